@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Wessie/sirencast/config"
+)
+
+// checkConfig runs the check-config command with the arguments given, it
+// reports every problem in the configuration file with the environment and
+// overrides applied, and returns the exit status to use.
+func checkConfig(args []string) int {
+	fs := flag.NewFlagSet("check-config", flag.ExitOnError)
+	confFile := fs.String("conf", config.DefaultFilename, "configuration file to check")
+	var settings settingsFlag
+	fs.Var(&settings, "set", "override a setting with `key=value`, can be given more than once")
+	fs.Parse(args)
+
+	_, err := config.Load(*confFile, config.FromEnv(), config.Overrides(settings...))
+	if err != nil {
+		if verr, ok := err.(config.ValidationError); ok {
+			for _, fe := range verr {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", *confFile, fe)
+			}
+		} else {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", *confFile, err)
+		}
+		return 1
+	}
+
+	fmt.Printf("%s: configuration is valid\n", *confFile)
+	return 0
+}
+
+// settingsFlag collects the key=value settings of repeated -set flags
+type settingsFlag []string
+
+func (s *settingsFlag) String() string {
+	return strings.Join(*s, " ")
+}
+
+func (s *settingsFlag) Set(kv string) error {
+	if !strings.Contains(kv, "=") {
+		return errors.New("expected key=value")
+	}
+	*s = append(*s, kv)
+	return nil
+}
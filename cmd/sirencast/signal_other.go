@@ -0,0 +1,14 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+import "os"
+
+// upgradeSignals are the signals that make us upgrade to a new binary,
+// upgrading isn't supported on this platform.
+var upgradeSignals []os.Signal
+
+// reloadSignals are the signals that make us reload the configuration,
+// there are none on this platform.
+var reloadSignals []os.Signal
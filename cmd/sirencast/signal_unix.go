@@ -0,0 +1,15 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// upgradeSignals are the signals that make us upgrade to a new binary
+var upgradeSignals = []os.Signal{syscall.SIGUSR2}
+
+// reloadSignals are the signals that make us reload the configuration
+var reloadSignals = []os.Signal{syscall.SIGHUP}
@@ -1,23 +1,144 @@
+// Command sirencast runs the sirencast streaming server.
+//
+// Settings are taken from, in increasing order of precedence: the defaults,
+// the configuration file given with -conf, SIRENCAST_* environment variables
+// and -set key=value flags. Use -print-config to see the result, and
+// "sirencast check-config" to validate it without starting the server.
 package main
 
 import (
+	"context"
+	"flag"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/Wessie/sirencast"
+	"github.com/Wessie/sirencast/config"
 	"github.com/Wessie/sirencast/icecast"
 	_ "github.com/Wessie/sirencast/web"
 )
 
+// shutdownTimeout is the time we give connections to drain on shutdown
+const shutdownTimeout = 10 * time.Second
+
 func main() {
-	environment, err := sirencast.Setup()
+	if len(os.Args) > 1 && os.Args[1] == "check-config" {
+		os.Exit(checkConfig(os.Args[2:]))
+	}
+
+	confFile := flag.String("conf", config.DefaultFilename, "configuration file to load")
+	allowDefault := flag.Bool("default", false,
+		"allow default configuration to be used if no file could be loaded")
+	writeDefault := flag.Bool("write-default", false,
+		"write the default configuration to the specified `conf` filename if it doesn't exist")
+	printConfig := flag.Bool("print-config", false,
+		"print the effective configuration after all overrides and exit")
+	var settings settingsFlag
+	flag.Var(&settings, "set", "override a setting with `key=value`, can be given more than once")
+	flag.Parse()
+
+	opts := []config.LoadOption{config.FromEnv(), config.Overrides(settings...)}
+	if *allowDefault {
+		opts = append(opts, config.AllowDefault())
+	}
+	if *writeDefault {
+		opts = append(opts, config.WriteDefault())
+	}
+
+	environment, err := config.LoadActive(*confFile, opts...)
+	if err != nil {
+		log.Fatal("sirencast: unable to load configuration: ", err)
+	}
+
+	if *printConfig {
+		if err := config.WriteConfig(os.Stdout, *environment); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	ice := icecast.NewServer(environment)
+	ice.RegisterDetectors(sirencast.DefaultDetectors)
+	ice.StartFileFallbacks()
+
+	server, err := sirencast.SetupServer(environment)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if err := sirencast.Setup(server); err != nil {
+		log.Fatal(err)
+	}
+	server.RegisterOnShutdown(ice.Close)
+	server.RegisterHandoff(ice.Handoff)
+	server.RegisterResumer(icecast.HandoffClient, ice.ResumeClient)
+	server.RegisterResumer(icecast.HandoffSource, ice.ResumeSource)
+	config.OnReload(ice.SetConfig)
+	config.OnReload(server.SetConfig)
+
+	served := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+
+		sig := make(chan os.Signal, 1)
+		signals := []os.Signal{syscall.SIGTERM, syscall.SIGINT}
+		signals = append(append(signals, upgradeSignals...), reloadSignals...)
+		signal.Notify(sig, signals...)
+
+		for s := range sig {
+			if isSignal(s, reloadSignals) {
+				log.Printf("sirencast: received %s, reloading configuration", s)
+				if _, err := config.Reload(); err != nil {
+					log.Println("sirencast: failed to reload configuration:", err)
+				}
+				continue
+			}
 
-	ice := icecast.NewServer()
-	sirencast.RegisterDetector(ice.Detect)
+			ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
 
-	if err = sirencast.Run(environment); err != nil {
+			if s == syscall.SIGTERM || s == syscall.SIGINT {
+				log.Printf("sirencast: received %s, shutting down", s)
+				if err := server.Shutdown(ctx); err != nil {
+					log.Println("sirencast: shutdown did not complete:", err)
+				}
+				cancel()
+				return
+			}
+
+			log.Printf("sirencast: received %s, upgrading", s)
+			err := server.Upgrade(ctx)
+			cancel()
+			if err == nil {
+				return
+			}
+			log.Println("sirencast: upgrade failed:", err)
+
+			// keep going if the new process never took over
+			select {
+			case <-served:
+				return
+			default:
+			}
+		}
+	}()
+
+	err = server.Serve()
+	close(served)
+	if err != sirencast.ErrServerClosed {
 		log.Fatal(err)
 	}
+	<-stopped
+}
+
+// isSignal returns true if s is one of signals
+func isSignal(s os.Signal, signals []os.Signal) bool {
+	for _, sig := range signals {
+		if s == sig {
+			return true
+		}
+	}
+	return false
 }
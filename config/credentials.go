@@ -0,0 +1,114 @@
+package config
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"strings"
+)
+
+// DefaultSourceUser is the username used by source clients that don't
+// let you configure one, this is the same as icecast uses.
+const DefaultSourceUser = "source"
+
+// DefaultAdminUser is the username used for the admin credentials if
+// none is configured, this is the same as icecast uses.
+const DefaultAdminUser = "admin"
+
+// ErrUnknownHash is returned when a password hash uses an unsupported algorithm
+var ErrUnknownHash = errors.New("credentials: unknown password hash algorithm")
+
+// Credentials is a username and password combination. The password can
+// either be stored in plain text in `Password` or as a hash in `PasswordHash`,
+// if both are set the hash is used.
+type Credentials struct {
+	// User is the username, if empty it defaults to DefaultSourceUser
+	User string `json:"user,omitempty"`
+	// Password is the plain text password
+	Password string `json:"password,omitempty"`
+	// PasswordHash is a hashed password of the form "algorithm:hexdigest",
+	// supported algorithms are sha1, sha256 and sha512.
+	PasswordHash string `json:"password_hash,omitempty"`
+}
+
+// Empty returns true if no password is configured
+func (c Credentials) Empty() bool {
+	return c.Password == "" && c.PasswordHash == ""
+}
+
+// Username returns the configured username or DefaultSourceUser if none is set
+func (c Credentials) Username() string {
+	if c.User == "" {
+		return DefaultSourceUser
+	}
+	return c.User
+}
+
+// Verify returns true if the user and passwd given match the credentials.
+// Empty credentials never verify.
+func (c Credentials) Verify(user, passwd string) bool {
+	if c.Empty() || user != c.Username() {
+		return false
+	}
+
+	if c.PasswordHash == "" {
+		return subtle.ConstantTimeCompare([]byte(c.Password), []byte(passwd)) == 1
+	}
+
+	h, digest, err := parseHash(c.PasswordHash)
+	if err != nil {
+		return false
+	}
+
+	h.Write([]byte(passwd))
+	return subtle.ConstantTimeCompare(h.Sum(nil), digest) == 1
+}
+
+// HashPassword returns passwd hashed with the algorithm given in a form
+// suitable for use in `Credentials.PasswordHash`.
+func HashPassword(algorithm, passwd string) (string, error) {
+	h := newHash(algorithm)
+	if h == nil {
+		return "", ErrUnknownHash
+	}
+
+	h.Write([]byte(passwd))
+	return algorithm + ":" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// parseHash splits a "algorithm:hexdigest" string into a hash
+// implementation and the decoded digest.
+func parseHash(s string) (hash.Hash, []byte, error) {
+	pair := strings.SplitN(s, ":", 2)
+	if len(pair) != 2 {
+		return nil, nil, ErrUnknownHash
+	}
+
+	h := newHash(pair[0])
+	if h == nil {
+		return nil, nil, ErrUnknownHash
+	}
+
+	digest, err := hex.DecodeString(pair[1])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return h, digest, nil
+}
+
+func newHash(algorithm string) hash.Hash {
+	switch strings.ToLower(algorithm) {
+	case "sha1":
+		return sha1.New()
+	case "sha256":
+		return sha256.New()
+	case "sha512":
+		return sha512.New()
+	}
+	return nil
+}
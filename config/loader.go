@@ -2,61 +2,210 @@ package config
 
 import (
 	"encoding/json"
-	"flag"
 	"io"
 	"log"
 	"os"
+	"sync"
+	"sync/atomic"
 )
 
 // DefaultFilename is the filename used as configuration if none is supplied
 const DefaultFilename = "sirencast.json"
 
-// Filename is the filename of the file we read the configuration from.
-var Filename string
+// Filename is the file Reload reads the configuration from, it is set by
+// LoadActive.
+var Filename = DefaultFilename
 
-// Active is the active configuration, and should be referenced in code using the
-// configuration. The configuration will be updated atomically if required.
-var Active *Config = &Default
+// active holds the active *Config, see Active
+var active atomic.Value
 
-// Loaded indicates if we were able to load a configuration successfully or not. It
-// is suggested to not continue executing if this variable is false when main is executed.
-var Loaded = false
+// reloadMu protects onReload and serializes reloads
+var reloadMu sync.Mutex
 
-func init() {
-	flag.StringVar(&Filename, "conf", DefaultFilename, "configuration file to load")
-	allowDefault := flag.Bool("default", false,
-		"allow default configuration to be used if no file could be loaded")
-	writeDefault := flag.Bool("write-default", false,
-		"write the default configuration to the specified `conf` filename if unable to load it")
-	flag.Parse()
+// onReload are the functions called with a new active configuration
+var onReload []func(*Config)
 
-	f, err := os.Open(Filename)
+// Active returns the active configuration, and should be called by code using
+// the configuration every time it needs it. The configuration is replaced
+// atomically on a reload, the Config returned should never be modified.
+func Active() *Config {
+	if conf, ok := active.Load().(*Config); ok {
+		return conf
+	}
+	return &Default
+}
+
+// SetActive atomically replaces the active configuration with conf, and
+// calls the functions registered with OnReload.
+func SetActive(conf *Config) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	setActive(conf)
+}
+
+func setActive(conf *Config) {
+	active.Store(conf)
+	for _, f := range onReload {
+		f(conf)
+	}
+}
+
+// OnReload registers f to be called with the new configuration every
+// time the active configuration is replaced.
+func OnReload(f func(*Config)) {
+	reloadMu.Lock()
+	onReload = append(onReload, f)
+	reloadMu.Unlock()
+}
+
+// Reload reads the configuration file again and makes it the active
+// configuration if it is valid. The active configuration is left alone
+// if an error is returned.
+func Reload() (*Config, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	conf, err := reloadOptions.load(Filename)
 	if err != nil {
-		log.Printf("unable to load configuration file '%s'", Filename)
-		goto defaults
+		return nil, err
+	}
+
+	setActive(conf)
+	return conf, nil
+}
+
+// readFile reads the configuration in the file given, any settings the
+// file doesn't have are taken from Default.
+func readFile(filename string) (*Config, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
 	}
 	defer f.Close()
 
-	if err := ReadConfig(Active, f); err != nil {
-		log.Printf("unable to parse configuration file: %s", err)
-		goto defaults
+	conf := Default
+	if err := ReadConfig(&conf, f); err != nil {
+		return nil, err
 	}
+	return &conf, nil
+}
+
+// LoadOption changes the behaviour of Load
+type LoadOption func(*loadOptions)
+
+type loadOptions struct {
+	allowDefault bool
+	writeDefault bool
+	env          bool
+	overrides    []string
+}
+
+// AllowDefault makes Load use Default if the configuration file can't be
+// loaded, instead of returning an error.
+func AllowDefault() LoadOption {
+	return func(o *loadOptions) { o.allowDefault = true }
+}
 
-	Loaded = true
-	return
+// WriteDefault makes Load write Default to the configuration file if it
+// doesn't exist yet.
+func WriteDefault() LoadOption {
+	return func(o *loadOptions) { o.writeDefault = true }
+}
 
-defaults:
-	Loaded = *allowDefault
+// FromEnv makes Load apply the SIRENCAST_* environment variables over the
+// configuration file, see Config.SetEnv.
+func FromEnv() LoadOption {
+	return func(o *loadOptions) { o.env = true }
+}
 
-	// Nothing left to do if this is false
-	if !*writeDefault {
-		return
+// Overrides makes Load apply the "key=value" settings given over the
+// configuration file and environment, see Config.Set.
+func Overrides(settings ...string) LoadOption {
+	return func(o *loadOptions) { o.overrides = append(o.overrides, settings...) }
+}
+
+// Load reads and validates the configuration in the file at path. Settings
+// are taken from, in increasing order of precedence: Default, the file, the
+// environment if FromEnv is given and the settings given with Overrides.
+// The configuration returned isn't made active, see SetActive.
+func Load(path string, opts ...LoadOption) (*Config, error) {
+	var o loadOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o.load(path)
+}
+
+func (o loadOptions) load(path string) (*Config, error) {
+	conf, err := readFile(path)
+	if err == nil {
+		err = o.apply(conf)
+	}
+	if err == nil {
+		err = conf.Validate()
+	}
+	if err == nil {
+		return conf, nil
+	}
+
+	if o.writeDefault && os.IsNotExist(err) {
+		if err := CreateDefault(path); err != nil {
+			log.Printf("unable to write default configuration to file '%s': %s", path, err)
+		}
+	}
+
+	if !o.allowDefault {
+		return nil, err
+	}
+
+	log.Printf("unable to load configuration file '%s', using defaults: %s", path, err)
+	conf = new(Config)
+	*conf = Default
+	if err := o.apply(conf); err != nil {
+		return nil, err
 	}
 
-	// else write the default config to file
-	if err := CreateDefault(Filename); err != nil {
-		log.Printf("unable to write default configuration to file '%s': %s", Filename, err)
+	// the defaults are used even if they aren't complete
+	if err := conf.Validate(); err != nil {
+		log.Printf("default configuration is incomplete: %s", err)
 	}
+	return conf, nil
+}
+
+// apply applies the environment and overrides to conf
+func (o loadOptions) apply(conf *Config) error {
+	if o.env {
+		if err := conf.SetEnv(os.Environ()); err != nil {
+			return err
+		}
+	}
+	return conf.SetAll(o.overrides)
+}
+
+// reloadOptions are the options Reload loads Filename with
+var reloadOptions loadOptions
+
+// LoadActive loads the configuration like Load and makes it the active
+// configuration. Reload reads the same file again afterwards, applying the
+// same environment and overrides, but never falls back to the defaults.
+func LoadActive(path string, opts ...LoadOption) (*Config, error) {
+	var o loadOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	conf, err := o.load(path)
+	if err != nil {
+		return nil, err
+	}
+
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	o.allowDefault, o.writeDefault = false, false
+	Filename, reloadOptions = path, o
+	setActive(conf)
+	return conf, nil
 }
 
 // ReadConfig reads a configuration from `r` and stores it
@@ -66,9 +215,12 @@ func ReadConfig(conf *Config, r io.Reader) error {
 }
 
 // WriteConfig writes the configuration `conf` to writer
-// `w`. The current format is JSON.
+// `w`. The current format is indented JSON, which can be used to dump
+// the effective configuration after all overrides.
 func WriteConfig(w io.Writer, conf Config) error {
-	return json.NewEncoder(w).Encode(conf)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	return enc.Encode(conf)
 }
 
 // CreateDefault creates file `filename` and writes the
@@ -0,0 +1,115 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "sirencast")
+	if err != nil {
+		t.Fatal("failed to create directory:", err)
+	}
+	return dir
+}
+
+func TestLoad(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "sirencast.json")
+	if _, err := Load(path); err == nil {
+		t.Fatal("loading a missing file succeeded")
+	}
+
+	conf, err := Load(path, AllowDefault())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf == &Default || conf.Addr != Default.Addr {
+		t.Errorf("expected a copy of the defaults, got %+v", conf)
+	}
+
+	if _, err := Load(path, WriteDefault()); err == nil {
+		t.Error("loading a missing file succeeded")
+	}
+
+	// the default has no passwords, which have to be filled in
+	if _, err := Load(path); err == nil {
+		t.Error("loading the written default succeeded")
+	} else if _, ok := err.(ValidationError); !ok {
+		t.Error("failed to read written default:", err)
+	}
+
+	// settings missing from the file are taken from the defaults
+	err = ioutil.WriteFile(path, []byte(`{"source": {"password": "hackme"}, "mounts": [{"name": "/main"}]}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conf, err = Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.Addr != Default.Addr || conf.Mount("/main") == nil {
+		t.Errorf("unexpected configuration: %+v", conf)
+	}
+
+	// an invalid file isn't replaced by the default
+	err = ioutil.WriteFile(path, []byte(`{"mounts": [{"name": "main"}]}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(path, WriteDefault()); err == nil {
+		t.Error("loading an invalid file succeeded")
+	}
+	if b, _ := ioutil.ReadFile(path); string(b) != `{"mounts": [{"name": "main"}]}` {
+		t.Errorf("invalid file was overwritten: %s", b)
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	defer func(filename string) { Filename = filename }(Filename)
+	Filename = filepath.Join(dir, "sirencast.json")
+
+	// the package state is restored for the tests after us
+	prev := Active()
+	reloadMu.Lock()
+	handlers, options := onReload, reloadOptions
+	reloadOptions = loadOptions{}
+	reloadMu.Unlock()
+	defer func() {
+		reloadMu.Lock()
+		active.Store(prev)
+		onReload, reloadOptions = handlers, options
+		reloadMu.Unlock()
+	}()
+
+	var reloaded *Config
+	OnReload(func(c *Config) { reloaded = c })
+
+	if _, err := Reload(); err == nil {
+		t.Error("reloading a missing file succeeded")
+	}
+	if reloaded != nil || Active() != prev {
+		t.Error("failed reload replaced the active configuration")
+	}
+
+	err := ioutil.WriteFile(Filename, []byte(`{"address": "localhost:8000", "source": {"password": "hackme"}}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conf, err := Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.Addr != "localhost:8000" || Active() != conf || reloaded != conf {
+		t.Errorf("reload did not replace the active configuration")
+	}
+}
@@ -0,0 +1,287 @@
+package config
+
+import (
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// EnvPrefix is the prefix of environment variables that override settings,
+// the rest of the name is the key of the setting in upper case with dots
+// and indexes separated by underscores, SIRENCAST_MOUNTS_0_METAINT sets
+// mounts[0].metaint for example.
+const EnvPrefix = "SIRENCAST_"
+
+// Set sets the setting at key to value. The key is the path to the setting
+// using the JSON names, such as "http_server.address" or "mounts[0].metaint".
+// Lists grow by one entry when the index right past their end is set.
+func (c *Config) Set(key, value string) error {
+	path, ok := parseKey(key)
+	if !ok {
+		return FieldError{key, "invalid setting name"}
+	}
+
+	if msg := setValue(reflect.ValueOf(c).Elem(), path, value); msg != "" {
+		return FieldError{key, msg}
+	}
+	return nil
+}
+
+// SetEnv sets the settings given by the SIRENCAST_* variables in env, which
+// holds "key=value" entries as returned by os.Environ. Variables with the
+// prefix that don't name a setting are errors, like unknown keys given to Set.
+func (c *Config) SetEnv(env []string) error {
+	env = append([]string(nil), env...)
+	// list indexes are set in order, so the lists can grow one at a time
+	sort.SliceStable(env, func(i, j int) bool {
+		a, _ := splitEnv(env[i])
+		b, _ := splitEnv(env[j])
+		return naturalLess(a, b)
+	})
+
+	var errs ValidationError
+	for _, kv := range env {
+		if !strings.HasPrefix(kv, EnvPrefix) {
+			continue
+		}
+
+		name, value := splitEnv(kv)
+		key := strings.ToLower(name[len(EnvPrefix):])
+		path, ok := envPath(reflect.TypeOf(*c), key)
+		if !ok {
+			errs = append(errs, FieldError{name, "unknown setting"})
+			continue
+		}
+
+		if msg := setValue(reflect.ValueOf(c).Elem(), path, value); msg != "" {
+			errs = append(errs, FieldError{name, msg})
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// splitEnv splits an environment entry into its name and value
+func splitEnv(kv string) (name, value string) {
+	if i := strings.IndexByte(kv, '='); i >= 0 {
+		return kv[:i], kv[i+1:]
+	}
+	return kv, ""
+}
+
+// SetAll sets the settings given as "key=value" pairs, see Set
+func (c *Config) SetAll(settings []string) error {
+	var errs ValidationError
+	for _, kv := range settings {
+		i := strings.IndexByte(kv, '=')
+		if i < 0 {
+			errs = append(errs, FieldError{kv, "expected key=value"})
+			continue
+		}
+
+		if err := c.Set(kv[:i], kv[i+1:]); err != nil {
+			errs = append(errs, err.(FieldError))
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// naturalLess compares a and b with runs of digits compared as numbers, such
+// that SIRENCAST_MOUNTS_2_NAME sorts before SIRENCAST_MOUNTS_10_NAME.
+func naturalLess(a, b string) bool {
+	for a != "" && b != "" {
+		da, db := leadingDigits(a), leadingDigits(b)
+		if da == 0 || db == 0 {
+			if a[0] != b[0] {
+				return a[0] < b[0]
+			}
+			a, b = a[1:], b[1:]
+			continue
+		}
+
+		na, nb := strings.TrimLeft(a[:da], "0"), strings.TrimLeft(b[:db], "0")
+		if len(na) != len(nb) {
+			return len(na) < len(nb)
+		}
+		if na != nb {
+			return na < nb
+		}
+		a, b = a[da:], b[db:]
+	}
+	return len(a) < len(b)
+}
+
+// leadingDigits returns the amount of digits s starts with
+func leadingDigits(s string) int {
+	n := 0
+	for n < len(s) && s[n] >= '0' && s[n] <= '9' {
+		n++
+	}
+	return n
+}
+
+// parseKey splits a key such as "mounts[0].name" into its parts, indexes
+// become parts of their own: "mounts", "0", "name".
+func parseKey(key string) ([]string, bool) {
+	var path []string
+	for _, part := range strings.Split(key, ".") {
+		name := part
+		if i := strings.IndexByte(part, '['); i >= 0 {
+			name, part = part[:i], part[i:]
+		} else {
+			part = ""
+		}
+		if name == "" {
+			return nil, false
+		}
+		path = append(path, name)
+
+		for part != "" {
+			end := strings.IndexByte(part, ']')
+			if part[0] != '[' || end < 0 {
+				return nil, false
+			}
+			path = append(path, part[1:end])
+			part = part[end+1:]
+		}
+	}
+	return path, true
+}
+
+// envPath finds the path to the setting in t named by key, a lower case
+// environment variable name without prefix. JSON names contain underscores
+// themselves, so every field that matches is tried.
+func envPath(t reflect.Type, key string) ([]string, bool) {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return envPath(t.Elem(), key)
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			name := jsonName(t.Field(i))
+			if name == "" {
+				continue
+			}
+
+			lower := strings.ToLower(name)
+			if key == lower {
+				return []string{name}, true
+			}
+			if strings.HasPrefix(key, lower+"_") {
+				if rest, ok := envPath(t.Field(i).Type, key[len(lower)+1:]); ok {
+					return append([]string{name}, rest...), true
+				}
+			}
+		}
+	case reflect.Slice:
+		index, rest := key, ""
+		if i := strings.IndexByte(key, '_'); i >= 0 {
+			index, rest = key[:i], key[i+1:]
+		}
+		if _, err := strconv.Atoi(index); err != nil {
+			return nil, false
+		}
+		if rest == "" {
+			return []string{index}, true
+		}
+		if path, ok := envPath(t.Elem(), rest); ok {
+			return append([]string{index}, path...), true
+		}
+	}
+	return nil, false
+}
+
+// setValue sets the setting at path in v to value, and returns a message
+// describing the problem if that isn't possible.
+func setValue(v reflect.Value, path []string, value string) string {
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return setValue(v.Elem(), path, value)
+	}
+
+	if len(path) == 0 {
+		return setLeaf(v, value)
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if jsonName(v.Type().Field(i)) == path[0] {
+				return setValue(v.Field(i), path[1:], value)
+			}
+		}
+		return "unknown setting " + strconv.Quote(path[0])
+	case reflect.Slice:
+		i, err := strconv.Atoi(path[0])
+		if err != nil || i < 0 {
+			return "invalid index " + strconv.Quote(path[0])
+		}
+		if i > v.Len() {
+			return "index " + path[0] + " is past the end of the list, set index " +
+				strconv.Itoa(v.Len()) + " first"
+		}
+		if i == v.Len() {
+			v.Set(reflect.Append(v, reflect.Zero(v.Type().Elem())))
+		}
+		return setValue(v.Index(i), path[1:], value)
+	}
+	return "unknown setting " + strconv.Quote(path[0])
+}
+
+// setLeaf sets a single value, lists of strings are separated by commas and
+// an empty value is an empty list.
+func setLeaf(v reflect.Value, value string) string {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return "invalid boolean " + strconv.Quote(value)
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, v.Type().Bits())
+		if err != nil {
+			return "invalid number " + strconv.Quote(value)
+		}
+		v.SetInt(n)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.String {
+			return "can only set the fields of list elements"
+		}
+		if value == "" {
+			v.Set(reflect.MakeSlice(v.Type(), 0, 0))
+			break
+		}
+		v.Set(reflect.ValueOf(strings.Split(value, ",")).Convert(v.Type()))
+	default:
+		return "can only set the fields of this setting"
+	}
+	return ""
+}
+
+// jsonName returns the name of the field in JSON, or "" if it has none
+func jsonName(f reflect.StructField) string {
+	if f.PkgPath != "" {
+		return ""
+	}
+
+	name := strings.Split(f.Tag.Get("json"), ",")[0]
+	switch name {
+	case "-":
+		return ""
+	case "":
+		return f.Name
+	}
+	return name
+}
@@ -0,0 +1,130 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSet(t *testing.T) {
+	var conf Config
+	err := conf.SetAll([]string{
+		"address=localhost:8000",
+		"http_server.disabled=true",
+		"mounts[0].metaint=8192",
+		"mounts[1].name=/second",
+		"mounts[1].public=false",
+		"shoutcast.streams[0].id=2",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if conf.Addr != "localhost:8000" || !conf.HTTP.Disabled {
+		t.Errorf("unexpected configuration: %+v", conf)
+	}
+	if len(conf.Mounts) != 2 || conf.Mounts[0].Metaint != 8192 || conf.Mounts[1].Name != "/second" {
+		t.Errorf("unexpected mounts: %+v", conf.Mounts)
+	}
+	if p := conf.Mounts[1].Public; p == nil || *p {
+		t.Errorf("public was not set")
+	}
+	if len(conf.Shoutcast.Streams) != 1 || conf.Shoutcast.Streams[0].ID != 2 {
+		t.Errorf("unexpected streams: %+v", conf.Shoutcast.Streams)
+	}
+
+	for _, kv := range []string{"unknown=1", "mounts[x].name=/a", "mounts[3].name=/a", "address.port=1", "http_server=1", "mounts[0].metaint=many", "address"} {
+		if err := conf.SetAll([]string{kv}); err == nil {
+			t.Errorf("setting %s succeeded", kv)
+		}
+	}
+}
+
+func TestSetEnv(t *testing.T) {
+	var conf Config
+	err := conf.SetEnv([]string{
+		"HOME=/root",
+		"SIRENCAST_HTTP_SERVER_ADDRESS=localhost:8080",
+		"SIRENCAST_SOURCE_PASSWORD_HASH=sha1:abcd",
+		"SIRENCAST_MOUNTS_0_FALLBACK_MOUNT=/fallback",
+		"SIRENCAST_MOUNTS_0_FALLBACK_BITRATE=64",
+		"SIRENCAST_MOUNTS_10_NAME=/tenth",
+		"SIRENCAST_MOUNTS_9_NAME=/ninth",
+		"SIRENCAST_MOUNTS_8_NAME=/eighth",
+		"SIRENCAST_MOUNTS_7_NAME=/seventh",
+		"SIRENCAST_MOUNTS_6_NAME=/sixth",
+		"SIRENCAST_MOUNTS_5_NAME=/fifth",
+		"SIRENCAST_MOUNTS_4_NAME=/fourth",
+		"SIRENCAST_MOUNTS_3_NAME=/third",
+		"SIRENCAST_MOUNTS_2_NAME=/second",
+		"SIRENCAST_MOUNTS_1_NAME=/first",
+		"SIRENCAST_REJECT_UNDECLARED_MOUNTS=1",
+		"SIRENCAST_LISTENERS_0_ADDRESS=localhost:8001",
+		"SIRENCAST_LISTENERS_0_DETECTORS=",
+		"SIRENCAST_ADMIN_USER=second",
+		"SIRENCAST_ADMIN_USER=first",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if conf.HTTP.Addr != "localhost:8080" || conf.Source.PasswordHash != "sha1:abcd" || !conf.RejectUndeclaredMounts {
+		t.Errorf("unexpected configuration: %+v", conf)
+	}
+	if len(conf.Mounts) != 11 || conf.Mounts[0].Fallback != "/fallback" ||
+		conf.Mounts[0].FallbackBitrate != 64 || conf.Mounts[10].Name != "/tenth" {
+		t.Errorf("unexpected mounts: %+v", conf.Mounts)
+	}
+	if len(conf.Listeners) != 1 || conf.Listeners[0].Detectors == nil || len(conf.Listeners[0].Detectors) != 0 {
+		t.Errorf("unexpected listeners: %+v", conf.Listeners)
+	}
+	// the values don't take part in the ordering
+	if conf.Admin.User != "first" {
+		t.Errorf("unexpected admin user: %s", conf.Admin.User)
+	}
+
+	err = conf.SetEnv([]string{
+		"SIRENCAST_MOUNTS_20_NAME=/far",
+		"SIRENCAST_MOUNTS_0=1",
+		"SIRENCAST_UNKNOWN=1",
+		"SIRENCAST_MOUNTS_0_NAEM=/typo",
+	})
+	if verr, ok := err.(ValidationError); !ok || len(verr) != 4 {
+		t.Errorf("expected four errors, got %v", err)
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "sirencast.json")
+	err := ioutil.WriteFile(path, []byte(`{
+		"address": "file:1",
+		"admin": {"user": "file", "password": "file"},
+		"source": {"user": "file", "password": "file"}
+	}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("SIRENCAST_ADMIN_USER", "env")
+	os.Setenv("SIRENCAST_SOURCE_USER", "env")
+	defer os.Unsetenv("SIRENCAST_ADMIN_USER")
+	defer os.Unsetenv("SIRENCAST_SOURCE_USER")
+
+	conf, err := Load(path, FromEnv(), Overrides("source.user=flag"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if conf.HTTP != Default.HTTP || conf.Addr != "file:1" || conf.Admin.User != "env" || conf.Source.User != "flag" {
+		t.Errorf("unexpected configuration: %+v", conf)
+	}
+
+	// the environment is only used when asked for
+	if conf, _ := Load(path); conf.Admin.User != "file" {
+		t.Errorf("environment was used without FromEnv")
+	}
+}
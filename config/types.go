@@ -1,14 +1,142 @@
 package config
 
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
 // Config is the configuration root and deals with configuration for
 // the streaming server.
 type Config struct {
 	// Addr is the address to bind the server to, this is used for
 	// the streaming component and optionally for the HTTP server
 	// if no alternative address is used and the HTTP server isn't
-	// disabled.
-	Addr string     `json:"address"`
-	HTTP HTTPServer `json:"http_server"`
+	// disabled. It can be empty if Listeners is used instead.
+	Addr string `json:"address"`
+	// Listeners are more addresses to accept connections on next to
+	// Addr, each with its own TLS and detector settings.
+	Listeners []Listener `json:"listeners,omitempty"`
+	HTTP      HTTPServer `json:"http_server"`
+	// TLS is the configuration for accepting TLS connections on Addr,
+	// the certificates are also used by Listeners with TLS enabled.
+	TLS TLS `json:"tls"`
+	// Detection limits the time and data new connections get to be detected
+	Detection Detection `json:"detection"`
+	// TrustedProxies are the addresses or CIDR networks of proxies that
+	// send a PROXY protocol (v1 or v2) header, the client address in the
+	// header is used instead of the address of the proxy.
+	TrustedProxies []string `json:"trusted_proxies,omitempty"`
+	// Source are the global credentials a source has to supply to
+	// be allowed to stream to a mount. These are used for any mount
+	// that has no credentials of its own configured.
+	Source Credentials `json:"source"`
+	// Admin are the credentials required to use the administrative
+	// functions on any mount.
+	Admin Credentials `json:"admin"`
+	// Mounts are the mountpoint specific configurations.
+	Mounts []Mount `json:"mounts,omitempty"`
+	// Shoutcast is the configuration for SHOUTcast compatible sources
+	Shoutcast Shoutcast `json:"shoutcast"`
+	// HandoffConnections indicates if live source and listener connections
+	// are passed to the new process on an upgrade, instead of only the
+	// listening socket. TLS connections are closed instead.
+	HandoffConnections bool `json:"handoff_connections"`
+	// RejectUndeclaredMounts indicates if sources are refused when they
+	// connect to a mount that isn't declared in Mounts, otherwise any
+	// mount is created when the first source connects to it.
+	RejectUndeclaredMounts bool `json:"reject_undeclared_mounts"`
+}
+
+// AllListeners returns Listeners with the listener on Addr in front of them
+func (c *Config) AllListeners() []Listener {
+	ls := make([]Listener, 0, len(c.Listeners)+1)
+	if c.Addr != "" {
+		l := Listener{Addr: c.Addr}
+		if c.TLS.Enabled() {
+			l.TLS = TLSRequired
+			if c.TLS.Detect {
+				l.TLS = TLSDetect
+			}
+		}
+		ls = append(ls, l)
+	}
+	return append(ls, c.Listeners...)
+}
+
+// Listener returns the listener with the same network and address as l,
+// or nil if no such listener is configured.
+func (c *Config) Listener(l Listener) *Listener {
+	for _, cl := range c.AllListeners() {
+		if cl.Net() == l.Net() && cl.Addr == l.Addr {
+			return &cl
+		}
+	}
+	return nil
+}
+
+// ProxyNetworks returns the networks of TrustedProxies, invalid entries
+// are skipped.
+func (c *Config) ProxyNetworks() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, s := range c.TrustedProxies {
+		if n, err := parseNetwork(s); err == nil {
+			nets = append(nets, n)
+		}
+	}
+	return nets
+}
+
+// parseNetwork parses a CIDR network or a single IP address
+func parseNetwork(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address %q", s)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)}, nil
+	}
+
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid network %q", s)
+	}
+	return n, nil
+}
+
+// Mount returns the configuration of the mount with the name given, or
+// nil if no configuration exists for it.
+func (c *Config) Mount(name string) *Mount {
+	for i := range c.Mounts {
+		if c.Mounts[i].Name == name {
+			return &c.Mounts[i]
+		}
+	}
+	return nil
+}
+
+// SourceCredentials returns the credentials a source needs to supply to
+// stream to the mount given. These are the mount specific credentials
+// if they exist, otherwise the global source credentials.
+func (c *Config) SourceCredentials(mount string) Credentials {
+	if m := c.Mount(mount); m != nil && !m.Source.Empty() {
+		return m.Source
+	}
+	return c.Source
+}
+
+// AdminCredentials returns the admin credentials, the username defaults
+// to DefaultAdminUser if none was configured.
+func (c *Config) AdminCredentials() Credentials {
+	creds := c.Admin
+	if creds.User == "" {
+		creds.User = DefaultAdminUser
+	}
+	return creds
 }
 
 // HTTPServer is an optional configuration for the HTTP server included
@@ -21,3 +149,206 @@ type HTTPServer struct {
 	// instead of using `Server.Addr`.
 	Addr string `json:"address,omitempty"`
 }
+
+// Detection limits what a new connection can use before a detector found a
+// handler for it, this protects against clients that connect and then send
+// little or nothing at all.
+type Detection struct {
+	// TimeoutSeconds is the time a connection has to send enough data to
+	// be detected, this includes the PROXY header and TLS handshake.
+	// Defaults to DefaultDetectionTimeout.
+	TimeoutSeconds int `json:"timeout_seconds,omitempty"`
+	// MaxBytes is the amount of data detectors can peek at, defaults to
+	// DefaultDetectionBytes.
+	MaxBytes int `json:"max_bytes,omitempty"`
+	// MaxPending is the amount of connections that can be in detection at
+	// once, new connections are closed while it is reached. Defaults to
+	// DefaultDetectionPending.
+	MaxPending int `json:"max_pending,omitempty"`
+}
+
+// The defaults of Detection
+const (
+	DefaultDetectionTimeout = 10 * time.Second
+	DefaultDetectionBytes   = 16 * 1024
+	DefaultDetectionPending = 1024
+)
+
+// Timeout returns the configured timeout or DefaultDetectionTimeout
+func (d Detection) Timeout() time.Duration {
+	if d.TimeoutSeconds <= 0 {
+		return DefaultDetectionTimeout
+	}
+	return time.Duration(d.TimeoutSeconds) * time.Second
+}
+
+// Bytes returns the configured maximum of data or DefaultDetectionBytes
+func (d Detection) Bytes() int {
+	if d.MaxBytes <= 0 {
+		return DefaultDetectionBytes
+	}
+	return d.MaxBytes
+}
+
+// Pending returns the configured maximum of pending connections or
+// DefaultDetectionPending
+func (d Detection) Pending() int {
+	if d.MaxPending <= 0 {
+		return DefaultDetectionPending
+	}
+	return d.MaxPending
+}
+
+// Listener is an address the server accepts connections on
+type Listener struct {
+	// Network is "tcp" (the default), "tcp4", "tcp6" or "unix"
+	Network string `json:"network,omitempty"`
+	// Addr is the host:port address to listen on, or the path of the
+	// socket for the unix network.
+	Addr string `json:"address"`
+	// TLS is TLSDetect to accept both TLS and plain connections, or
+	// TLSRequired to only accept TLS connections. Only plain connections
+	// are accepted if empty. The certificates are taken from Config.TLS.
+	TLS string `json:"tls,omitempty"`
+	// Detectors are the names of the detectors used for connections on
+	// this listener, every detector is used if empty. The handler for
+	// connections no detector claims is named "default", the others are
+	// "icecast.source", "icecast.listener", "icecast.admin", "shoutcast"
+	// and "shoutcast2".
+	Detectors []string `json:"detectors,omitempty"`
+}
+
+// The TLS modes of a Listener
+const (
+	TLSDetect   = "detect"
+	TLSRequired = "required"
+)
+
+// Net returns the network of the listener, with tcp as the default
+func (l Listener) Net() string {
+	if l.Network == "" {
+		return "tcp"
+	}
+	return l.Network
+}
+
+// String returns the network and address of the listener
+func (l Listener) String() string {
+	return l.Net() + ":" + l.Addr
+}
+
+// TLS is the configuration for TLS termination. Connections are decrypted
+// before the detectors see them, so every protocol can be used over TLS.
+type TLS struct {
+	// Certificates are the certificates to serve, the first one valid for
+	// the server name the client asks for is used (SNI), or the first one
+	// if none are. TLS is disabled if this is empty.
+	Certificates []Certificate `json:"certificates,omitempty"`
+	// Detect allows plain connections next to TLS connections on Addr, TLS
+	// connections are recognized by their ClientHello. Otherwise every
+	// connection has to use TLS once certificates are configured.
+	Detect bool `json:"detect"`
+}
+
+// Enabled returns true if TLS connections are accepted
+func (t TLS) Enabled() bool {
+	return len(t.Certificates) > 0
+}
+
+// Certificate is a certificate and private key pair, both PEM encoded. The
+// certificate file can contain intermediate certificates after the leaf.
+type Certificate struct {
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+}
+
+// Mount is the configuration of a single mountpoint.
+type Mount struct {
+	// Name is the path of the mount, including the leading slash.
+	Name string `json:"name"`
+	// ContentType is the content-type sources have to send to stream to
+	// this mount, any content-type is allowed if empty.
+	ContentType string `json:"content_type,omitempty"`
+	// Source are the credentials required to stream to this mount,
+	// if empty the global source credentials are used instead.
+	Source Credentials `json:"source,omitempty"`
+	// Fallback is the name of the mount listeners are moved to when
+	// the last source of this mount disconnects. They are moved back
+	// once a source connects again.
+	Fallback string `json:"fallback_mount,omitempty"`
+	// FallbackFile is a file or M3U playlist that is played in a loop
+	// while no source is connected to the mount.
+	FallbackFile string `json:"fallback_file,omitempty"`
+	// FallbackBitrate is the bitrate in kbit/s FallbackFile is played at,
+	// it is found from the file itself if zero.
+	FallbackBitrate int `json:"fallback_bitrate,omitempty"`
+	// BurstSize is the amount of bytes send to a new listener right away
+	// when it connects, defaults to 64KB. A negative size disables it.
+	BurstSize int `json:"burst_size,omitempty"`
+	// BurstSeconds is the burst size in seconds of audio, it is used over
+	// BurstSize whenever the bitrate of the stream is known.
+	BurstSeconds int `json:"burst_seconds,omitempty"`
+	// Metaint is the amount of bytes between ICY metadata sections send
+	// to listeners, defaults to 16000.
+	Metaint int `json:"metaint,omitempty"`
+	// MaxListeners is the maximum amount of listeners allowed on the mount
+	// at once, zero means no limit.
+	MaxListeners int `json:"max_listeners,omitempty"`
+	// Charset is the character set of metadata updates that don't specify
+	// one, defaults to UTF-8.
+	Charset string `json:"charset,omitempty"`
+
+	// Public overrides if the stream is listed in directories, otherwise
+	// the source decides.
+	Public *bool `json:"public,omitempty"`
+	// StreamName, StreamDescription, StreamGenre and StreamURL override the
+	// stream information send by the source when not empty.
+	StreamName        string `json:"stream_name,omitempty"`
+	StreamDescription string `json:"stream_description,omitempty"`
+	StreamGenre       string `json:"stream_genre,omitempty"`
+	StreamURL         string `json:"stream_url,omitempty"`
+}
+
+// Shoutcast is the configuration for sources using one of the SHOUTcast
+// source protocols. These protocols have no notion of mounts so we need
+// to know which mount to attach them to.
+type Shoutcast struct {
+	// Mount is the mount SHOUTcast v1 sources are attached to, the
+	// protocol is disabled if this is empty.
+	Mount string `json:"mount,omitempty"`
+	// CipherKey is the key SHOUTcast v2 sources use to encrypt their
+	// credentials with, defaults to DefaultCipherKey if empty.
+	CipherKey string `json:"cipher_key,omitempty"`
+	// Streams maps SHOUTcast v2 stream IDs to mounts, the protocol is
+	// disabled if this is empty.
+	Streams []ShoutcastStream `json:"streams,omitempty"`
+}
+
+// DefaultCipherKey is the cipher key used by SHOUTcast v2 sources
+// if none is configured, this is the same as the SHOUTcast DNAS uses.
+const DefaultCipherKey = "foobar2000"
+
+// Key returns the configured cipher key or DefaultCipherKey if none is set
+func (s Shoutcast) Key() string {
+	if s.CipherKey == "" {
+		return DefaultCipherKey
+	}
+	return s.CipherKey
+}
+
+// StreamMount returns the mount the SHOUTcast v2 stream ID given is
+// mapped to, or an empty string if it isn't mapped.
+func (s Shoutcast) StreamMount(id int) string {
+	for _, st := range s.Streams {
+		if st.ID == id {
+			return st.Mount
+		}
+	}
+	return ""
+}
+
+// ShoutcastStream maps a SHOUTcast v2 stream ID to a mount
+type ShoutcastStream struct {
+	ID    int    `json:"id"`
+	Mount string `json:"mount"`
+}
@@ -0,0 +1,231 @@
+package config
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/Wessie/sirencast/util/taxtic"
+)
+
+// FieldError is a problem with a single setting, Field is the path to the
+// setting using the JSON names, such as "mounts[1].metaint".
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+func (e FieldError) Error() string {
+	return e.Field + ": " + e.Message
+}
+
+// ValidationError holds every problem Validate found in a configuration
+type ValidationError []FieldError
+
+func (e ValidationError) Error() string {
+	msgs := make([]string, len(e))
+	for i, fe := range e {
+		msgs[i] = fe.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Validate checks the configuration for settings that can't work, it
+// returns a ValidationError describing every problem found or nil.
+func (c *Config) Validate() error {
+	var errs ValidationError
+	add := func(field, format string, args ...interface{}) {
+		errs = append(errs, FieldError{field, fmt.Sprintf(format, args...)})
+	}
+
+	if c.Addr == "" {
+		if len(c.Listeners) == 0 {
+			add("address", "no address configured")
+		}
+	} else if err := checkAddr(c.Addr); err != nil {
+		add("address", "%s", err)
+	}
+
+	addrs := map[string]bool{}
+	if c.Addr != "" {
+		addrs[Listener{Addr: c.Addr}.String()] = true
+	}
+	for i, l := range c.Listeners {
+		field := fmt.Sprintf("listeners[%d].", i)
+
+		switch l.Net() {
+		case "tcp", "tcp4", "tcp6":
+			if err := checkAddr(l.Addr); err != nil {
+				add(field+"address", "%s", err)
+			} else if addrs[l.String()] {
+				add(field+"address", "%q is listened on more than once", l.Addr)
+			}
+		case "unix":
+			if l.Addr == "" {
+				add(field+"address", "no socket path configured")
+			} else if addrs[l.String()] {
+				add(field+"address", "%q is listened on more than once", l.Addr)
+			}
+		default:
+			add(field+"network", "unknown network %q", l.Network)
+		}
+		addrs[l.String()] = true
+
+		switch l.TLS {
+		case "":
+		case TLSDetect, TLSRequired:
+			if !c.TLS.Enabled() {
+				add(field+"tls", "no certificates configured")
+			}
+		default:
+			add(field+"tls", "unknown mode %q, expected %q or %q", l.TLS, TLSDetect, TLSRequired)
+		}
+
+		for j, name := range l.Detectors {
+			if name == "" {
+				add(fmt.Sprintf("%sdetectors[%d]", field, j), "empty detector name")
+			}
+		}
+	}
+
+	if c.HTTP.Addr != "" {
+		if err := checkAddr(c.HTTP.Addr); err != nil {
+			add("http_server.address", "%s", err)
+		} else if c.HTTP.Addr == c.Addr {
+			add("http_server.address", "same as address, leave it empty to share the address")
+		}
+	}
+
+	if c.TLS.Detect && !c.TLS.Enabled() {
+		add("tls.detect", "no certificates configured")
+	}
+	for i, cert := range c.TLS.Certificates {
+		field := fmt.Sprintf("tls.certificates[%d].", i)
+
+		switch {
+		case cert.CertFile == "":
+			add(field+"cert_file", "no certificate file configured")
+		case cert.KeyFile == "":
+			add(field+"key_file", "no key file configured")
+		default:
+			if _, err := tls.LoadX509KeyPair(cert.CertFile, cert.KeyFile); err != nil {
+				add(field+"cert_file", "%s", err)
+			}
+		}
+	}
+
+	if c.Detection.TimeoutSeconds < 0 {
+		add("detection.timeout_seconds", "can't be negative")
+	}
+	if c.Detection.MaxBytes < 0 {
+		add("detection.max_bytes", "can't be negative")
+	}
+	if c.Detection.MaxPending < 0 {
+		add("detection.max_pending", "can't be negative")
+	}
+
+	for i, s := range c.TrustedProxies {
+		if _, err := parseNetwork(s); err != nil {
+			add(fmt.Sprintf("trusted_proxies[%d]", i), "%s", err)
+		}
+	}
+
+	checkCredentials(add, "source", c.Source)
+	checkCredentials(add, "admin", c.Admin)
+
+	// sources need a password for every mount they can stream to
+	if c.Source.Empty() && !c.RejectUndeclaredMounts {
+		add("source.password", "no password configured, sources can't stream to undeclared mounts")
+	}
+
+	seen := make(map[string]bool, len(c.Mounts))
+	for i, m := range c.Mounts {
+		field := fmt.Sprintf("mounts[%d].", i)
+
+		if !strings.HasPrefix(m.Name, "/") {
+			add(field+"name", "%q does not start with a slash", m.Name)
+		} else if seen[m.Name] {
+			add(field+"name", "%q is declared more than once", m.Name)
+		}
+		seen[m.Name] = true
+
+		checkCredentials(add, field+"source", m.Source)
+		if m.Source.Empty() && c.Source.Empty() {
+			add(field+"source.password", "no password configured here or in source")
+		}
+
+		if m.Fallback != "" && !strings.HasPrefix(m.Fallback, "/") {
+			add(field+"fallback_mount", "%q does not start with a slash", m.Fallback)
+		} else if m.Fallback == m.Name && m.Name != "" {
+			add(field+"fallback_mount", "a mount can't fall back to itself")
+		}
+
+		if m.FallbackBitrate < 0 {
+			add(field+"fallback_bitrate", "can't be negative")
+		}
+		if m.BurstSeconds < 0 {
+			add(field+"burst_seconds", "can't be negative")
+		}
+		if m.Metaint < 0 {
+			add(field+"metaint", "can't be negative")
+		}
+		if m.MaxListeners < 0 {
+			add(field+"max_listeners", "can't be negative")
+		}
+
+		if m.Charset != "" && !taxtic.Supported(m.Charset) {
+			add(field+"charset", "unknown charset %q", m.Charset)
+		}
+	}
+
+	if c.Shoutcast.Mount != "" && !strings.HasPrefix(c.Shoutcast.Mount, "/") {
+		add("shoutcast.mount", "%q does not start with a slash", c.Shoutcast.Mount)
+	}
+
+	ids := make(map[int]bool, len(c.Shoutcast.Streams))
+	for i, st := range c.Shoutcast.Streams {
+		field := fmt.Sprintf("shoutcast.streams[%d].", i)
+
+		if st.ID < 1 {
+			add(field+"id", "must be at least 1")
+		} else if ids[st.ID] {
+			add(field+"id", "stream %d is mapped more than once", st.ID)
+		}
+		ids[st.ID] = true
+
+		if !strings.HasPrefix(st.Mount, "/") {
+			add(field+"mount", "%q does not start with a slash", st.Mount)
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// checkAddr checks if addr is a valid host:port address to listen on
+func checkAddr(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid address %q: %s", addr, err)
+	}
+
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		return fmt.Errorf("invalid port %q", port)
+	}
+	return nil
+}
+
+// checkCredentials checks if the password hash of creds can be used
+func checkCredentials(add func(string, string, ...interface{}), field string, creds Credentials) {
+	if creds.PasswordHash == "" {
+		return
+	}
+
+	if _, _, err := parseHash(creds.PasswordHash); err != nil {
+		add(field+".password_hash", "%s", err)
+	}
+}
@@ -0,0 +1,108 @@
+package config
+
+import (
+	"sort"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	valid := Config{
+		Addr:           "localhost:9050",
+		Source:         Credentials{Password: "hackme"},
+		Mounts:         []Mount{{Name: "/main", Fallback: "/fallback", Charset: "latin1"}},
+		TrustedProxies: []string{"10.0.0.1", "2001:db8::/32"},
+	}
+	if err := valid.Validate(); err != nil {
+		t.Errorf("valid configuration failed: %s", err)
+	}
+
+	invalid := Config{
+		Addr: "localhost",
+		HTTP: HTTPServer{Addr: "localhost:99999"},
+		Admin: Credentials{
+			PasswordHash: "md5:abcdef",
+		},
+		Mounts: []Mount{
+			{Name: "/main", Fallback: "/main", MaxListeners: -1},
+			{Name: "/main", Metaint: -1, Charset: "klingon"},
+			{Name: "other", Source: Credentials{Password: "hackme"}},
+		},
+		Shoutcast: Shoutcast{
+			Streams: []ShoutcastStream{{ID: 1, Mount: "/main"}, {ID: 1, Mount: "main"}},
+		},
+		TLS: TLS{
+			Certificates: []Certificate{
+				{CertFile: "cert.pem"},
+				{CertFile: "missing.pem", KeyFile: "missing.key"},
+			},
+		},
+		TrustedProxies: []string{"10.0.0.0/8", "10.0.0.0/33", "proxy"},
+		Detection:      Detection{TimeoutSeconds: -1, MaxPending: -1},
+		Listeners: []Listener{
+			{Network: "unix", Addr: "/run/sirencast.sock", TLS: TLSDetect},
+			{Addr: "localhost", Detectors: []string{""}},
+			{Network: "udp", Addr: "localhost:9050"},
+			{Network: "unix", Addr: "/run/sirencast.sock", TLS: "always"},
+		},
+	}
+
+	err := invalid.Validate()
+	verr, ok := err.(ValidationError)
+	if !ok {
+		t.Fatalf("expected a ValidationError, got %v", err)
+	}
+
+	var fields []string
+	for _, fe := range verr {
+		fields = append(fields, fe.Field)
+	}
+	sort.Strings(fields)
+
+	expected := []string{
+		"address",
+		"admin.password_hash",
+		"detection.max_pending",
+		"detection.timeout_seconds",
+		"http_server.address",
+		"listeners[1].address",
+		"listeners[1].detectors[0]",
+		"listeners[2].network",
+		"listeners[3].address",
+		"listeners[3].tls",
+		"mounts[0].fallback_mount",
+		"mounts[0].max_listeners",
+		"mounts[0].source.password",
+		"mounts[1].charset",
+		"mounts[1].metaint",
+		"mounts[1].name",
+		"mounts[1].source.password",
+		"mounts[2].name",
+		"shoutcast.streams[1].id",
+		"shoutcast.streams[1].mount",
+		"source.password",
+		"tls.certificates[0].key_file",
+		"tls.certificates[1].cert_file",
+		"trusted_proxies[1]",
+		"trusted_proxies[2]",
+	}
+	if len(fields) != len(expected) {
+		t.Fatalf("unexpected problems found: %s", err)
+	}
+	for i := range fields {
+		if fields[i] != expected[i] {
+			t.Errorf("expected a problem with %s, got %s", expected[i], fields[i])
+		}
+	}
+}
+
+func TestValidateUndeclaredMounts(t *testing.T) {
+	// without undeclared mounts only the declared mounts need a password
+	conf := Config{
+		Addr:                   "localhost:9050",
+		RejectUndeclaredMounts: true,
+		Mounts:                 []Mount{{Name: "/main", Source: Credentials{Password: "hackme"}}},
+	}
+	if err := conf.Validate(); err != nil {
+		t.Errorf("valid configuration failed: %s", err)
+	}
+}
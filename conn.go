@@ -1,7 +1,9 @@
 package sirencast
 
 import (
+	"bytes"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"runtime"
@@ -21,6 +23,33 @@ type Conn struct {
 	reader io.Reader
 	// handler is the handler that is called when `serve` is called.
 	handler ConnHandler
+	// remote is the address of the client given by a PROXY protocol
+	// header, RemoteAddr returns it instead of the address of `conn`.
+	remote net.Addr
+}
+
+// newResumedConn returns a Conn for a connection handed off by a previous
+// process, pending is the data the previous process had read but not handled.
+func newResumedConn(c net.Conn, pending []byte, handler ConnHandler) *Conn {
+	start := bytes.NewReader(pending)
+	return &Conn{
+		conn:    c,
+		start:   start,
+		reader:  start,
+		handler: handler,
+	}
+}
+
+// unread returns the data that was read from the connection by the
+// peeker but not yet returned by Read.
+func (sc *Conn) unread() []byte {
+	if sc.start == nil || sc.reader != sc.start {
+		return nil
+	}
+
+	b, _ := ioutil.ReadAll(sc.start)
+	sc.reader = sc.conn
+	return b
 }
 
 // serve calls the appointed handler with sc as argument, it recovers from any panics
@@ -77,6 +106,9 @@ func (sc *Conn) LocalAddr() net.Addr {
 }
 
 func (sc *Conn) RemoteAddr() net.Addr {
+	if sc.remote != nil {
+		return sc.remote
+	}
 	return sc.conn.RemoteAddr()
 }
 
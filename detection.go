@@ -0,0 +1,68 @@
+package sirencast
+
+import (
+	"errors"
+
+	"github.com/Wessie/sirencast/config"
+)
+
+// errDetectTimeout is returned by newConn for a connection that wasn't
+// detected before the detection timeout.
+var errDetectTimeout = errors.New("sirencast: connection timed out in detection")
+
+// DetectionStats are counters of the connections that went through
+// detection since the server was created.
+type DetectionStats struct {
+	// Pending is the amount of connections in detection right now
+	Pending int
+	// Detected is the amount of connections handed to a handler
+	Detected uint64
+	// Failed is the amount of connections no handler was found for
+	Failed uint64
+	// TimedOut is the amount of connections closed because they weren't
+	// detected before the detection timeout.
+	TimedOut uint64
+	// Rejected is the amount of connections closed right away because
+	// too many connections were in detection already.
+	Rejected uint64
+}
+
+// DetectionStats returns the detection counters of the server
+func (server *Server) DetectionStats() DetectionStats {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return server.detection
+}
+
+// startDetection reserves a place for a new connection in detection and
+// returns the detection configuration, or false if no place is left.
+func (server *Server) startDetection() (config.Detection, bool) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	dc := server.Config.Detection
+	if server.detection.Pending >= dc.Pending() {
+		server.detection.Rejected++
+		return dc, false
+	}
+
+	server.detection.Pending++
+	return dc, true
+}
+
+// endDetection releases the place of a connection in detection, err is
+// the result of newConn.
+func (server *Server) endDetection(err error) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	server.detection.Pending--
+	switch err {
+	case nil:
+		server.detection.Detected++
+	case errDetectTimeout:
+		server.detection.TimedOut++
+	default:
+		server.detection.Failed++
+	}
+}
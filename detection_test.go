@@ -0,0 +1,115 @@
+package sirencast
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Wessie/sirencast/config"
+)
+
+// startDetectionServer starts a server that claims connections sending
+// "hello\n", and calls the Default handler for anything else.
+func startDetectionServer(t *testing.T, dc config.Detection) (*Server, string, chan struct{}) {
+	defaulted := make(chan struct{}, 10)
+
+	ds := NewDetectors()
+	ds.Register(nameDetector("hello"))
+	ds.Default = func(c *Conn) {
+		c.Close()
+		defaulted <- struct{}{}
+	}
+
+	server, addr, _ := startServerConfig(t, &config.Config{
+		Addr:      "127.0.0.1:0",
+		Detection: dc,
+	}, ds)
+	return server, addr, defaulted
+}
+
+// waitStats waits until f returns true for the detection stats of server
+func waitStats(t *testing.T, server *Server, f func(DetectionStats) bool) DetectionStats {
+	for i := 0; i < 300; i++ {
+		if stats := server.DetectionStats(); f(stats) {
+			return stats
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	stats := server.DetectionStats()
+	t.Fatalf("unexpected detection stats: %+v", stats)
+	return stats
+}
+
+func TestDetectionTimeout(t *testing.T) {
+	server, addr, defaulted := startDetectionServer(t, config.Detection{TimeoutSeconds: 1})
+	defer server.Shutdown(context.Background())
+
+	silent, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	waitStats(t, server, func(s DetectionStats) bool { return s.Pending == 1 })
+
+	// the silent connection doesn't hold up others
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.SetDeadline(time.Now().Add(500 * time.Millisecond))
+	c.Write([]byte("hello\n"))
+	if line, _ := bufio.NewReader(c).ReadString('\n'); line != "hello\n" {
+		t.Fatalf("connection was not served while another was in detection: %q", line)
+	}
+
+	// and is closed once it times out
+	silent.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := silent.Read(make([]byte, 1)); err == nil {
+		t.Error("read data from the silent connection")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Error("silent connection was not closed")
+	}
+
+	stats := waitStats(t, server, func(s DetectionStats) bool { return s.Pending == 0 })
+	if stats.TimedOut != 1 || stats.Detected != 1 {
+		t.Errorf("unexpected detection stats: %+v", stats)
+	}
+
+	select {
+	case <-defaulted:
+		t.Error("timed out connection was passed to the default handler")
+	default:
+	}
+}
+
+func TestDetectionPending(t *testing.T) {
+	server, addr, _ := startDetectionServer(t, config.Detection{TimeoutSeconds: 5, MaxPending: 1})
+	defer server.Shutdown(context.Background())
+
+	silent, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	waitStats(t, server, func(s DetectionStats) bool { return s.Pending == 1 })
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	c.Write([]byte("hello\n"))
+	if line, _ := bufio.NewReader(c).ReadString('\n'); line != "" {
+		t.Errorf("connection over the limit was served: %q", line)
+	}
+
+	if stats := server.DetectionStats(); stats.Rejected != 1 {
+		t.Errorf("unexpected detection stats: %+v", stats)
+	}
+}
@@ -2,7 +2,10 @@ package sirencast
 
 import (
 	"io"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // DefaultDetectors are the global default detectors
@@ -20,26 +23,183 @@ type ConnHandler func(*Conn)
 // or not due to being the entry-point of all connections.
 type Detector func(io.Reader) ConnHandler
 
+// DefaultName is the name of the Default handler of Detectors, as used
+// when restricting the detectors of a listener.
+const DefaultName = "default"
+
+// DefaultDetectorPriority is the priority of detectors registered without one
+const DefaultDetectorPriority = 0
+
+// Detectors is a registry of detectors, they are tried in order of priority
+// until one of them returns a handler.
 type Detectors struct {
-	mu        *sync.RWMutex
-	Detectors []Detector
-	Default   ConnHandler
+	mu *sync.RWMutex
+	// detectors are sorted by priority, the slice is replaced as a whole
+	// on changes so Detect doesn't hold the lock while detecting.
+	detectors []*registeredDetector
+	// Default is the handler used if no detector returned a handler
+	Default ConnHandler
+	// defaultHits counts the connections passed to Default
+	defaultHits uint64
+}
+
+// registeredDetector is a Detector with its registration and counters, the
+// counters are updated atomically.
+type registeredDetector struct {
+	hits, misses, peeked uint64
+	nanos                int64
+	disabled             int32
+
+	name     string
+	priority int
+	detect   Detector
+}
+
+// DetectorStats are the registration and counters of a single detector
+type DetectorStats struct {
+	Name     string
+	Priority int
+	Enabled  bool
+	// Hits is the amount of connections the detector found a handler for
+	Hits uint64
+	// Misses is the amount of connections the detector didn't claim
+	Misses uint64
+	// Peeked is the total amount of bytes the detector read
+	Peeked uint64
+	// Time is the total time spent in the detector
+	Time time.Duration
 }
 
 // NewDetectors returns a new *Detectors
 func NewDetectors() *Detectors {
 	return &Detectors{
-		mu:        new(sync.RWMutex),
-		Detectors: make([]Detector, 0),
+		mu: new(sync.RWMutex),
 	}
 }
 
 // Register registers a new detector in the Detectors. The Detector
 // is called when Detect is called.
 func (ds *Detectors) Register(d Detector) {
+	ds.RegisterPriority("", DefaultDetectorPriority, d)
+}
+
+// RegisterName registers a new detector under the name given, listeners
+// can be restricted to a set of named detectors.
+func (ds *Detectors) RegisterName(name string, d Detector) {
+	ds.RegisterPriority(name, DefaultDetectorPriority, d)
+}
+
+// RegisterPriority registers a new detector under the name and priority
+// given. Detectors with a higher priority are tried first, and those with
+// the same priority in the order they were registered. A detector that
+// already exists with the same name is replaced.
+func (ds *Detectors) RegisterPriority(name string, priority int, d Detector) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	detectors := make([]*registeredDetector, 0, len(ds.detectors)+1)
+	for _, rd := range ds.detectors {
+		if name == "" || rd.name != name {
+			detectors = append(detectors, rd)
+		}
+	}
+	detectors = append(detectors, &registeredDetector{
+		name:     name,
+		priority: priority,
+		detect:   d,
+	})
+
+	sort.SliceStable(detectors, func(i, j int) bool {
+		return detectors[i].priority > detectors[j].priority
+	})
+	ds.detectors = detectors
+}
+
+// Unregister removes the detector with the name given, it returns false if
+// no such detector exists.
+func (ds *Detectors) Unregister(name string) bool {
 	ds.mu.Lock()
-	ds.Detectors = append(ds.Detectors, d)
-	ds.mu.Unlock()
+	defer ds.mu.Unlock()
+
+	detectors := make([]*registeredDetector, 0, len(ds.detectors))
+	for _, rd := range ds.detectors {
+		if rd.name != name {
+			detectors = append(detectors, rd)
+		}
+	}
+
+	if len(detectors) == len(ds.detectors) {
+		return false
+	}
+	ds.detectors = detectors
+	return true
+}
+
+// List returns the registered detectors in the order they are tried
+func (ds *Detectors) List() []Detector {
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+
+	detectors := make([]Detector, len(ds.detectors))
+	for i, rd := range ds.detectors {
+		detectors[i] = rd.detect
+	}
+	return detectors
+}
+
+// SetEnabled enables or disables the detector with the name given, disabled
+// detectors are skipped by Detect. It returns false if no such detector exists.
+func (ds *Detectors) SetEnabled(name string, enabled bool) bool {
+	rd := ds.lookup(name)
+	if rd == nil {
+		return false
+	}
+
+	var disabled int32
+	if !enabled {
+		disabled = 1
+	}
+	atomic.StoreInt32(&rd.disabled, disabled)
+	return true
+}
+
+func (ds *Detectors) lookup(name string) *registeredDetector {
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+
+	for _, rd := range ds.detectors {
+		if rd.name == name {
+			return rd
+		}
+	}
+	return nil
+}
+
+// Stats returns the registration and counters of every detector in the
+// order they are tried, followed by the Default handler under DefaultName.
+func (ds *Detectors) Stats() []DetectorStats {
+	ds.mu.RLock()
+	detectors := ds.detectors
+	ds.mu.RUnlock()
+
+	stats := make([]DetectorStats, 0, len(detectors)+1)
+	for _, rd := range detectors {
+		stats = append(stats, DetectorStats{
+			Name:     rd.name,
+			Priority: rd.priority,
+			Enabled:  atomic.LoadInt32(&rd.disabled) == 0,
+			Hits:     atomic.LoadUint64(&rd.hits),
+			Misses:   atomic.LoadUint64(&rd.misses),
+			Peeked:   atomic.LoadUint64(&rd.peeked),
+			Time:     time.Duration(atomic.LoadInt64(&rd.nanos)),
+		})
+	}
+
+	return append(stats, DetectorStats{
+		Name:    DefaultName,
+		Enabled: true,
+		Hits:    atomic.LoadUint64(&ds.defaultHits),
+	})
 }
 
 // Detect tries to detect what kind of stream we're receiving
@@ -48,31 +208,91 @@ func (ds *Detectors) Register(d Detector) {
 //
 // Detect returns on the first non-nil return value from a Detector
 func (ds *Detectors) Detect(input Peeker) (handler ConnHandler) {
+	return ds.detect(input, nil)
+}
+
+// detect is Detect using only the detectors named in allow, or all of
+// them if allow is empty. The Default handler is named DefaultName.
+func (ds *Detectors) detect(input Peeker, allow []string) (handler ConnHandler) {
+	allowed := func(name string) bool {
+		if len(allow) == 0 {
+			return true
+		}
+		for _, a := range allow {
+			if a == name && name != "" {
+				return true
+			}
+		}
+		return false
+	}
+
 	ds.mu.RLock()
-	for _, d := range ds.Detectors {
-		handler = d(input)
+	detectors, def := ds.detectors, ds.Default
+	ds.mu.RUnlock()
+
+	for _, rd := range detectors {
+		if atomic.LoadInt32(&rd.disabled) != 0 || !allowed(rd.name) {
+			continue
+		}
+
+		handler = rd.run(input)
 
 		// Reset for next detector or for return
 		input.Reset()
 
 		if handler != nil {
-			break
+			return handler
 		}
 	}
 
-	if handler == nil {
-		return ds.Default
+	if def != nil && allowed(DefaultName) {
+		atomic.AddUint64(&ds.defaultHits, 1)
+		return def
 	}
-	ds.mu.RUnlock()
+	return nil
+}
+
+// run calls the detector and updates its counters
+func (rd *registeredDetector) run(input io.Reader) ConnHandler {
+	var (
+		r     = &countingReader{r: input}
+		start = time.Now()
+	)
 
+	handler := rd.detect(r)
+
+	atomic.AddInt64(&rd.nanos, int64(time.Since(start)))
+	atomic.AddUint64(&rd.peeked, r.n)
+	if handler != nil {
+		atomic.AddUint64(&rd.hits, 1)
+	} else {
+		atomic.AddUint64(&rd.misses, 1)
+	}
 	return handler
 }
 
+// countingReader counts the bytes read from r
+type countingReader struct {
+	r io.Reader
+	n uint64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += uint64(n)
+	return n, err
+}
+
 // RegisterDetector calls DefaultDetectors.Register
 func RegisterDetector(d Detector) {
 	DefaultDetectors.Register(d)
 }
 
+// RegisterNamedDetector calls DefaultDetectors.RegisterName
+func RegisterNamedDetector(name string, d Detector) {
+	DefaultDetectors.RegisterName(name, d)
+}
+
 // Detect calls DefaultDetectors.Detect
 func Detect(input Peeker) ConnHandler {
 	return DefaultDetectors.Detect(input)
@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"io"
 	"io/ioutil"
+	"strings"
 	"testing"
+	"time"
 )
 
 type TestSourceClient struct {
@@ -30,3 +32,94 @@ func TestDetectorDetect(t *testing.T) {
 		t.Error("Expected input return, got nil")
 	}
 }
+
+func TestDetectorsDefaultUnlock(t *testing.T) {
+	d := NewDetectors()
+	d.Default = func(c *Conn) {}
+
+	if d.Detect(NewPeeker(bytes.NewBuffer(nil))) == nil {
+		t.Fatal("expected the default handler")
+	}
+
+	// returning the default handler used to leave the read lock held
+	done := make(chan struct{})
+	go func() {
+		d.Register(EchoDetector)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("register blocked after detecting the default handler")
+	}
+}
+
+func TestDetectorsRegistry(t *testing.T) {
+	var order []string
+	detector := func(name string, claim bool) Detector {
+		return func(r io.Reader) ConnHandler {
+			order = append(order, name)
+			r.Read(make([]byte, 4))
+			if !claim {
+				return nil
+			}
+			return func(c *Conn) {}
+		}
+	}
+
+	d := NewDetectors()
+	d.RegisterName("low", detector("low", true))
+	d.RegisterPriority("high", 10, detector("high", false))
+	d.RegisterName("second", detector("second", false))
+	d.RegisterPriority("first", 5, detector("first", false))
+
+	detect := func() []string {
+		order = nil
+		d.Detect(NewPeeker(bytes.NewBufferString("some data")))
+		return order
+	}
+
+	if got := strings.Join(detect(), " "); got != "high first low" {
+		t.Errorf("unexpected detector order: %s", got)
+	}
+
+	if !d.SetEnabled("first", false) || d.SetEnabled("unknown", false) {
+		t.Error("unexpected result of SetEnabled")
+	}
+	if !d.Unregister("low") || d.Unregister("low") {
+		t.Error("unexpected result of Unregister")
+	}
+	if got := strings.Join(detect(), " "); got != "high second" {
+		t.Errorf("unexpected detector order: %s", got)
+	}
+
+	// registering a name again replaces the detector
+	d.RegisterPriority("second", 20, detector("replaced", true))
+	if got := strings.Join(detect(), " "); got != "replaced" {
+		t.Errorf("unexpected detector order: %s", got)
+	}
+
+	// List follows the registry
+	order = nil
+	if l := d.List(); len(l) != 3 || l[0](strings.NewReader("data")) == nil || order[0] != "replaced" {
+		t.Errorf("unexpected detector list: %d detectors, called %v", len(l), order)
+	}
+
+	stats := d.Stats()
+	expected := []DetectorStats{
+		{Name: "second", Priority: 20, Enabled: true, Hits: 1, Peeked: 4},
+		{Name: "high", Priority: 10, Enabled: true, Misses: 2, Peeked: 8},
+		{Name: "first", Priority: 5, Enabled: false, Misses: 1, Peeked: 4},
+		{Name: DefaultName, Enabled: true},
+	}
+	if len(stats) != len(expected) {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+	for i := range stats {
+		stats[i].Time = 0
+		if stats[i] != expected[i] {
+			t.Errorf("unexpected stats: %+v != %+v", stats[i], expected[i])
+		}
+	}
+}
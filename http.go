@@ -3,17 +3,23 @@ package sirencast
 import (
 	"errors"
 	"net"
+	"sync"
 )
 
 // NewHTTPListener returns a new HTTPListener
 func NewHTTPListener(addr string) *HTTPListener {
 	l := &HTTPListener{
 		pipe: make(chan *Conn),
+		done: make(chan struct{}),
 		addr: addr,
 	}
 
 	l.Handler = func(conn *Conn) {
-		l.pipe <- conn
+		select {
+		case l.pipe <- conn:
+		case <-l.done:
+			conn.Close()
+		}
 	}
 
 	return l
@@ -26,23 +32,27 @@ func NewHTTPListener(addr string) *HTTPListener {
 type HTTPListener struct {
 	addr string
 	pipe chan *Conn
+	// done is closed when the listener is closed
+	done      chan struct{}
+	closeOnce sync.Once
 
 	Handler ConnHandler
 }
 
 // Accept waits for and returns the next connection
 func (l *HTTPListener) Accept() (net.Conn, error) {
-	sc, ok := <-l.pipe
-
-	if !ok {
+	select {
+	case sc := <-l.pipe:
+		return sc, nil
+	case <-l.done:
 		return nil, errors.New("closed listener pipe")
 	}
-
-	return sc, nil
 }
 
-// Close is a no-op and always returns nil
+// Close closes the listener, any blocked Accept calls return an error
+// and connections passed to the handler afterwards are closed.
 func (l *HTTPListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
 	return nil
 }
 
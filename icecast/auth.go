@@ -0,0 +1,61 @@
+package icecast
+
+import (
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/Wessie/sirencast/config"
+)
+
+// AuthRealm is the realm send in the WWW-Authenticate header of a
+// 401 Unauthorized response.
+const AuthRealm = "sirencast"
+
+// checkCredentials checks the Authorization header of the request against
+// the credentials given.
+func checkCredentials(r *http.Request, c config.Credentials) bool {
+	user, passwd, err := ParseDigest(r)
+	if err != nil {
+		return false
+	}
+
+	return c.Verify(user, passwd)
+}
+
+// authenticateSource checks if the request carries valid source
+// credentials for the mount given.
+func (s *Server) authenticateSource(r *http.Request, mount string) bool {
+	creds := s.Config().SourceCredentials(mount)
+	if creds.Empty() {
+		log.Printf("icecast.auth: no source credentials configured for '%s'", mount)
+		return false
+	}
+
+	return checkCredentials(r, creds)
+}
+
+// authenticateAdmin checks if the request is allowed to use the admin
+// functions of the mount given. This is allowed for the admin credentials,
+// and for the source credentials of the mount itself if source is true.
+func (s *Server) authenticateAdmin(r *http.Request, mount string, source bool) bool {
+	if checkCredentials(r, s.Config().AdminCredentials()) {
+		return true
+	}
+
+	return source && checkCredentials(r, s.Config().SourceCredentials(mount))
+}
+
+// challengeHeader returns a header containing the WWW-Authenticate challenge
+// to send along with a 401 Unauthorized response.
+func challengeHeader() http.Header {
+	return http.Header{
+		"Www-Authenticate": {`Basic realm="` + AuthRealm + `"`},
+	}
+}
+
+// WriteUnauthorized writes a 401 Unauthorized header with a
+// WWW-Authenticate challenge to writer `w`.
+func WriteUnauthorized(w io.Writer) error {
+	return WriteHeader(w, challengeHeader(), http.StatusUnauthorized)
+}
@@ -0,0 +1,97 @@
+package icecast
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/Wessie/sirencast/config"
+)
+
+func TestCheckCredentials(t *testing.T) {
+	hashed, err := config.HashPassword("sha256", "hackme")
+	if err != nil {
+		t.Fatal("failed to hash password:", err)
+	}
+
+	tests := []struct {
+		creds        config.Credentials
+		user, passwd string
+		ok           bool
+	}{
+		{config.Credentials{Password: "hackme"}, "source", "hackme", true},
+		{config.Credentials{Password: "hackme"}, "source", "wrong", false},
+		{config.Credentials{Password: "hackme"}, "admin", "hackme", false},
+		{config.Credentials{User: "dj", Password: "hackme"}, "dj", "hackme", true},
+		{config.Credentials{PasswordHash: hashed}, "source", "hackme", true},
+		{config.Credentials{PasswordHash: hashed}, "source", hashed, false},
+		{config.Credentials{PasswordHash: "md4:00"}, "source", "hackme", false},
+		{config.Credentials{}, "source", "", false},
+	}
+
+	for _, h := range tests {
+		r, _ := http.NewRequest("SOURCE", "/stream", nil)
+		r.SetBasicAuth(h.user, h.passwd)
+
+		if ok := checkCredentials(r, h.creds); ok != h.ok {
+			t.Errorf("unexpected result for %+v with %s:%s: %v != %v",
+				h.creds, h.user, h.passwd, ok, h.ok)
+		}
+	}
+}
+
+func TestAuthenticateSourceMountOverride(t *testing.T) {
+	s := NewServer(&config.Config{
+		Source: config.Credentials{Password: "global"},
+		Mounts: []config.Mount{
+			{Name: "/special", Source: config.Credentials{Password: "special"}},
+		},
+	})
+
+	r, _ := http.NewRequest("SOURCE", "/special", nil)
+	r.SetBasicAuth("source", "global")
+	if s.authenticateSource(r, "/special") {
+		t.Error("global credentials accepted for mount with its own credentials")
+	}
+
+	r.SetBasicAuth("source", "special")
+	if !s.authenticateSource(r, "/special") {
+		t.Error("mount credentials rejected")
+	}
+
+	if s.authenticateSource(r, "/other") {
+		t.Error("mount credentials used for a different mount")
+	}
+}
+
+func TestAuthenticateAdmin(t *testing.T) {
+	s := NewServer(&config.Config{
+		Admin: config.Credentials{Password: "admin"},
+		Mounts: []config.Mount{
+			{Name: "/a", Source: config.Credentials{Password: "a"}},
+			{Name: "/b", Source: config.Credentials{Password: "b"}},
+		},
+	})
+
+	tests := []struct {
+		user, passwd, mount string
+		source, ok          bool
+	}{
+		{"admin", "admin", "/a", true, true},
+		{"admin", "admin", "/b", false, true},
+		{"source", "a", "/a", true, true},
+		{"source", "a", "/a", false, false},
+		{"source", "a", "/b", true, false},
+		{"source", "b", "/b", true, true},
+		{"source", "admin", "/a", true, false},
+	}
+
+	for _, h := range tests {
+		r, _ := http.NewRequest("GET", "/admin/metadata?mount="+h.mount, nil)
+		r.SetBasicAuth(h.user, h.passwd)
+
+		if ok := s.authenticateAdmin(r, h.mount, h.source); ok != h.ok {
+			t.Errorf("unexpected admin result for %s:%s on %s (source %v): %v != %v",
+				h.user, h.passwd, h.mount, h.source, ok, h.ok)
+		}
+	}
+}
@@ -5,23 +5,114 @@ import (
 	"io"
 	"log"
 	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
 )
 
+// DefaultMetaint is the amount of bytes between metadata sections
+const DefaultMetaint = 16000
+
+// lastClientID is the last ID handed out to a client
+var lastClientID uint64
+
+// NewClient returns a new client for the connection and request given
+func NewClient(conn net.Conn, r *http.Request) *Client {
+	c := &Client{
+		id:        atomic.AddUint64(&lastClientID, 1),
+		conn:      conn,
+		addr:      r.RemoteAddr,
+		userAgent: r.UserAgent(),
+		connected: time.Now(),
+		meta:      r.Header.Get("icy-metadata") == "1",
+		metaint:   DefaultMetaint,
+		done:      make(chan struct{}),
+	}
+
+	if h, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		c.addr = h
+	}
+
+	c.bufconn = bufio.NewWriter(countWriter{conn, &c.sent})
+	return c
+}
+
 type Client struct {
+	// sent is the amount of bytes written to the client, this is
+	// accessed atomically and should be kept at the top for alignment.
+	sent uint64
+	// id is the unique identifier of the client
+	id uint64
+	// detached is set to 1 if the client is being handed off, the
+	// connection is left open when the client stops. This is accessed
+	// atomically.
+	detached int32
+	// done is closed once the client stopped and was removed from its mount
+	done chan struct{}
+
 	// conn is the connection of the client
 	conn    net.Conn
 	bufconn *bufio.Writer
+	// input is the buffer the client reads from, closing it
+	// stops the client.
+	input io.Closer
+
+	// addr is the remote address of the client
+	addr string
+	// userAgent is the User-Agent header send by the client
+	userAgent string
+	// connected is the time the client connected
+	connected time.Time
 
 	// meta indicates if this client wants metadata interleaved with the data
 	meta bool
 	// metaint is the amount of bytes between each metadata section send
 	metaint int
+	// offset is the amount of bytes send since the last metadata section
+	offset int
+	// curMeta and curFields are the metadata last send to the client
+	curMeta   string
+	curFields []MetaField
+	// ultravox is the type of the Ultravox messages the data is send in
+	// to a SHOUTcast v2 listener, zero for all other clients.
+	ultravox uint16
+}
+
+// ClientInfo is a snapshot of the information known about a client
+type ClientInfo struct {
+	ID        uint64
+	Addr      string
+	UserAgent string
+	Connected time.Time
+	BytesSent uint64
+}
+
+// Info returns a snapshot of the client information
+func (c *Client) Info() ClientInfo {
+	return ClientInfo{
+		ID:        c.id,
+		Addr:      c.addr,
+		UserAgent: c.userAgent,
+		Connected: c.connected,
+		BytesSent: atomic.LoadUint64(&c.sent),
+	}
 }
 
 func (c *Client) runLoop(r io.ReadCloser, m ReadOnlyMetadata) {
-	defer c.conn.Close()
+	defer func() {
+		c.bufconn.Flush()
+		if atomic.LoadInt32(&c.detached) == 0 {
+			c.conn.Close()
+		}
+	}()
 	defer r.Close()
 
+	if c.ultravox != 0 {
+		c.ultravoxLoop(r, m)
+		return
+	}
+
 	// if we have mp3 and metadata to handle we use a specialized loop
 	if c.meta {
 		c.mp3Loop(r, m)
@@ -57,40 +148,41 @@ func (c *Client) mp3Loop(r io.ReadCloser, m ReadOnlyMetadata) {
 		// buffer for reading into
 		p = make([]byte, c.metaint)
 		// metadata buffer, we can't send more than 255*16+1 metadata blocks
-		metabuf = make([]byte, 255*16+1)
+		metabuf = make([]byte, maxMetaLength+1)
 		// zero is the no-metadata buffer
 		zero = []byte{0}
 		// variable used for writing
 		metadata []byte
-		// meta is the temporary metadata variable
-		meta string
-		// the latest metadata we saw
-		curMeta string
+		// meta and fields are the temporary metadata variables
+		meta   string
+		fields []MetaField
 	)
 
 	for {
-		n, err = io.ReadFull(r, p)
-		if err != nil {
-			return
+		// offset is only non-zero for a client that was handed off to us
+		// in the middle of a metaint block, or after a short read.
+		n, err = io.ReadFull(r, p[c.offset:])
+		if n > 0 {
+			wn, werr := c.bufconn.Write(p[c.offset : c.offset+n])
+			c.offset += wn
+			if wn != n || werr != nil {
+				return
+			}
 		}
 
-		if n != len(p) {
-			log.Println("icecast.client: failed to read full buffer")
-			return
-		}
-
-		wn, err = c.bufconn.Write(p)
-		if wn != n || err != nil {
+		if err != nil {
 			return
 		}
+		c.offset = 0
 
 		// handle metadata, we first need to check if we have new metadata
 		// at all, we can send a 0 length meta block if we have nothing.
-		if meta = m.Get(); meta == curMeta {
+		meta, fields = m.Get(), m.Fields()
+		if meta == c.curMeta && equalMetaFields(fields, c.curFields) {
 			metadata = zero
 		} else {
-			curMeta = meta
-			metadata = fillMetaBuffer(metabuf, curMeta)
+			c.curMeta, c.curFields = meta, fields
+			metadata = fillMetaBuffer(metabuf, meta, fields)
 		}
 
 		wn, err = c.bufconn.Write(metadata)
@@ -100,27 +192,109 @@ func (c *Client) mp3Loop(r io.ReadCloser, m ReadOnlyMetadata) {
 	}
 }
 
-var (
-	metaFront   = []byte("StreamTitle='")
-	metaBack    = []byte("';")
-	metaPadding = make([]byte, 16)
-)
+// ultravoxLoop sends the data wrapped in Ultravox messages, the metadata is
+// send as XML metadata messages in between whenever it changes.
+func (c *Client) ultravoxLoop(r io.ReadCloser, m ReadOnlyMetadata) {
+	log.Println("icecast.client: using ultravox loop")
+	var (
+		p  = make([]byte, uvMaxPayloadSize)
+		id uint16
+	)
+
+	for {
+		if meta := m.Get(); meta != c.curMeta {
+			c.curMeta = meta
+			id++
+			doc := ultravoxMetadataDoc(meta)
+			for _, payload := range uvMetadataMessages(id, doc, uvMaxPayloadSize-6) {
+				if err := writeUltravox(c.bufconn, uvXMLMetadata, string(payload)); err != nil {
+					return
+				}
+			}
+		}
+
+		n, err := r.Read(p)
+		if n > 0 {
+			if werr := writeUltravox(c.bufconn, c.ultravox, string(p[:n])); werr != nil {
+				return
+			}
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// maxMetaLength is the most metadata that fits in a metadata section, the
+// length byte counts in blocks of 16 bytes.
+const maxMetaLength = 255 * 16
+
+var metaPadding = make([]byte, 16)
 
-func fillMetaBuffer(m []byte, meta string) []byte {
-	p := m[1:1]
-	p = append(p, metaFront...)
-	p = append(p, meta...)
-	p = append(p, metaBack...)
+// fillMetaBuffer fills m with a metadata section holding meta as the
+// StreamTitle followed by the fields given, m has to be at least
+// maxMetaLength+1 bytes. The title is truncated if it doesn't fit, any
+// fields that don't fit after it are left out.
+func fillMetaBuffer(m []byte, meta string, fields []MetaField) []byte {
+	p := appendMetaField(m[1:1], "StreamTitle", meta, true)
+	for _, f := range fields {
+		p = appendMetaField(p, f.Key, f.Value, false)
+	}
 	p = append(p, getPadding(len(p))...)
 	m[0] = byte(len(p) / 16)
 
 	return m[:len(p)+1]
 }
 
+// appendMetaField appends key='value'; to p with any quote in value escaped.
+// If the field doesn't fit in maxMetaLength it is truncated if truncate is
+// set, and left out otherwise. Truncation never splits a character.
+func appendMetaField(p []byte, key, value string, truncate bool) []byte {
+	start := len(p)
+	if start+len(key)+len("='';") > maxMetaLength {
+		return p
+	}
+
+	p = append(p, key...)
+	p = append(p, "='"...)
+	for len(value) > 0 {
+		_, size := utf8.DecodeRuneInString(value)
+		c := value[:size]
+		if c == "'" {
+			c = `\'`
+		}
+
+		if len(p)+len(c)+len("';") > maxMetaLength {
+			if !truncate {
+				return p[:start]
+			}
+			break
+		}
+		p = append(p, c...)
+		value = value[size:]
+	}
+	return append(p, "';"...)
+}
+
 func getPadding(length int) []byte {
 	return metaPadding[:calculatePadding(length)]
 }
 
+// calculatePadding returns the padding needed to make length a multiple of 16
 func calculatePadding(length int) int {
-	return 16 - (length % 16)
+	return (16 - length%16) % 16
+}
+
+// countWriter is a writer that adds the amount of bytes written to
+// `n`, this is done atomically.
+type countWriter struct {
+	w io.Writer
+	n *uint64
+}
+
+func (cw countWriter) Write(p []byte) (n int, err error) {
+	n, err = cw.w.Write(p)
+	atomic.AddUint64(cw.n, uint64(n))
+	return n, err
 }
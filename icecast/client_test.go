@@ -1,6 +1,10 @@
 package icecast
 
-import "testing"
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
 
 func TestMP3CalculatePadding(t *testing.T) {
 	// calculate padding is expected to return at least the
@@ -56,10 +60,91 @@ func TestMP3ClientMetadata(t *testing.T) {
 		// padding component
 		expectedLen += calculatePadding(expectedLen - 1)
 
-		m := fillMetaBuffer(buf, s)
+		m := fillMetaBuffer(buf, s, nil)
 		if len(m) != expectedLen {
 			t.Errorf("filled buffer is not of expected length: (%d != %d) %s\n",
 				len(m), expectedLen, string(m))
 		}
 	}
 }
+
+func TestMP3ClientMetadataFields(t *testing.T) {
+	tests := []struct {
+		meta     string
+		fields   []MetaField
+		expected string
+	}{
+		{"test", nil, "StreamTitle='test';"},
+		{"it's", nil, `StreamTitle='it\'s';`},
+		{"test", []MetaField{{"StreamUrl", "http://example.com/art.jpg"}},
+			"StreamTitle='test';StreamUrl='http://example.com/art.jpg';"},
+		// fields that don't fit are left out
+		{"test", []MetaField{{"StreamUrl", strings.Repeat("a", maxMetaLength)}, {"Key", "value"}},
+			"StreamTitle='test';Key='value';"},
+	}
+
+	buf := make([]byte, maxMetaLength+1)
+	for _, test := range tests {
+		m := fillMetaBuffer(buf, test.meta, test.fields)
+		if int(m[0])*16 != len(m)-1 {
+			t.Errorf("length byte doesn't match: %d != %d", int(m[0])*16, len(m)-1)
+		}
+
+		if got := strings.TrimRight(string(m[1:]), "\x00"); got != test.expected {
+			t.Errorf("unexpected metadata: %q != %q", got, test.expected)
+		}
+	}
+}
+
+func TestMP3ClientMetadataTruncate(t *testing.T) {
+	buf := make([]byte, maxMetaLength+1)
+
+	// multi-byte characters and escaped quotes should never be split, no
+	// matter where the limit falls.
+	for _, unit := range []string{"ü", "'", "a'", "日本"} {
+		for pad := 0; pad < 4; pad++ {
+			title := strings.Repeat("x", pad) + strings.Repeat(unit, maxMetaLength)
+			m := fillMetaBuffer(buf, title, []MetaField{{"StreamUrl", "http://example.com"}})
+			if len(m) > maxMetaLength+1 || int(m[0])*16 != len(m)-1 {
+				t.Fatalf("invalid metadata section of length %d", len(m))
+			}
+
+			s := strings.TrimRight(string(m[1:]), "\x00")
+			if !strings.HasPrefix(s, "StreamTitle='") || !strings.HasSuffix(s, "';") {
+				t.Fatalf("invalid metadata: %q", s)
+			}
+
+			value := strings.Replace(s[len("StreamTitle='"):len(s)-2], `\'`, "'", -1)
+			if !strings.HasPrefix(title, value) {
+				t.Errorf("truncated title is not a prefix of the title")
+			}
+			if strings.HasSuffix(s, `\';`) {
+				t.Errorf("escape was split: %q", s[len(s)-10:])
+			}
+			if strings.ContainsRune(value, '\uFFFD') {
+				t.Errorf("character was split")
+			}
+		}
+	}
+}
+
+func TestMetadataFields(t *testing.T) {
+	query := url.Values{
+		"song":           {"title"},
+		"url":            {"http://example.com"},
+		"icy.StreamTest": {"test"},
+		"icy.Bad=Key":    {"ignored"},
+		"icy.":           {"ignored"},
+		"other":          {"ignored"},
+	}
+
+	fields, err := metadataFields(query, "utf8")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []MetaField{{"StreamUrl", "http://example.com"}, {"StreamTest", "test"}}
+	if !equalMetaFields(fields, expected) {
+		t.Errorf("unexpected fields: %v", fields)
+	}
+}
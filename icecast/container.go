@@ -1,15 +1,23 @@
 package icecast
 
-import "sync"
+import (
+	"math"
+	"sort"
+	"sync"
+)
 
 const DefaultPriority = 0
 
+// FallbackPriority is the lowest possible priority, it is used for sources
+// that should only be used when nothing else is available.
+const FallbackPriority = math.MinInt32
+
 // NewContainer returns a new container.
 func NewContainer() *Container {
 	return &Container{
 		mu:         new(sync.Mutex),
 		names:      make(map[string][]*Source, 8),
-		priorities: make([]int, 2),
+		priorities: make([]int, 0, 2),
 		queue:      make(map[int][]*Source, 2),
 	}
 }
@@ -38,13 +46,11 @@ func (c *Container) AddPriority(s *Source, priority int) {
 	// persist when added to it by name.
 	c.names[s.Name] = append(c.names[s.Name], s)
 
-	for i, p := range c.priorities {
-		if p == priority {
-			c.queue[priority] = append(c.queue[priority], s)
-			break
-		} else if p > priority {
-			continue
-		}
+	if len(c.queue[priority]) == 0 {
+		// priorities are kept in descending order
+		i := sort.Search(len(c.priorities), func(i int) bool {
+			return c.priorities[i] < priority
+		})
 
 		// Append something so we can be sure we have enough space available
 		c.priorities = append(c.priorities, 0)
@@ -52,9 +58,9 @@ func (c *Container) AddPriority(s *Source, priority int) {
 		copy(c.priorities[i+1:], c.priorities[i:])
 		// And fill the gap
 		c.priorities[i] = priority
-
-		c.queue[priority] = []*Source{s}
 	}
+
+	c.queue[priority] = append(c.queue[priority], s)
 }
 
 func (c *Container) Remove(s *Source) {
@@ -87,6 +93,7 @@ func (c *Container) RemovePriority(source *Source, prio int) {
 		}
 
 		c.names[source.Name] = ns
+		break
 	}
 
 	slc := c.queue[prio]
@@ -96,8 +103,15 @@ func (c *Container) RemovePriority(source *Source, prio int) {
 		}
 
 		slc = append(slc[:i], slc[i+1:]...)
+		break
 	}
-	c.queue[prio] = slc
+
+	// the priority stays around as long as other sources use it
+	if len(slc) > 0 {
+		c.queue[prio] = slc
+		return
+	}
+	delete(c.queue, prio)
 
 	for i, p := range c.priorities {
 		if p != prio {
@@ -159,3 +173,15 @@ func (c *Container) GetByName(name string) *Source {
 	}
 	return ns[len(ns)-1]
 }
+
+// All returns all sources in the container in no particular order.
+func (c *Container) All() []*Source {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var all []*Source
+	for _, s := range c.queue {
+		all = append(all, s...)
+	}
+	return all
+}
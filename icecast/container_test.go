@@ -11,7 +11,7 @@ func TestContainerSingleEntry(t *testing.T) {
 
 	c.Add(s)
 	if res := c.Top(); res != s {
-		t.Log("got: %p want: %p", res, s)
+		t.Logf("got: %p want: %p", res, s)
 		t.Error("container did not return expected top source")
 	}
 
@@ -72,6 +72,48 @@ func TestContainerPriorities(t *testing.T) {
 	}
 }
 
+func TestContainerLowestPriority(t *testing.T) {
+	t.Parallel()
+	var (
+		c        = NewContainer()
+		fallback = &Source{Name: "fallback"}
+		first    = &Source{Name: "first"}
+		second   = &Source{Name: "second"}
+	)
+
+	c.AddPriority(fallback, FallbackPriority)
+	if res := c.Top(); res != fallback {
+		t.Logf("got: %p want: %p", res, fallback)
+		t.Fatal("container did not return lowest priority source")
+	}
+
+	c.Add(first)
+	c.Add(second)
+	if res := c.Top(); res != first {
+		t.Logf("got: %p want: %p", res, first)
+		t.Error("container did not return first added source")
+	}
+
+	// the priority should remain while a source still uses it
+	c.Remove(first)
+	if res := c.Top(); res != second {
+		t.Logf("got: %p want: %p", res, second)
+		t.Error("container did not return remaining source")
+	}
+
+	c.Remove(second)
+	if res := c.Top(); res != fallback {
+		t.Logf("got: %p want: %p", res, fallback)
+		t.Error("container did not return to lowest priority source")
+	}
+
+	c.RemovePriority(fallback, FallbackPriority)
+	if res := c.Top(); res != nil {
+		t.Logf("got: %p want: nil", res)
+		t.Error("container is not empty after removing all sources")
+	}
+}
+
 func BenchmarkContainerAdd(b *testing.B) {
 	var (
 		s = &Source{Name: "test"}
@@ -2,6 +2,8 @@ package icecast
 
 import (
 	"bufio"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net/url"
@@ -14,53 +16,104 @@ func init() {
 	//	sirencast.RegisterDetector(Detect)
 }
 
+// The names of the icecast detectors, as registered by RegisterDetectors
+const (
+	DetectorSource     = "icecast.source"
+	DetectorListener   = "icecast.listener"
+	DetectorAdmin      = "icecast.admin"
+	DetectorShoutcast  = "shoutcast"
+	DetectorShoutcast2 = "shoutcast2"
+)
+
+// RegisterDetectors registers the detectors of every protocol we support
+// with ds under their names, this allows listeners to be restricted to
+// sources or listeners only. Their statistics are served by DetectorsHandler.
+func (s *Server) RegisterDetectors(ds *sirencast.Detectors) {
+	s.mu.Lock()
+	s.detectors = ds
+	s.mu.Unlock()
+
+	// The SHOUTcast v2 detector has to come first, the others wait for
+	// a full line which a SHOUTcast v2 source never sends.
+	ds.RegisterPriority(DetectorShoutcast2, sirencast.DefaultDetectorPriority+1, s.DetectShoutcastV2)
+	ds.RegisterName(DetectorSource, s.detectKind(DetectorSource))
+	ds.RegisterName(DetectorListener, s.detectKind(DetectorListener))
+	ds.RegisterName(DetectorAdmin, s.detectKind(DetectorAdmin))
+	ds.RegisterName(DetectorShoutcast, s.DetectShoutcast)
+}
+
+// Detect detects any icecast request, these are sources, listeners and
+// the admin requests.
 func (s *Server) Detect(r io.Reader) sirencast.ConnHandler {
+	_, handler, err := s.detectRequest(r)
+	if err != nil {
+		log.Println("icecast.detector:", err)
+	}
+	return handler
+}
+
+// detectKind returns a detector for the icecast requests of the kind given
+func (s *Server) detectKind(kind string) sirencast.Detector {
+	return func(r io.Reader) sirencast.ConnHandler {
+		if k, handler, _ := s.detectRequest(r); k == kind {
+			return handler
+		}
+		return nil
+	}
+}
+
+// detectRequest returns the handler for the icecast request at the start
+// of r and the name of the detector for its kind.
+func (s *Server) detectRequest(r io.Reader) (kind string, handler sirencast.ConnHandler, err error) {
 	// TODO: Optimize this, the bufio.Reader is a bit heavy
 	b := bufio.NewReader(r)
 	line, err := b.ReadString('\n')
 	if err != nil {
-		log.Println("icecast.detector: failed to read first line:", err)
-		return nil
+		return "", nil, fmt.Errorf("failed to read first line: %s", err)
 	}
 
 	method, uri, _, ok := parseRequestLine(line)
 	if !ok {
-		log.Println("icecast.detector: failed to parse request line")
-		return nil
+		return "", nil, errors.New("failed to parse request line")
 	}
 
-	if method == "SOURCE" {
-		return s.SourceHandler
+	if method == "SOURCE" || method == "PUT" {
+		return DetectorSource, s.SourceHandler, nil
 	}
 
 	// All handlers below expect a GET request, so we can return
 	// early if this isn't a GET
 	if method != "GET" {
-		return nil
+		return "", nil, nil
 	}
 
-	// Check for '/admin/listclients' and '/admin/metadata' request,
-	// both are special for icecast. Anything else we try as a client
-	// requesting a mountpoint.
+	// Check for the '/admin/listclients', '/admin/metadata',
+	// '/admin/reload' and '/admin/detectors' requests, these are
+	// special for icecast.
+	// Anything else we try as a client requesting a mountpoint.
 	u, err := url.ParseRequestURI(uri)
 	if err != nil {
-		return nil
+		return "", nil, nil
 	}
 
 	if u.Path == "/admin/listclients" {
-		return s.ListClientHandler
+		return DetectorAdmin, s.ListClientHandler, nil
 	} else if u.Path == "/admin/metadata" {
-		return s.MetadataHandler
+		return DetectorAdmin, s.MetadataHandler, nil
+	} else if u.Path == "/admin/reload" {
+		return DetectorAdmin, s.ReloadHandler, nil
+	} else if u.Path == "/admin/detectors" {
+		return DetectorAdmin, s.DetectorsHandler, nil
 	}
 
 	// this is racey because the mount could not exist before the handler
 	// is actually called, this is okay in this case because the handler
 	// also checks for this condition.
-	if s.MountExists(u.Path) {
-		return s.ClientHandler
+	if s.MountExists(s.mountName(u)) {
+		return DetectorListener, s.ClientHandler, nil
 	}
 
-	return nil
+	return "", nil, nil
 }
 
 func parseRequestLine(line string) (method, requestURI, proto string, ok bool) {
@@ -70,5 +123,5 @@ func parseRequestLine(line string) (method, requestURI, proto string, ok bool) {
 		return
 	}
 	s2 += s1 + 1
-	return line[:s1], line[s1+1 : s2], line[s2+1:], true
+	return line[:s1], line[s1+1 : s2], strings.TrimSpace(line[s2+1:]), true
 }
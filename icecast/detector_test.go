@@ -0,0 +1,60 @@
+package icecast
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Wessie/sirencast"
+	"github.com/Wessie/sirencast/config"
+)
+
+func TestDetectKind(t *testing.T) {
+	s := NewServer(&config.Config{})
+	defer s.Close()
+
+	if _, err := s.sourceMount("/live", "audio/mpeg"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		request string
+		kind    string
+	}{
+		{"SOURCE /live ICE/1.0\r\n", DetectorSource},
+		{"PUT /live HTTP/1.1\r\n", DetectorSource},
+		{"GET /live HTTP/1.1\r\n", DetectorListener},
+		{"GET /admin/metadata?mount=/live HTTP/1.1\r\n", DetectorAdmin},
+		{"GET /unknown HTTP/1.1\r\n", ""},
+		{"POST /live HTTP/1.1\r\n", ""},
+	}
+
+	kinds := []string{DetectorSource, DetectorListener, DetectorAdmin}
+	for _, test := range tests {
+		if h := s.Detect(strings.NewReader(test.request)); (h != nil) != (test.kind != "") {
+			t.Errorf("%q: unexpected result from Detect", test.request)
+		}
+
+		for _, kind := range kinds {
+			h := s.detectKind(kind)(strings.NewReader(test.request))
+			if (h != nil) != (kind == test.kind) {
+				t.Errorf("%q: unexpected result from the %s detector", test.request, kind)
+			}
+		}
+	}
+
+	// the registered detectors can be picked by name
+	ds := sirencast.NewDetectors()
+	s.RegisterDetectors(ds)
+
+	var names []string
+	for _, st := range ds.Stats() {
+		names = append(names, st.Name)
+	}
+	expected := []string{
+		DetectorShoutcast2, DetectorSource, DetectorListener,
+		DetectorAdmin, DetectorShoutcast, sirencast.DefaultName,
+	}
+	if strings.Join(names, " ") != strings.Join(expected, " ") {
+		t.Errorf("unexpected detectors: %q", names)
+	}
+}
@@ -0,0 +1,232 @@
+package icecast
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/Wessie/sirencast"
+)
+
+// Kinds of connections handed off by Server.Handoff
+const (
+	HandoffClient = "icecast.client"
+	HandoffSource = "icecast.source"
+)
+
+// clientState is the state of a handed off client
+type clientState struct {
+	Mount       string
+	ContentType string
+	ID          uint64
+	Sent        uint64
+	Addr        string
+	UserAgent   string
+	Connected   time.Time
+	Meta        bool
+	Metaint     int
+	Offset      int
+	CurMeta     string
+	CurFields   []MetaField
+	Ultravox    uint16
+}
+
+// sourceState is the state of a handed off source
+type sourceState struct {
+	Mount       string
+	ContentType string
+	Method      string
+	RequestURI  string
+	Proto       string
+	Header      http.Header
+	Metadata    string
+	Fields      []MetaField
+	// Headers are the stream headers of formats that have them
+	Headers []byte
+}
+
+// Handoff stops all clients and all sources that support it, and returns
+// them to be handed off to a new process. Sources that can't be handed
+// off are left running until the mount is closed.
+func (s *Server) Handoff() []sirencast.Handoff {
+	s.mu.Lock()
+	mounts := make([]*Mount, 0, len(s.mounts))
+	for _, m := range s.mounts {
+		mounts = append(mounts, m)
+	}
+	s.mu.Unlock()
+
+	var handoffs []sirencast.Handoff
+	for _, m := range mounts {
+		for _, src := range m.detachSources() {
+			var headers []byte
+			if hf, ok := src.frames.(headerFramer); ok {
+				headers = hf.Headers()
+			}
+
+			state, err := json.Marshal(sourceState{
+				Mount:       m.Name,
+				ContentType: m.ContentType,
+				Method:      src.req.Method,
+				RequestURI:  src.req.RequestURI,
+				Proto:       src.req.Proto,
+				Header:      src.req.Header,
+				Metadata:    m.sourceMeta.Get(src.ID()),
+				Fields:      m.sourceMeta.Fields(src.ID()),
+				Headers:     headers,
+			})
+			if err != nil {
+				log.Println("icecast.handoff: failed to encode source state:", err)
+				src.conn.Close()
+				continue
+			}
+
+			handoffs = append(handoffs, sirencast.Handoff{
+				Kind:    HandoffSource,
+				State:   state,
+				Pending: src.pending(),
+				Conn:    src.conn,
+			})
+		}
+
+		for _, c := range m.detachClients() {
+			state, err := json.Marshal(clientState{
+				Mount:       m.Name,
+				ContentType: m.ContentType,
+				ID:          c.id,
+				Sent:        atomic.LoadUint64(&c.sent),
+				Addr:        c.addr,
+				UserAgent:   c.userAgent,
+				Connected:   c.connected,
+				Meta:        c.meta,
+				Metaint:     c.metaint,
+				Offset:      c.offset,
+				CurMeta:     c.curMeta,
+				CurFields:   c.curFields,
+				Ultravox:    c.ultravox,
+			})
+			if err != nil {
+				log.Println("icecast.handoff: failed to encode client state:", err)
+				c.conn.Close()
+				continue
+			}
+
+			handoffs = append(handoffs, sirencast.Handoff{
+				Kind:  HandoffClient,
+				State: state,
+				Conn:  c.conn,
+			})
+		}
+	}
+
+	return handoffs
+}
+
+// ResumeClient resumes a client handed off by Handoff in a previous process
+func (s *Server) ResumeClient(conn *sirencast.Conn, state []byte) {
+	var st clientState
+	if err := json.Unmarshal(state, &st); err != nil {
+		log.Println("icecast.handoff: invalid client state:", err)
+		conn.Close()
+		return
+	}
+
+	mount, err := s.sourceMount(st.Mount, st.ContentType)
+	if err != nil {
+		log.Println("icecast.handoff: unable to resume client on", st.Mount+":", err)
+		conn.Close()
+		return
+	}
+
+	// Make sure new clients don't get an ID that is already in use
+	for {
+		last := atomic.LoadUint64(&lastClientID)
+		if st.ID <= last || atomic.CompareAndSwapUint64(&lastClientID, last, st.ID) {
+			break
+		}
+	}
+
+	c := &Client{
+		sent:      st.Sent,
+		id:        st.ID,
+		conn:      conn,
+		addr:      st.Addr,
+		userAgent: st.UserAgent,
+		connected: st.Connected,
+		meta:      st.Meta,
+		metaint:   st.Metaint,
+		offset:    st.Offset,
+		curMeta:   st.CurMeta,
+		curFields: st.CurFields,
+		ultravox:  st.Ultravox,
+		done:      make(chan struct{}),
+	}
+	c.bufconn = bufio.NewWriter(countWriter{conn, &c.sent})
+
+	// the client already received the data from before the handoff
+	if err := mount.addClient(c, false); err != nil {
+		log.Println("icecast.handoff: failed to resume client on", mount.Name+":", err)
+		conn.Close()
+	}
+}
+
+// ResumeSource resumes a source handed off by Handoff in a previous process
+func (s *Server) ResumeSource(conn *sirencast.Conn, state []byte) {
+	var st sourceState
+	if err := json.Unmarshal(state, &st); err != nil {
+		log.Println("icecast.handoff: invalid source state:", err)
+		conn.Close()
+		return
+	}
+
+	u, err := url.ParseRequestURI(st.RequestURI)
+	if err != nil {
+		log.Println("icecast.handoff: invalid source request uri:", err)
+		conn.Close()
+		return
+	}
+
+	mount, err := s.sourceMount(st.Mount, st.ContentType)
+	if err != nil {
+		log.Println("icecast.handoff: unable to resume source on", st.Mount+":", err)
+		conn.Close()
+		return
+	}
+
+	b := ReadWriteCloser{
+		Reader: bufio.NewReader(conn),
+		Writer: bufio.NewWriter(conn),
+		Closer: conn,
+	}
+
+	req := &http.Request{
+		Method:     st.Method,
+		Proto:      st.Proto,
+		ProtoMajor: 1,
+		ProtoMinor: 0,
+		Header:     st.Header,
+		RequestURI: st.RequestURI,
+		URL:        u,
+		Host:       st.Header.Get("Host"),
+		RemoteAddr: conn.RemoteAddr().String(),
+		Body:       b,
+	}
+
+	source := NewSource(b, req)
+	source.conn, source.buf = conn, b.Reader
+
+	// the source continues in the middle of its stream
+	source.frames = mount.newFramer()
+	if op, ok := source.frames.(*oggParser); ok && len(st.Headers) > 0 {
+		op.seed(st.Headers)
+	}
+	mount.AddSource(source)
+
+	if st.Metadata != "" || len(st.Fields) > 0 {
+		mount.SetMetadataFields(source.ID(), st.Metadata, st.Fields)
+	}
+}
@@ -2,8 +2,17 @@ package icecast
 
 import (
 	"bufio"
+	"errors"
 	"net"
 	"net/http"
+	"net/textproto"
+	"net/url"
+	"strings"
+)
+
+var (
+	ErrInvalidRequestLine = errors.New("request: invalid request line")
+	ErrNotSourceRequest   = errors.New("request: received non-source method request")
 )
 
 // ReadRequest is a light wrapper around http.ReadRequest
@@ -17,3 +26,80 @@ func ReadRequest(conn net.Conn) (*http.Request, error) {
 	r.RemoteAddr = conn.RemoteAddr().String()
 	return r, nil
 }
+
+// ReadSourceRequest reads a source request from `b`, this is either
+// an icecast SOURCE request or a HTTP PUT request. The body of the
+// returned request is not set, the caller should read the stream
+// data from `b` instead.
+func ReadSourceRequest(b *bufio.Reader) (*http.Request, error) {
+	// A request from an icecast source looks similar to plain HTTP.
+	//
+	// The initial line is of the form:
+	// 	SOURCE /mountpoint ICE/1.0
+	//
+	// The HTTP version part of this line (ICE/1.0) is the only thing
+	// holding us back from using the builtin net/http request parsers.
+	//
+	// Instead we parse the first line ourself, and construct a http.Request
+	// from this. PUT requests are plain HTTP but are handled the same for
+	// consistency.
+	tp := textproto.NewReader(b)
+
+	// FIXME: this will read something big if a \n is never found
+	line, err := tp.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+
+	method, uri, proto, ok := parseRequestLine(line)
+	if !ok {
+		return nil, ErrInvalidRequestLine
+	}
+
+	if method != "SOURCE" && method != "PUT" {
+		return nil, ErrNotSourceRequest
+	}
+
+	u, err := url.ParseRequestURI(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	mimeHeader, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	req := &http.Request{
+		Method:     method,
+		Proto:      proto,
+		ProtoMajor: 1,
+		ProtoMinor: 0,
+		Header:     http.Header(mimeHeader),
+		RequestURI: uri,
+		URL:        u,
+		Host:       u.Host,
+	}
+
+	if major, minor, ok := http.ParseHTTPVersion(proto); ok {
+		req.ProtoMajor, req.ProtoMinor = major, minor
+	}
+
+	// Adjust the Host field if it wasn't included in the URI but we
+	// do have a Host header.
+	if req.Host == "" {
+		req.Host = req.Header.Get("Host")
+	}
+
+	return req, nil
+}
+
+// isChunked returns true if the request body uses chunked transfer encoding
+func isChunked(r *http.Request) bool {
+	for _, te := range r.Header["Transfer-Encoding"] {
+		if strings.Contains(strings.ToLower(te), "chunked") {
+			return true
+		}
+	}
+	return false
+}
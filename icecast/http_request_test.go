@@ -0,0 +1,41 @@
+package icecast
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+)
+
+func TestReadSourceRequest(t *testing.T) {
+	tests := []struct {
+		raw    string
+		method string
+		path   string
+		major  int
+		minor  int
+	}{
+		{"SOURCE /main ICE/1.0\r\nContent-Type: audio/mpeg\r\n\r\n", "SOURCE", "/main", 1, 0},
+		{"PUT /main.ogg HTTP/1.1\r\nContent-Type: audio/ogg\r\nExpect: 100-continue\r\n\r\n", "PUT", "/main.ogg", 1, 1},
+	}
+
+	for _, h := range tests {
+		r, err := ReadSourceRequest(bufio.NewReader(strings.NewReader(h.raw)))
+		if err != nil {
+			t.Errorf("failed to read request %q: %s", h.raw, err)
+			continue
+		}
+
+		if r.Method != h.method || r.URL.Path != h.path {
+			t.Errorf("unexpected request: %s %s != %s %s", r.Method, r.URL.Path, h.method, h.path)
+		}
+
+		if r.ProtoMajor != h.major || r.ProtoMinor != h.minor {
+			t.Errorf("unexpected protocol version for %s: %d.%d", r.Proto, r.ProtoMajor, r.ProtoMinor)
+		}
+	}
+
+	_, err := ReadSourceRequest(bufio.NewReader(strings.NewReader("GET /main HTTP/1.1\r\n\r\n")))
+	if err != ErrNotSourceRequest {
+		t.Errorf("expected non-source request error, got: %v", err)
+	}
+}
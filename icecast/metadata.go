@@ -4,6 +4,29 @@ import "sync"
 
 type ReadOnlyMetadata interface {
 	Get() string
+	// Fields returns the extra fields send along with the title
+	Fields() []MetaField
+}
+
+// MetaField is a key/value pair send in ICY metadata next to the
+// StreamTitle, such as StreamUrl.
+type MetaField struct {
+	Key   string
+	Value string
+}
+
+// equalMetaFields returns true if a and b hold the same fields in
+// the same order.
+func equalMetaFields(a, b []MetaField) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
 }
 
 func NewMetadata() *Metadata {
@@ -11,8 +34,9 @@ func NewMetadata() *Metadata {
 }
 
 type Metadata struct {
-	meta string
-	mu   sync.Mutex
+	meta   string
+	fields []MetaField
+	mu     sync.Mutex
 }
 
 func (m *Metadata) Get() string {
@@ -21,28 +45,51 @@ func (m *Metadata) Get() string {
 	return m.meta
 }
 
+func (m *Metadata) Fields() []MetaField {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.fields
+}
+
 func (m *Metadata) Set(s string) {
+	m.SetFields(s, nil)
+}
+
+// SetFields sets the metadata and the extra fields that go with it, the
+// fields given should not be modified afterwards.
+func (m *Metadata) SetFields(s string, fields []MetaField) {
 	m.mu.Lock()
-	m.meta = s
+	m.meta, m.fields = s, fields
 	m.mu.Unlock()
 }
 
 func NewMetadataContainer() *MetadataContainer {
 	return &MetadataContainer{
-		m: make(map[SourceID]string, 1),
+		m:      make(map[SourceID]string, 1),
+		fields: make(map[SourceID][]MetaField, 1),
 	}
 }
 
 type MetadataContainer struct {
-	mu sync.Mutex
-	m  map[SourceID]string
+	mu     sync.Mutex
+	m      map[SourceID]string
+	fields map[SourceID][]MetaField
 }
 
 func (m *MetadataContainer) Set(id SourceID, meta string) {
+	m.SetFields(id, meta, nil)
+}
+
+// SetFields sets the metadata and extra fields of the source given
+func (m *MetadataContainer) SetFields(id SourceID, meta string, fields []MetaField) {
 	m.mu.Lock()
 	m.m[id] = meta
+	if len(fields) > 0 {
+		m.fields[id] = fields
+	} else {
+		delete(m.fields, id)
+	}
 	m.mu.Unlock()
-	return
 }
 
 func (m *MetadataContainer) Get(id SourceID) (meta string) {
@@ -51,3 +98,10 @@ func (m *MetadataContainer) Get(id SourceID) (meta string) {
 	m.mu.Unlock()
 	return meta
 }
+
+// Fields returns the extra fields of the source given
+func (m *MetadataContainer) Fields(id SourceID) []MetaField {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.fields[id]
+}
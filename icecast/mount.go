@@ -1,8 +1,14 @@
 package icecast
 
 import (
+	"errors"
 	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/Wessie/sirencast/config"
 	"github.com/Wessie/sirencast/util"
 )
 
@@ -14,8 +20,18 @@ const (
 	EventRemoveSource
 	EventNewMetadata
 	EventDestroyMount
+	// EventFallback asks the mount to check if its fallback mount
+	// became available.
+	EventFallback
 )
 
+// maxFallbackDepth is the maximum length of a chain of fallback mounts
+const maxFallbackDepth = 16
+
+// ErrMountFull is returned by AddClient if the mount, or the fallback mount
+// its clients are listening to, has the maximum amount of listeners.
+var ErrMountFull = errors.New("icecast: maximum amount of listeners reached")
+
 // Mount depicts a singular icecast mountpoint. A mountpoint can have
 // many clients (same as plain icecast) and have many sources (not the
 // same as icecast).
@@ -31,6 +47,41 @@ type Mount struct {
 
 	meta *Metadata
 	mw   *MultiWriter
+	// out is the writer sources write to, it wraps mw and keeps the
+	// backlog send to new clients.
+	out *mountWriter
+	// quit is closed once runLoop returns
+	quit chan struct{}
+
+	// fallback returns the mount to move listeners to when there are
+	// no sources left, it is nil if the mount has no fallback.
+	fallback func() *Mount
+
+	// infoMu protects info, fallbackTo, relays, metaint and conf
+	infoMu sync.Mutex
+	// info is the stream information of the current source
+	info StreamInfo
+	// fallbackTo is the fallback mount our listeners are currently
+	// listening to, or nil.
+	fallbackTo *Mount
+	// relays are the mounts that have us as their fallbackTo
+	relays map[*Mount]struct{}
+	// metaint is the metaint new clients get, zero means DefaultMetaint
+	metaint int
+	// conf is the configuration of the mount, see Configure
+	conf config.Mount
+
+	// mu protects clients and closed
+	mu sync.Mutex
+	// clients are all clients listening to the mount by ID
+	clients map[uint64]*Client
+	// nclients is len(clients), it is updated under mu but read atomically
+	// by the mounts relaying us.
+	nclients int32
+	// closed indicates if Close has been called
+	closed bool
+	// wg tracks the source and client goroutines
+	wg sync.WaitGroup
 }
 
 func NewMount(name string, content string) *Mount {
@@ -42,36 +93,95 @@ func NewMount(name string, content string) *Mount {
 		meta:        NewMetadata(),
 		mw:          NewMultiWriter(),
 		events:      make(chan mountEvent),
+		quit:        make(chan struct{}),
+		clients:     make(map[uint64]*Client),
+		relays:      make(map[*Mount]struct{}),
+	}
+	m.out = newMountWriter(m.mw, m.newFramer(), m.frameSync())
+	if isOgg(content) {
+		m.out.rewriter = new(oggRewriter)
 	}
 	go m.runLoop()
 	return &m
 }
 
 func (m *Mount) runLoop() {
-	var current *Source
+	defer close(m.quit)
+
+	var (
+		current *Source
+		// output is the gate the data of the current source passes
+		// through, or the relay of our fallback mount if we have no
+		// source. The gate is stopped at a frame boundary when the
+		// current source changes.
+		output *frameGate
+	)
 	for {
-		switch <-m.events {
-		case EventNewSource, EventRemoveSource:
+		switch ev := <-m.events; ev {
+		case EventNewSource, EventRemoveSource, EventFallback:
 			next := m.sources.Top()
-			if next == nil && current != nil {
-				current.SwapOutput(discardWriter)
+			if next == current {
+				// without a source our fallback mount can have become
+				// available, or was changed or removed on a reload.
+				if current == nil && m.fallbackMount() != m.currentFallback() {
+					var after <-chan struct{}
+					if output != nil {
+						m.log("leaving fallback: %s", m.currentFallback().Name)
+						after = output.stop()
+						m.setFallback(nil)
+					}
+					output = m.startFallback(after)
+				}
 				continue
 			}
 
-			if next != current && current != nil {
-				current.SwapOutput(discardWriter)
+			// the next source starts once the current output reached a
+			// frame boundary, unless the current source is gone already
+			// since no more data is coming from it.
+			var after <-chan struct{}
+			if output != nil {
+				if current != nil && ev == EventRemoveSource {
+					output.finish()
+				} else {
+					after = output.stop()
+				}
+
+				if current == nil {
+					m.log("moving clients back from fallback")
+					m.setFallback(nil)
+				}
+				output = nil
 			}
 
-			next.SwapOutput(m.mw)
 			current = next
+			if current == nil {
+				m.setStreamInfo(StreamInfo{})
+				output = m.startFallback(nil)
+				continue
+			}
+
+			output = newFrameGate(m.out, current.frames, after)
+			output.discard = true
+			current.SwapOutput(output)
+
+			m.out.setBitrate(current.Info().Kbps(), isMP3(m.ContentType))
+			m.setStreamInfo(current.Info())
+			m.meta.SetFields(m.sourceMeta.Get(current.ID()), m.sourceMeta.Fields(current.ID()))
+			m.out.setMetadata(m.meta.Get())
 		case EventNewMetadata:
 			if current == nil {
 				continue
 			}
-			m.meta.Set(
+			m.meta.SetFields(
 				m.sourceMeta.Get(current.ID()),
+				m.sourceMeta.Fields(current.ID()),
 			)
+			m.out.setMetadata(m.meta.Get())
 		case EventDestroyMount:
+			if output != nil {
+				output.finish()
+				m.setFallback(nil)
+			}
 			return
 		default:
 			panic("icecast.mount: invalid mount event issued")
@@ -79,32 +189,431 @@ func (m *Mount) runLoop() {
 	}
 }
 
-// Close disconnects all sources and clients
+// startFallback starts relaying the data of our fallback mount to our
+// clients once after is closed, if it is non-nil. It returns nil if there
+// is no usable fallback mount.
+func (m *Mount) startFallback(after <-chan struct{}) *frameGate {
+	fb := m.fallbackMount()
+	if fb == nil {
+		return nil
+	}
+
+	if fb.ContentType != m.ContentType {
+		m.log("fallback %s has a different content-type: %s", fb.Name, fb.ContentType)
+		return nil
+	}
+
+	if !fb.admits(m.listeners()) {
+		m.log("not moving clients to fallback %s, it would exceed its maximum listeners", fb.Name)
+		return nil
+	}
+
+	m.log("moving clients to fallback: %s", fb.Name)
+	g := newFrameGate(m.out, nil, after)
+	fb.out.relay(g)
+	m.setFallback(fb)
+	return g
+}
+
+// fallbackMount returns the fallback mount, or nil if there is none or
+// following the fallbacks would lead back to us.
+func (m *Mount) fallbackMount() *Mount {
+	if m.fallback == nil {
+		return nil
+	}
+
+	fb := m.fallback()
+	for cur, depth := fb, 0; cur != nil; depth++ {
+		if cur == m || depth >= maxFallbackDepth {
+			m.log("ignoring fallback, it loops back to us or is too deep")
+			return nil
+		}
+
+		if cur.fallback == nil {
+			break
+		}
+		cur = cur.fallback()
+	}
+	return fb
+}
+
+// newFramer returns a framer for the data of our sources
+func (m *Mount) newFramer() framer {
+	switch {
+	case isMP3(m.ContentType):
+		return new(mp3Parser)
+	case isOgg(m.ContentType):
+		return new(oggParser)
+	}
+	return anyFramer{}
+}
+
+// frameSync returns the function used to find where to start the burst
+// in the backlog send to new clients.
+func (m *Mount) frameSync() func([]byte) int {
+	switch {
+	case isMP3(m.ContentType):
+		return mp3FrameSync
+	case isOgg(m.ContentType):
+		return oggBurstStart
+	}
+	return anySync
+}
+
+func (m *Mount) setFallback(fb *Mount) {
+	m.infoMu.Lock()
+	old := m.fallbackTo
+	m.fallbackTo = fb
+	m.infoMu.Unlock()
+
+	if old != nil {
+		old.infoMu.Lock()
+		delete(old.relays, m)
+		old.infoMu.Unlock()
+	}
+	if fb != nil {
+		fb.infoMu.Lock()
+		fb.relays[m] = struct{}{}
+		fb.infoMu.Unlock()
+	}
+}
+
+func (m *Mount) currentFallback() *Mount {
+	m.infoMu.Lock()
+	defer m.infoMu.Unlock()
+	return m.fallbackTo
+}
+
+// sendEvent sends an event to the mount, unless it was already destroyed
+func (m *Mount) sendEvent(ev mountEvent) {
+	select {
+	case m.events <- ev:
+	case <-m.quit:
+	}
+}
+
+// Metadata returns the metadata our clients should receive, this is
+// the metadata of the fallback mount if our clients are listening to it.
+func (m *Mount) Metadata() ReadOnlyMetadata {
+	return mountMetadata{m}
+}
+
+type mountMetadata struct {
+	m *Mount
+}
+
+func (mm mountMetadata) Get() string {
+	if fb := mm.m.currentFallback(); fb != nil {
+		return fb.Metadata().Get()
+	}
+	return mm.m.meta.Get()
+}
+
+func (mm mountMetadata) Fields() []MetaField {
+	if fb := mm.m.currentFallback(); fb != nil {
+		return fb.Metadata().Fields()
+	}
+	return mm.m.meta.Fields()
+}
+
+// StreamInfo returns the stream information of the current source, or
+// that of the fallback mount if our clients are listening to it.
+func (m *Mount) StreamInfo() StreamInfo {
+	if fb := m.currentFallback(); fb != nil {
+		return fb.StreamInfo()
+	}
+
+	m.infoMu.Lock()
+	defer m.infoMu.Unlock()
+
+	info := m.info
+	set := func(field *string, value string) {
+		if value != "" {
+			*field = value
+		}
+	}
+	set(&info.Name, m.conf.StreamName)
+	set(&info.Description, m.conf.StreamDescription)
+	set(&info.Genre, m.conf.StreamGenre)
+	set(&info.URL, m.conf.StreamURL)
+	if m.conf.Public != nil {
+		info.Public = *m.conf.Public
+	}
+	return info
+}
+
+func (m *Mount) setStreamInfo(info StreamInfo) {
+	m.infoMu.Lock()
+	m.info = info
+	m.infoMu.Unlock()
+}
+
+// Close disconnects all sources and clients, and waits for them to be
+// removed from the mount. Clients get the data they already received
+// flushed before being disconnected.
 func (m *Mount) Close() {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return
+	}
+	m.closed = true
+
+	for _, c := range m.clients {
+		c.input.Close()
+	}
+	m.mu.Unlock()
 
+	for _, s := range m.sources.All() {
+		s.Close()
+	}
+
+	m.wg.Wait()
+	m.sendEvent(EventDestroyMount)
 	return
 }
 
-func (m *Mount) AddClient(c *Client) {
-	m.log("adding client: %v", c)
+// AddClient adds a client to the mount, the client is send the burst
+// backlog of the mount before any new data. ErrMountFull is returned if
+// there is no room for another listener.
+func (m *Mount) AddClient(c *Client) error {
+	return m.addClient(c, true)
+}
+
+// Configure applies the configuration given to the mount. The stream
+// information in it overrides that of the sources, and settings left
+// empty use their defaults.
+func (m *Mount) Configure(conf config.Mount) {
+	m.SetBurst(conf.BurstSize, conf.BurstSeconds)
+	m.SetMetaint(conf.Metaint)
+
+	m.infoMu.Lock()
+	m.conf = conf
+	m.infoMu.Unlock()
+}
+
+// full returns true if the mount has the maximum amount of listeners
+// configured.
+func (m *Mount) full() bool {
+	return !m.room(1)
+}
+
+// room returns true if n more listeners fit within the maximum amount of
+// listeners configured for the mount.
+func (m *Mount) room(n int) bool {
+	m.infoMu.Lock()
+	max := m.conf.MaxListeners
+	m.infoMu.Unlock()
+
+	return max <= 0 || m.listeners()+n <= max
+}
+
+// admits returns true if n more listeners fit on the mount, and on the
+// fallback mounts its clients are listening to.
+func (m *Mount) admits(n int) bool {
+	for cur, depth := m, 0; cur != nil && depth <= maxFallbackDepth; depth++ {
+		if !cur.room(n) {
+			return false
+		}
+		cur = cur.currentFallback()
+	}
+	return true
+}
+
+// listeners returns the amount of clients receiving our data, these are
+// our own clients and those of the mounts relaying us as their fallback.
+func (m *Mount) listeners() int {
+	n := int(atomic.LoadInt32(&m.nclients))
 
+	m.infoMu.Lock()
+	relays := make([]*Mount, 0, len(m.relays))
+	for r := range m.relays {
+		relays = append(relays, r)
+	}
+	m.infoMu.Unlock()
+
+	for _, r := range relays {
+		n += r.listeners()
+	}
+	return n
+}
+
+// SetMetaint sets the amount of bytes between metadata sections for new
+// clients, clients already connected keep using the metaint they got. Zero
+// or negative means DefaultMetaint.
+func (m *Mount) SetMetaint(n int) {
+	m.infoMu.Lock()
+	m.metaint = n
+	m.infoMu.Unlock()
+}
+
+// Metaint returns the amount of bytes between metadata sections for new
+// clients.
+func (m *Mount) Metaint() int {
+	m.infoMu.Lock()
+	defer m.infoMu.Unlock()
+	if m.metaint <= 0 {
+		return DefaultMetaint
+	}
+	return m.metaint
+}
+
+// SetBurst sets the amount of data send to new clients when they connect
+// in bytes, or in seconds if the bitrate of the stream is known. A size of
+// zero means DefaultBurstSize and a negative size disables the burst.
+func (m *Mount) SetBurst(size, seconds int) {
+	if size == 0 {
+		size = DefaultBurstSize
+	} else if size < 0 {
+		size, seconds = 0, 0
+	}
+	m.out.setBurst(size, seconds)
+}
+
+func (m *Mount) addClient(c *Client, burst bool) error {
 	r := util.NewRingBuffer(5)
-	m.mw.Add(r)
-	go c.runLoop(r, m.meta)
+	c.input = r
+
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		c.conn.Close()
+		return nil
+	}
+	// checked while holding mu so two clients can't take the last spot
+	if !m.admits(1) {
+		m.mu.Unlock()
+		return ErrMountFull
+	}
+	m.log("adding client: %v", c)
+	m.clients[c.id] = c
+	atomic.AddInt32(&m.nclients, 1)
+	m.wg.Add(1)
+	m.mu.Unlock()
+
+	if burst {
+		m.out.join(r)
+	} else {
+		m.out.add(r)
+	}
+	go func() {
+		defer m.wg.Done()
+		defer close(c.done)
+		c.runLoop(r, m.Metadata())
+
+		m.mu.Lock()
+		delete(m.clients, c.id)
+		atomic.AddInt32(&m.nclients, -1)
+		m.mu.Unlock()
+		m.log("removing client: %v", c)
+	}()
+	return nil
+}
+
+// detachClients stops all clients without disconnecting them and returns
+// them once they have been removed from the mount.
+func (m *Mount) detachClients() []*Client {
+	m.mu.Lock()
+	clients := make([]*Client, 0, len(m.clients))
+	for _, c := range m.clients {
+		atomic.StoreInt32(&c.detached, 1)
+		c.input.Close()
+		clients = append(clients, c)
+	}
+	m.mu.Unlock()
+
+	for _, c := range clients {
+		<-c.done
+	}
+	return clients
+}
+
+// detachSources stops all sources that can be handed off without
+// disconnecting them and returns them once they have been removed
+// from the mount.
+func (m *Mount) detachSources() []*Source {
+	var sources []*Source
+	for _, s := range m.sources.All() {
+		if s.conn == nil || s.buf == nil {
+			continue
+		}
+
+		// interrupt the read the source is blocked on
+		atomic.StoreInt32(&s.detached, 1)
+		s.conn.SetReadDeadline(time.Now())
+		sources = append(sources, s)
+	}
+
+	for _, s := range sources {
+		<-s.done
+		s.conn.SetReadDeadline(time.Time{})
+	}
+	return sources
 }
 
+// Clients returns information about all clients currently listening
+// to the mount, ordered by client ID.
+func (m *Mount) Clients() []ClientInfo {
+	m.mu.Lock()
+	info := make([]ClientInfo, 0, len(m.clients))
+	for _, c := range m.clients {
+		info = append(info, c.Info())
+	}
+	m.mu.Unlock()
+
+	sort.Sort(byClientID(info))
+	return info
+}
+
+type byClientID []ClientInfo
+
+func (s byClientID) Len() int           { return len(s) }
+func (s byClientID) Less(i, j int) bool { return s[i].ID < s[j].ID }
+func (s byClientID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
 // AddSource adds a new source to the mountpoint, the mountpoint will
 // be responsible for sources output and removal after disconnection
 func (m *Mount) AddSource(s *Source) {
+	m.AddSourcePriority(s, DefaultPriority)
+}
+
+// AddSourcePriority adds a new source to the mountpoint with the priority
+// given, the source with the highest priority is the one being played.
+func (m *Mount) AddSourcePriority(s *Source, priority int) {
 	m.log("adding source: %v", s)
-	m.sources.Add(s)
-	m.events <- EventNewSource
+
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		s.Close()
+		return
+	}
+	m.wg.Add(1)
+	m.mu.Unlock()
+
+	// sources are parked on a finished gate until they become the
+	// current source, such that their framer sees all of their data.
+	if s.frames == nil {
+		s.frames = m.newFramer()
+	}
+	s.onMetadata = func(meta string) {
+		m.SetMetadata(s.ID(), meta)
+	}
+	park := newFrameGate(discardWriter, s.frames, nil)
+	park.discard = true
+	park.finish()
+	s.SwapOutput(park)
+
+	m.sources.AddPriority(s, priority)
+	m.sendEvent(EventNewSource)
 
 	go func() {
+		defer m.wg.Done()
+		defer close(s.done)
 		// read from the source and remove when it returns
 		s.readLoop()
-		m.sources.Remove(s)
-		m.events <- EventRemoveSource
+		m.sources.RemovePriority(s, priority)
+		m.sendEvent(EventRemoveSource)
 		m.log("removing source: %v", s)
 	}()
 }
@@ -113,10 +622,15 @@ func (m *Mount) AddSource(s *Source) {
 // SourceID. Setting an empty string means deleting the current
 // metadata.
 func (m *Mount) SetMetadata(id SourceID, metadata string) {
-	m.log("setting metadata: id: %s meta: %s", id, metadata)
-	m.sourceMeta.Set(id, metadata)
-	m.events <- EventNewMetadata
-	return
+	m.SetMetadataFields(id, metadata, nil)
+}
+
+// SetMetadataFields is like SetMetadata but also sets extra fields to
+// send in the ICY metadata, such as StreamUrl.
+func (m *Mount) SetMetadataFields(id SourceID, metadata string, fields []MetaField) {
+	m.log("setting metadata: id: %s meta: %s fields: %v", id, metadata, fields)
+	m.sourceMeta.SetFields(id, metadata, fields)
+	m.sendEvent(EventNewMetadata)
 }
 
 func (m *Mount) log(f string, args ...interface{}) {
@@ -0,0 +1,451 @@
+package icecast
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Wessie/sirencast/config"
+)
+
+func TestMountClose(t *testing.T) {
+	m := NewMount("/test", "audio/mpeg")
+
+	clientConn, clientRemote := net.Pipe()
+	r, _ := http.NewRequest("GET", "/test", nil)
+	m.AddClient(NewClient(clientConn, r))
+
+	sourceConn, sourceRemote := net.Pipe()
+	defer sourceRemote.Close()
+	r, _ = http.NewRequest("SOURCE", "/test", nil)
+	m.AddSource(NewSource(sourceConn, r))
+
+	done := make(chan struct{})
+	go func() {
+		m.Close()
+		close(done)
+	}()
+
+	// the client should be disconnected, reading returns once it is
+	go ioutil.ReadAll(clientRemote)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("mount close did not return")
+	}
+
+	if n := len(m.Clients()); n != 0 {
+		t.Errorf("mount still has %d clients after close", n)
+	}
+
+	if s := m.sources.Top(); s != nil {
+		t.Error("mount still has a source after close")
+	}
+
+	// adding a client after close should disconnect it immediately
+	conn, remote := net.Pipe()
+	m.AddClient(NewClient(conn, r))
+	if _, err := remote.Read(make([]byte, 1)); err == nil {
+		t.Error("client added after close was not disconnected")
+	}
+}
+
+func TestMountEventsAfterClose(t *testing.T) {
+	m := NewMount("/test", "audio/mpeg")
+	m.Close()
+
+	// events sent to a closed mount shouldn't block
+	done := make(chan struct{})
+	go func() {
+		r, _ := http.NewRequest("GET", "/admin/metadata", nil)
+		m.SetMetadata(NewSourceID(r), "late song")
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("metadata update blocked on a closed mount")
+	}
+}
+
+func TestMountDetachClients(t *testing.T) {
+	m := NewMount("/test", "audio/mpeg")
+	defer m.Close()
+
+	conn, remote := net.Pipe()
+	defer remote.Close()
+
+	r, _ := http.NewRequest("GET", "/test", nil)
+	r.Header.Set("Icy-Metadata", "1")
+	m.AddClient(NewClient(conn, r))
+
+	clients := m.detachClients()
+	if len(clients) != 1 {
+		t.Fatalf("unexpected amount of detached clients: %d", len(clients))
+	}
+
+	if n := len(m.Clients()); n != 0 {
+		t.Errorf("mount still has %d clients after detaching", n)
+	}
+
+	// the connection should still be usable after detaching
+	go conn.Write([]byte("x"))
+	remote.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := remote.Read(make([]byte, 1)); err != nil {
+		t.Error("client connection was closed by detaching:", err)
+	}
+}
+
+// expectStream feeds data to a source connection until the client
+// connection receives it.
+func expectStream(t *testing.T, source, client net.Conn, data string) {
+	chunk := []byte(strings.Repeat(data, 4096/len(data)+1))
+	buf := make([]byte, 16384)
+
+	for i := 0; i < 100; i++ {
+		source.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+		source.Write(chunk)
+
+		client.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+		n, _ := client.Read(buf)
+		if strings.Contains(string(buf[:n]), data+data) {
+			return
+		}
+	}
+	t.Fatalf("client did not receive %q", data)
+}
+
+func TestMountFallback(t *testing.T) {
+	s := NewServer(&config.Config{
+		Mounts: []config.Mount{{Name: "/main", Fallback: "/fallback"}},
+	})
+	defer s.Close()
+
+	fb, _ := s.sourceMount("/fallback", "audio/aac")
+	fbConn, fbRemote := net.Pipe()
+	defer fbRemote.Close()
+	r, _ := http.NewRequest("SOURCE", "/fallback", nil)
+	fb.AddSource(NewSource(fbConn, r))
+	fb.SetMetadata(NewSourceID(r), "fallback song")
+
+	main, _ := s.sourceMount("/main", "audio/aac")
+	conn, remote := net.Pipe()
+	defer remote.Close()
+	r, _ = http.NewRequest("GET", "/main", nil)
+	main.AddClient(NewClient(conn, r))
+
+	// without a source the client should hear the fallback
+	expectStream(t, fbRemote, remote, "fallback")
+	if meta := main.Metadata().Get(); meta != "fallback song" {
+		t.Errorf("unexpected metadata during fallback: %q", meta)
+	}
+
+	// and move back once a source connects
+	sourceConn, sourceRemote := net.Pipe()
+	defer sourceRemote.Close()
+	r, _ = http.NewRequest("SOURCE", "/main", nil)
+	main.AddSource(NewSource(sourceConn, r))
+
+	go io.Copy(ioutil.Discard, remote)
+	for i := 0; main.currentFallback() != nil; i++ {
+		if i > 100 {
+			t.Fatal("clients were not moved back from fallback")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMountFallbackReload(t *testing.T) {
+	s := NewServer(&config.Config{
+		Mounts: []config.Mount{{Name: "/main", Fallback: "/a"}},
+	})
+	defer s.Close()
+
+	source := func(name string) net.Conn {
+		m, _ := s.sourceMount(name, "audio/aac")
+		conn, remote := net.Pipe()
+		r, _ := http.NewRequest("SOURCE", name, nil)
+		m.AddSource(NewSource(conn, r))
+		return remote
+	}
+	aRemote, bRemote := source("/a"), source("/b")
+	defer aRemote.Close()
+	defer bRemote.Close()
+
+	main, _ := s.sourceMount("/main", "audio/aac")
+	conn, remote := net.Pipe()
+	defer remote.Close()
+	r, _ := http.NewRequest("GET", "/main", nil)
+	main.AddClient(NewClient(conn, r))
+
+	expectStream(t, aRemote, remote, "first")
+
+	// a changed fallback mount is picked up on a reload
+	s.SetConfig(&config.Config{
+		Mounts: []config.Mount{{Name: "/main", Fallback: "/b"}},
+	})
+	expectStream(t, bRemote, remote, "second")
+	if fb := main.currentFallback(); fb == nil || fb.Name != "/b" {
+		t.Errorf("unexpected fallback after reload: %v", fb)
+	}
+
+	// and so is a removed one
+	s.SetConfig(&config.Config{})
+	for i := 0; main.currentFallback() != nil; i++ {
+		if i > 100 {
+			t.Fatal("clients were not moved away from the removed fallback")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMountFallbackLoop(t *testing.T) {
+	s := NewServer(&config.Config{
+		Mounts: []config.Mount{
+			{Name: "/a", Fallback: "/b"},
+			{Name: "/b", Fallback: "/a"},
+		},
+	})
+	defer s.Close()
+
+	a, _ := s.sourceMount("/a", "audio/aac")
+	s.sourceMount("/b", "audio/aac")
+
+	if fb := a.fallbackMount(); fb != nil {
+		t.Errorf("looping fallback was used: %s", fb.Name)
+	}
+}
+
+func TestMountConfig(t *testing.T) {
+	public := false
+	s := NewServer(&config.Config{
+		RejectUndeclaredMounts: true,
+		Mounts: []config.Mount{{
+			Name:         "/declared",
+			ContentType:  "audio/mpeg",
+			MaxListeners: 1,
+			Metaint:      8192,
+			Public:       &public,
+			StreamName:   "Configured name",
+		}},
+	})
+	defer s.Close()
+
+	if _, err := s.sourceMount("/undeclared", "audio/mpeg"); err != ErrUndeclaredMount {
+		t.Errorf("expected %v, got %v", ErrUndeclaredMount, err)
+	}
+	if _, err := s.sourceMount("/declared", "application/ogg"); err != ErrContentType {
+		t.Errorf("expected %v, got %v", ErrContentType, err)
+	}
+
+	m, err := s.sourceMount("/declared", "audio/mpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := m.Metaint(); n != 8192 {
+		t.Errorf("unexpected metaint: %d", n)
+	}
+
+	m.setStreamInfo(StreamInfo{Name: "Source name", Genre: "Source genre", Public: true})
+	info := m.StreamInfo()
+	if info.Name != "Configured name" || info.Genre != "Source genre" || info.Public {
+		t.Errorf("unexpected stream info: %+v", info)
+	}
+
+	if m.full() {
+		t.Errorf("mount without listeners is full")
+	}
+
+	conn, remote := net.Pipe()
+	defer remote.Close()
+	r, _ := http.NewRequest("GET", "/declared", nil)
+	m.AddClient(NewClient(conn, r))
+	if !m.full() {
+		t.Errorf("mount with maximum listeners isn't full")
+	}
+}
+
+func TestMountMaxListeners(t *testing.T) {
+	s := NewServer(&config.Config{
+		Mounts: []config.Mount{
+			{Name: "/main", Fallback: "/fallback"},
+			{Name: "/fallback", MaxListeners: 2},
+		},
+	})
+	defer s.Close()
+
+	addClient := func(m *Mount) error {
+		conn, remote := net.Pipe()
+		go ioutil.ReadAll(remote)
+		r, _ := http.NewRequest("GET", m.Name, nil)
+		return m.AddClient(NewClient(conn, r))
+	}
+
+	// clients racing for the last spot
+	fb, _ := s.sourceMount("/fallback", "audio/mpeg")
+	errs := make(chan error)
+	for i := 0; i < 10; i++ {
+		go func() { errs <- addClient(fb) }()
+	}
+	var added int
+	for i := 0; i < 10; i++ {
+		if err := <-errs; err == nil {
+			added++
+		} else if err != ErrMountFull {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+	if added != 2 {
+		t.Fatalf("%d clients added to a mount with a maximum of 2", added)
+	}
+
+	// make room for a listener of /main to be moved in
+	fb.Configure(config.Mount{Name: "/fallback", MaxListeners: 3})
+
+	main, _ := s.sourceMount("/main", "audio/mpeg")
+	for i := 0; i < 100 && main.currentFallback() != fb; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if main.currentFallback() != fb {
+		t.Fatal("mount did not move to its fallback")
+	}
+
+	if err := addClient(main); err != nil {
+		t.Fatal("client refused while the fallback has room:", err)
+	}
+
+	// the listener of /main counts towards the maximum of /fallback
+	if err := addClient(fb); err != ErrMountFull {
+		t.Errorf("expected %v on the fallback, got %v", ErrMountFull, err)
+	}
+	if err := addClient(main); err != ErrMountFull {
+		t.Errorf("expected %v on the relaying mount, got %v", ErrMountFull, err)
+	}
+}
+
+func TestServerSetConfig(t *testing.T) {
+	s := NewServer(&config.Config{})
+	defer s.Close()
+
+	m, err := s.sourceMount("/live", "audio/mpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, remote := net.Pipe()
+	defer remote.Close()
+	r, _ := http.NewRequest("GET", "/live", nil)
+	c := NewClient(conn, r)
+	m.AddClient(c)
+
+	s.SetConfig(&config.Config{
+		RejectUndeclaredMounts: true,
+		Mounts: []config.Mount{{
+			Name:         "/live",
+			MaxListeners: 1,
+			Metaint:      4096,
+			StreamName:   "Reloaded",
+		}},
+	})
+
+	if !m.full() || m.Metaint() != 4096 || m.StreamInfo().Name != "Reloaded" {
+		t.Errorf("mount did not pick up the new configuration")
+	}
+
+	if _, err := s.sourceMount("/other", "audio/mpeg"); err != ErrUndeclaredMount {
+		t.Errorf("expected %v, got %v", ErrUndeclaredMount, err)
+	}
+
+	select {
+	case <-c.done:
+		t.Errorf("client was disconnected by the new configuration")
+	default:
+	}
+
+	// removing the mount from the configuration resets it
+	s.SetConfig(&config.Config{})
+	if m.full() || m.Metaint() != DefaultMetaint || m.StreamInfo().Name != "" {
+		t.Errorf("mount kept its old configuration")
+	}
+}
+
+// feedFrames writes MP3 frames filled with fill to conn in odd sized
+// chunks until it is closed. Writes are slowed down a bit such that
+// clients don't drop any data.
+func feedFrames(conn net.Conn, fill byte) {
+	frames := mp3Frames(10, fill)
+	stream := append(frames, frames...)
+	for off := 0; ; off = (off + 1000) % len(frames) {
+		if _, err := conn.Write(stream[off : off+1000]); err != nil {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestMountSwitchAtFrameBoundary(t *testing.T) {
+	m := NewMount("/test", "audio/mpeg")
+	defer m.Close()
+	m.SetBurst(-1, 0)
+
+	lowConn, lowRemote := net.Pipe()
+	defer lowRemote.Close()
+	r, _ := http.NewRequest("SOURCE", "/test", nil)
+	m.AddSource(NewSource(lowConn, r))
+	go feedFrames(lowRemote, 'a')
+
+	conn, remote := net.Pipe()
+	defer remote.Close()
+	r, _ = http.NewRequest("GET", "/test", nil)
+	m.AddClient(NewClient(conn, r))
+
+	var out []byte
+	buf := make([]byte, 16384)
+	read := func(until func() bool) {
+		for i := 0; !until(); i++ {
+			if i > 1000 {
+				t.Fatal("client did not receive expected data")
+			}
+			remote.SetReadDeadline(time.Now().Add(time.Second))
+			n, err := remote.Read(buf)
+			if err != nil {
+				t.Fatal("failed to read from client:", err)
+			}
+			out = append(out, buf[:n]...)
+		}
+	}
+
+	read(func() bool { return len(out) > 4096 })
+
+	highConn, highRemote := net.Pipe()
+	defer highRemote.Close()
+	r, _ = http.NewRequest("SOURCE", "/test", nil)
+	r.RemoteAddr = "127.0.0.2:1234"
+	m.AddSourcePriority(NewSource(highConn, r), DefaultPriority+1)
+	go feedFrames(highRemote, 'b')
+
+	read(func() bool { return bytes.Count(out, []byte("bbbb")) > 100 })
+
+	// the output should consist of complete frames only
+	size := mp3FrameSize(mp3Frame)
+	start := mp3FrameSync(out)
+	for i := start; i+size <= len(out); i += size {
+		frame := out[i : i+size]
+		if !bytes.Equal(frame[:4], mp3Frame[:4]) {
+			t.Fatalf("no frame header at offset %d", i)
+		}
+
+		fill := frame[4]
+		if bytes.Count(frame[4:], []byte{fill}) != size-4 {
+			t.Fatalf("frame at offset %d contains data of both sources", i)
+		}
+	}
+}
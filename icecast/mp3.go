@@ -0,0 +1,234 @@
+package icecast
+
+import (
+	"mime"
+	"strings"
+)
+
+// isMP3 returns true if the content-type given is one used for MPEG audio
+func isMP3(ct string) bool {
+	if t, _, err := mime.ParseMediaType(ct); err == nil {
+		ct = t
+	}
+
+	switch strings.ToLower(ct) {
+	case "audio/mpeg", "audio/mpeg3", "audio/mp3", "audio/x-mpeg":
+		return true
+	}
+	return false
+}
+
+// isMP3Header returns true if h starts with a valid MPEG audio frame header.
+// Free format bitrates are not considered valid since we can't find the
+// frame length of those.
+func isMP3Header(h []byte) bool {
+	if len(h) < 4 || h[0] != 0xFF || h[1]&0xE0 != 0xE0 {
+		return false
+	}
+
+	version := h[1] >> 3 & 0x3
+	layer := h[1] >> 1 & 0x3
+	bitrate := h[2] >> 4
+	samplerate := h[2] >> 2 & 0x3
+
+	return version != 0x1 && layer != 0x0 &&
+		bitrate != 0x0 && bitrate != 0xF && samplerate != 0x3
+}
+
+// mp3FrameSync returns the index of the first MPEG audio frame header
+// in p, or -1 if there is none. Audio data can look like a header, so a
+// header is only accepted if another valid header follows at the end of
+// its frame, or if its frame runs past the end of p.
+func mp3FrameSync(p []byte) int {
+	for i := 0; i+4 <= len(p); i++ {
+		size := mp3FrameSize(p[i:])
+		if size == 0 {
+			continue
+		}
+
+		if next := i + size; next+4 > len(p) || isMP3Header(p[next:]) {
+			return i
+		}
+	}
+	return -1
+}
+
+// anySync is the frame sync used for formats we know nothing about, every
+// write is considered to start at a frame boundary.
+func anySync(p []byte) int {
+	return 0
+}
+
+// mp3Bitrates are the bitrates in kbit/s by bitrate index, for MPEG-1
+// layer I, II and III followed by MPEG-2/2.5 layer I and layer II/III.
+var mp3Bitrates = [5][15]int{
+	{0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448},
+	{0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384},
+	{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320},
+	{0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256},
+	{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+}
+
+// mp3Bitrate returns the bitrate in kbit/s of the MPEG audio frame header
+// h, h should be a valid header as reported by isMP3Header.
+func mp3Bitrate(h []byte) int {
+	version := h[1] >> 3 & 0x3
+	layer := h[1] >> 1 & 0x3
+	index := h[2] >> 4
+
+	var table int
+	switch {
+	case version == 0x3: // MPEG-1
+		table = int(3 - layer)
+	case layer == 0x3: // MPEG-2/2.5 layer I
+		table = 3
+	default:
+		table = 4
+	}
+	return mp3Bitrates[table][index]
+}
+
+// mp3SampleRates are the sample rates by version and sample rate index
+var mp3SampleRates = [4][3]int{
+	{11025, 12000, 8000},  // MPEG-2.5
+	{},                    // reserved
+	{22050, 24000, 16000}, // MPEG-2
+	{44100, 48000, 32000}, // MPEG-1
+}
+
+// mp3FrameSize returns the size in bytes of the MPEG audio frame starting
+// with header h, including the header. Returns zero if h is not valid.
+func mp3FrameSize(h []byte) int {
+	if !isMP3Header(h) {
+		return 0
+	}
+
+	version := h[1] >> 3 & 0x3
+	layer := h[1] >> 1 & 0x3
+	bitrate := mp3Bitrate(h) * 1000
+	rate := mp3SampleRates[version][h[2]>>2&0x3]
+	padding := int(h[2] >> 1 & 0x1)
+
+	switch {
+	case layer == 0x3: // layer I
+		return (12*bitrate/rate + padding) * 4
+	case layer == 0x1 && version != 0x3: // MPEG-2/2.5 layer III
+		return 72*bitrate/rate + padding
+	default:
+		return 144*bitrate/rate + padding
+	}
+}
+
+// framer finds frame boundaries in a stream of data
+type framer interface {
+	// Scan returns the index of the first frame boundary in p, given all
+	// data passed to Scan before, or -1 if there is none.
+	Scan(p []byte) int
+	// clone returns a framer continuing from the same state
+	clone() framer
+}
+
+// headerFramer is a framer for formats where a decoder needs the headers
+// of a stream before it can decode data from the middle of it.
+type headerFramer interface {
+	framer
+	// Headers returns the headers of the stream scanned so far
+	Headers() []byte
+	// StartHeaders returns the headers needed before the first boundary
+	// found by the last Scan, or nil if that boundary starts a stream.
+	StartHeaders() []byte
+}
+
+// metadataFramer is a framer for formats that carry metadata in-band
+type metadataFramer interface {
+	framer
+	// Metadata returns the metadata of the stream, ok is false if it
+	// didn't change since the last call.
+	Metadata() (meta string, ok bool)
+}
+
+// anyFramer is the framer used for formats we know nothing about, every
+// write is considered to start at a frame boundary.
+type anyFramer struct{}
+
+func (anyFramer) Scan(p []byte) int {
+	return 0
+}
+
+func (f anyFramer) clone() framer {
+	return f
+}
+
+// mp3Parser is a framer for MPEG audio, it follows the stream frame by
+// frame using the frame sizes found in the headers. Once it loses sync it
+// searches for the next valid header.
+type mp3Parser struct {
+	// synced indicates if we know where the next frame starts
+	synced bool
+	// skip is the amount of bytes left in the current frame
+	skip int
+	// header holds the start of a frame header split over two writes
+	header [4]byte
+	hlen   int
+}
+
+func (mp *mp3Parser) clone() framer {
+	c := *mp
+	return &c
+}
+
+func (mp *mp3Parser) Scan(p []byte) int {
+	first := -1
+	for i := 0; i < len(p); {
+		if mp.skip > 0 {
+			n := len(p) - i
+			if n > mp.skip {
+				n = mp.skip
+			}
+			mp.skip -= n
+			i += n
+			continue
+		}
+
+		if !mp.synced {
+			j := mp3FrameSync(p[i:])
+			if j < 0 {
+				return first
+			}
+			i += j
+			mp.synced = true
+		}
+
+		// a frame starts at i, or its header continues at i if the
+		// header was split over two writes.
+		start := i - mp.hlen
+		n := copy(mp.header[mp.hlen:], p[i:])
+		mp.hlen += n
+		if mp.hlen < len(mp.header) {
+			// we trust our position while in sync, so this is a
+			// boundary even if we can't check the header yet.
+			if first < 0 && start >= 0 {
+				first = start
+			}
+			return first
+		}
+		mp.hlen = 0
+
+		size := mp3FrameSize(mp.header[:])
+		if size == 0 {
+			// lost sync, search again from right after the bad header
+			mp.synced = false
+			if start >= 0 {
+				i = start + 1
+			}
+			continue
+		}
+
+		if first < 0 && start >= 0 {
+			first = start
+		}
+		mp.skip = size - len(mp.header)
+		i += n
+	}
+	return first
+}
@@ -0,0 +1,391 @@
+package icecast
+
+import (
+	"bytes"
+	"encoding/binary"
+	"mime"
+	"strings"
+)
+
+// Ogg page header layout, the header is followed by a segment table of
+// nsegs bytes holding the sizes of the segments in the page body.
+const (
+	oggHeaderSize = 27
+	oggMaxHeader  = oggHeaderSize + 255
+
+	oggFlagContinued = 0x01
+	oggFlagBOS       = 0x02
+	oggFlagEOS       = 0x04
+)
+
+var oggCapture = []byte("OggS")
+
+// isOgg returns true if the content-type given is one used for Ogg
+func isOgg(ct string) bool {
+	if t, _, err := mime.ParseMediaType(ct); err == nil {
+		ct = t
+	}
+
+	switch strings.ToLower(ct) {
+	case "audio/ogg", "application/ogg", "video/ogg", "audio/opus", "audio/vorbis":
+		return true
+	}
+	return false
+}
+
+// oggPage is the information we use from an Ogg page header
+type oggPage struct {
+	Flags   byte
+	Granule uint64
+	// Size is the size of the page including the header
+	Size int
+}
+
+// parseOggPage parses the page header at the start of h, it returns false
+// if h doesn't hold a complete and valid header.
+func parseOggPage(h []byte) (oggPage, bool) {
+	if len(h) < oggHeaderSize || !bytes.Equal(h[:4], oggCapture) || h[4] != 0 {
+		return oggPage{}, false
+	}
+
+	nsegs := int(h[26])
+	if len(h) < oggHeaderSize+nsegs {
+		return oggPage{}, false
+	}
+
+	size := oggHeaderSize + nsegs
+	for _, s := range h[oggHeaderSize : oggHeaderSize+nsegs] {
+		size += int(s)
+	}
+
+	return oggPage{
+		Flags:   h[5],
+		Granule: binary.LittleEndian.Uint64(h[6:14]),
+		Size:    size,
+	}, true
+}
+
+// isHeader returns true if the page can hold codec headers, these come
+// right after the BOS page and have no granule position.
+func (pg oggPage) isHeader() bool {
+	return pg.Flags&oggFlagBOS != 0 || pg.Granule == 0 || pg.Granule == ^uint64(0)
+}
+
+// isOggBOS returns true if p starts with a BOS page
+func isOggBOS(p []byte) bool {
+	pg, ok := parseOggPage(p)
+	return ok && pg.Flags&oggFlagBOS != 0
+}
+
+// oggSync returns the index of the first page that starts with a valid
+// header in p, or -1 if there is none.
+func oggSync(p []byte) int {
+	for i := 0; i+5 <= len(p); i++ {
+		j := bytes.Index(p[i:], oggCapture)
+		if j < 0 || i+j+5 > len(p) {
+			return -1
+		}
+
+		i += j
+		if p[i+4] == 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+// oggBurstStart returns where to start sending the Ogg data in b to a new
+// client. This is the last BOS page if b holds the start of a stream,
+// otherwise the first page that isn't a header page.
+func oggBurstStart(b []byte) int {
+	i := oggSync(b)
+	if i < 0 {
+		return -1
+	}
+
+	start, bos, prevBOS := -1, -1, false
+	for i < len(b) {
+		pg, ok := parseOggPage(b[i:])
+		if !ok {
+			break
+		}
+
+		// multiplexed streams start with a BOS page for each stream
+		isBOS := pg.Flags&oggFlagBOS != 0
+		if isBOS && !prevBOS {
+			bos = i
+		} else if start < 0 && !pg.isHeader() {
+			start = i
+		}
+		prevBOS = isBOS
+		i += pg.Size
+	}
+
+	if bos >= 0 {
+		return bos
+	}
+	return start
+}
+
+// oggCRCTable is the lookup table for the CRC used in Ogg pages
+var oggCRCTable = func() (t [256]uint32) {
+	for i := range t {
+		r := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if r&0x80000000 != 0 {
+				r = r<<1 ^ 0x04C11DB7
+			} else {
+				r <<= 1
+			}
+		}
+		t[i] = r
+	}
+	return t
+}()
+
+// setOggCRC calculates and sets the CRC of the page given
+func setOggCRC(page []byte) {
+	binary.LittleEndian.PutUint32(page[22:26], 0)
+
+	var crc uint32
+	for _, b := range page {
+		crc = crc<<8 ^ oggCRCTable[byte(crc>>24)^b]
+	}
+	binary.LittleEndian.PutUint32(page[22:26], crc)
+}
+
+// oggPackets returns the packets in the complete pages given, a packet
+// that isn't finished in the last page is left out.
+func oggPackets(b []byte) [][]byte {
+	var packets [][]byte
+	var cur []byte
+	for len(b) > 0 {
+		pg, ok := parseOggPage(b)
+		if !ok || pg.Size > len(b) {
+			break
+		}
+
+		nsegs := int(b[26])
+		body := b[oggHeaderSize+nsegs : pg.Size]
+		for _, l := range b[oggHeaderSize : oggHeaderSize+nsegs] {
+			cur = append(cur, body[:l]...)
+			body = body[l:]
+			if l < 255 {
+				packets = append(packets, cur)
+				cur = nil
+			}
+		}
+		b = b[pg.Size:]
+	}
+	return packets
+}
+
+// oggPacketPages returns the pages holding packet, the first page gets
+// the flags given. Pages are numbered starting at seq, which is advanced.
+func oggPacketPages(packet []byte, flags byte, serial uint32, seq *uint32) []byte {
+	var out []byte
+	for done := false; !done; flags = oggFlagContinued {
+		var lacing, body []byte
+		for len(lacing) < 255 && !done {
+			l := len(packet)
+			if l >= 255 {
+				l = 255
+			} else {
+				done = true
+			}
+			lacing = append(lacing, byte(l))
+			body = append(body, packet[:l]...)
+			packet = packet[l:]
+		}
+
+		// pages on which no packet ends have no granule position
+		granule := uint64(0)
+		if !done {
+			granule = ^uint64(0)
+		}
+
+		page := make([]byte, oggHeaderSize, oggHeaderSize+len(lacing)+len(body))
+		copy(page, oggCapture)
+		page[5] = flags
+		binary.LittleEndian.PutUint64(page[6:14], granule)
+		binary.LittleEndian.PutUint32(page[14:18], serial)
+		binary.LittleEndian.PutUint32(page[18:22], *seq)
+		page[26] = byte(len(lacing))
+		page = append(append(page, lacing...), body...)
+		setOggCRC(page)
+
+		out = append(out, page...)
+		*seq++
+	}
+	return out
+}
+
+// oggParser is a framer for Ogg, it follows the stream page by page and
+// keeps the header pages of the current stream. A BOS page after the
+// headers starts a new stream, as happens with chained streams.
+type oggParser struct {
+	// synced indicates if we know where the next page starts
+	synced bool
+	// skip is the amount of bytes left in the body of the current page
+	skip int
+	// header holds the page header being read
+	header [oggMaxHeader]byte
+	hlen   int
+
+	// headers are the header pages of the current stream, the first
+	// complete bytes of it are pages we read completely.
+	headers  []byte
+	complete int
+	// inHeaders indicates if we're still reading the header pages
+	inHeaders bool
+	// recording indicates if the current page is a header page
+	recording bool
+
+	// meta is the metadata in the comments of the current stream, and
+	// newMeta indicates if it changed since the last call to Metadata.
+	meta    string
+	newMeta bool
+
+	// startHeaders are the headers needed before the first boundary
+	// found by the last Scan, see StartHeaders.
+	startHeaders []byte
+	// first is the index of the first boundary found by the current
+	// Scan, or -1 if none was found yet.
+	first int
+}
+
+func (op *oggParser) Scan(p []byte) int {
+	first := -1
+	op.first = -1
+	for i := 0; i < len(p); {
+		if op.skip > 0 {
+			n := len(p) - i
+			if n > op.skip {
+				n = op.skip
+			}
+			if op.recording {
+				op.headers = append(op.headers, p[i:i+n]...)
+			}
+			op.skip -= n
+			i += n
+			if op.skip == 0 && op.recording {
+				op.complete = len(op.headers)
+			}
+			continue
+		}
+
+		if !op.synced {
+			j := oggSync(p[i:])
+			if j < 0 {
+				return first
+			}
+			i += j
+			op.synced = true
+		}
+
+		// a page starts at i, or its header continues at i if the
+		// header was split over two writes.
+		start := i - op.hlen
+		if first < 0 && start >= 0 {
+			first = start
+			op.first = start
+			op.startHeaders = op.Headers()
+		}
+
+		need := oggHeaderSize
+		if op.hlen >= oggHeaderSize {
+			need += int(op.header[26])
+		}
+
+		n := copy(op.header[op.hlen:need], p[i:])
+		op.hlen += n
+		i += n
+		if op.hlen < need {
+			continue
+		}
+
+		if need == oggHeaderSize {
+			// we still need the segment table
+			if op.header[26] > 0 {
+				continue
+			}
+		}
+
+		pg, ok := parseOggPage(op.header[:op.hlen])
+		header := op.header[:op.hlen]
+		op.hlen = 0
+		if !ok {
+			// lost sync, search again from right after the bad header
+			op.synced = false
+			if start >= 0 {
+				i = start + 1
+			}
+			if start >= 0 && start == op.first {
+				first, op.first = -1, -1
+			}
+			continue
+		}
+
+		op.page(pg, header, start >= 0 && start == op.first)
+		op.skip = pg.Size - len(header)
+		if op.skip == 0 && op.recording {
+			op.complete = len(op.headers)
+		}
+	}
+
+	op.first = -1
+	return first
+}
+
+// page handles a page header, first indicates if the page is at the
+// first boundary found by the current Scan.
+func (op *oggParser) page(pg oggPage, header []byte, first bool) {
+	if pg.Flags&oggFlagBOS != 0 && !op.inHeaders {
+		// a new stream, the page itself carries what a decoder needs
+		op.headers, op.complete, op.inHeaders = nil, 0, true
+		if first {
+			op.startHeaders = nil
+		}
+	}
+
+	op.recording = op.inHeaders && pg.isHeader()
+	if op.recording {
+		op.headers = append(op.headers, header...)
+	} else if op.inHeaders {
+		op.inHeaders = false
+		if vc, _, ok := oggHeaderComments(oggPackets(op.Headers())); ok {
+			op.meta, op.newMeta = vc.Meta(), true
+		}
+	}
+}
+
+// Metadata returns the metadata in the comments of the stream, ok is
+// false if it didn't change since the last call.
+func (op *oggParser) Metadata() (meta string, ok bool) {
+	ok, op.newMeta = op.newMeta, false
+	return op.meta, ok
+}
+
+func (op *oggParser) clone() framer {
+	c := *op
+	c.headers = c.headers[:len(c.headers):len(c.headers)]
+	return &c
+}
+
+// seed sets the header pages of the stream, for a stream we start
+// reading in the middle of.
+func (op *oggParser) seed(headers []byte) {
+	op.headers, op.complete, op.inHeaders = headers, len(headers), false
+}
+
+// Headers returns the complete header pages of the current stream
+func (op *oggParser) Headers() []byte {
+	return op.headers[:op.complete:op.complete]
+}
+
+// StartHeaders returns the header pages a decoder needs before the data
+// at the first boundary found by the last Scan. Returns nil if the data
+// at that boundary starts a new stream.
+func (op *oggParser) StartHeaders() []byte {
+	return op.startHeaders
+}
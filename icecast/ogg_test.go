@@ -0,0 +1,125 @@
+package icecast
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// oggPageBytes returns an Ogg page with a single segment holding body,
+// the CRC is left zero since we don't check it.
+func oggPageBytes(flags byte, granule uint64, body string) []byte {
+	p := make([]byte, oggHeaderSize+1, oggHeaderSize+1+len(body))
+	copy(p, oggCapture)
+	p[5] = flags
+	binary.LittleEndian.PutUint64(p[6:], granule)
+	p[26] = 1
+	p[27] = byte(len(body))
+	return append(p, body...)
+}
+
+// oggStream returns the header pages and audio pages of a stream
+func oggStream(name string) (headers []byte, audio [][]byte) {
+	headers = append(oggPageBytes(oggFlagBOS, 0, name+" ident"), oggPageBytes(0, 0, name+" comment")...)
+	for i := uint64(1); i <= 3; i++ {
+		audio = append(audio, oggPageBytes(0, i*1000, name+" audio data"))
+	}
+	return headers, audio
+}
+
+func TestOggParser(t *testing.T) {
+	headers, audio := oggStream("first")
+	stream := append(append([]byte{}, headers...), bytes.Join(audio, nil)...)
+
+	// scan in small pieces so headers get split
+	op := new(oggParser)
+	for i := 0; i < len(stream); i += 7 {
+		end := i + 7
+		if end > len(stream) {
+			end = len(stream)
+		}
+		op.Scan(stream[i:end])
+	}
+
+	if !bytes.Equal(op.Headers(), headers) {
+		t.Fatalf("unexpected headers: %q", op.Headers())
+	}
+
+	// starting in the middle of the stream needs the headers
+	next := oggPageBytes(0, 4000, "more audio")
+	if i := op.Scan(next); i != 0 {
+		t.Errorf("unexpected boundary: %d", i)
+	}
+
+	if !bytes.Equal(op.StartHeaders(), headers) {
+		t.Errorf("unexpected start headers: %q", op.StartHeaders())
+	}
+
+	// a chained stream replaces the headers
+	chained, _ := oggStream("second")
+	if i := op.Scan(append([]byte("junk"), chained...)); i != 4 {
+		t.Errorf("unexpected boundary in chained stream: %d", i)
+	}
+
+	if op.StartHeaders() != nil {
+		t.Errorf("start of a new stream needs no headers: %q", op.StartHeaders())
+	}
+
+	if !bytes.Equal(op.Headers(), chained) {
+		t.Errorf("unexpected headers after chaining: %q", op.Headers())
+	}
+}
+
+func TestOggBurstStart(t *testing.T) {
+	headers, audio := oggStream("test")
+
+	stream := append(append([]byte("junk"), headers...), audio[0]...)
+	if i := oggBurstStart(stream); i != 4 {
+		t.Errorf("burst should start at the BOS page, got: %d", i)
+	}
+
+	// a header page without its BOS page should be skipped
+	stream = append(append([]byte{}, headers[len(headers)/2:]...), bytes.Join(audio, nil)...)
+	if i := oggBurstStart(stream); i != len(stream)-3*len(audio[0]) {
+		t.Errorf("burst should start at the first audio page, got: %d", i)
+	}
+}
+
+func TestMountWriterOggHeaders(t *testing.T) {
+	headers, audio := oggStream("test")
+
+	w := newMountWriter(NewMultiWriter(), new(oggParser), oggBurstStart)
+	w.setBurst(len(audio[0])+10, 0)
+	w.Write(headers)
+	for _, p := range audio {
+		w.Write(p)
+	}
+
+	// a late joiner gets the headers and the last full page
+	var buf bytes.Buffer
+	w.join(&buf)
+	if want := append(append([]byte{}, headers...), audio[2]...); !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("unexpected data for late joiner: %q", buf.Bytes())
+	}
+}
+
+func TestFrameGateOggHeaders(t *testing.T) {
+	headers, audio := oggStream("test")
+	op := new(oggParser)
+
+	// the source was parked while sending its headers
+	park := newFrameGate(discardWriter, op, nil)
+	park.discard = true
+	park.finish()
+	park.Write(headers)
+	park.Write(audio[0][:10])
+
+	var buf bytes.Buffer
+	g := newFrameGate(&buf, op, nil)
+	g.Write(audio[0][10:])
+	g.Write(audio[1])
+
+	if want := append(append([]byte{}, headers...), audio[1]...); !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("unexpected output of gate: %q", buf.Bytes())
+	}
+}
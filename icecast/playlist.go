@@ -0,0 +1,279 @@
+package icecast
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultFileBitrate is the bitrate in kbit/s files are played at if
+// it is not configured and can't be found from the file itself.
+const DefaultFileBitrate = 128
+
+var ErrNoPlayableFiles = errors.New("icecast.playlist: no playable files")
+
+// fileContentTypes are the content-types of the file extensions we
+// know about, mime.TypeByExtension is used for others.
+var fileContentTypes = map[string]string{
+	".mp3":  "audio/mpeg",
+	".ogg":  "audio/ogg",
+	".oga":  "audio/ogg",
+	".opus": "audio/ogg",
+	".aac":  "audio/aac",
+	".flac": "audio/flac",
+}
+
+// fileContentType returns the content-type of the file given based on
+// its extension.
+func fileContentType(path string) string {
+	ext := strings.ToLower(filepath.Ext(path))
+	if ct, ok := fileContentTypes[ext]; ok {
+		return ct
+	}
+	return mime.TypeByExtension(ext)
+}
+
+// isPlaylist returns true if the path given is a M3U playlist
+func isPlaylist(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".m3u" || ext == ".m3u8"
+}
+
+// readPlaylist returns the files in the playlist given, a path that isn't
+// a playlist is returned as the only file. Relative paths in a playlist
+// are relative to the directory of the playlist.
+func readPlaylist(path string) ([]string, error) {
+	if !isPlaylist(path) {
+		return []string{path}, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var files []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if !filepath.IsAbs(line) {
+			line = filepath.Join(filepath.Dir(path), line)
+		}
+		files = append(files, line)
+	}
+
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(files) == 0 {
+		return nil, ErrNoPlayableFiles
+	}
+	return files, nil
+}
+
+// NewFileSource returns a source for the mount given that plays the file
+// or M3U playlist at path in a loop. The files are paced at bitrate kbit/s,
+// if bitrate is zero it is found from the MPEG audio frames in each file
+// or DefaultFileBitrate is used.
+func NewFileSource(mount, path string, bitrate int) (*Source, error) {
+	files, err := readPlaylist(path)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &http.Request{
+		Method:     "SOURCE",
+		URL:        &url.URL{Path: mount},
+		RequestURI: mount,
+		Proto:      "ICE/1.0",
+		Header:     http.Header{"Content-Type": {fileContentType(files[0])}},
+	}
+
+	p := &playlistReader{
+		files:   files,
+		bitrate: bitrate,
+		closed:  make(chan struct{}),
+	}
+
+	s := NewSource(p, r)
+	s.Name = path
+	return s, nil
+}
+
+// playlistReader reads the files of a playlist in a loop, reads are
+// paced such that the data is returned at the bitrate of the files.
+type playlistReader struct {
+	files []string
+	// next is the index of the next file to play
+	next int
+	// bitrate is the configured bitrate in kbit/s or zero
+	bitrate int
+
+	// mu protects cur
+	mu  sync.Mutex
+	cur *os.File
+
+	// rate is the bytes per second the current file is played at, or
+	// zero if we don't know yet.
+	rate int64
+	// start is the time we started playing the current file
+	start time.Time
+	// read is the amount of bytes read from the current file
+	read int64
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (p *playlistReader) Read(b []byte) (int, error) {
+	for failed := 0; ; {
+		select {
+		case <-p.closed:
+			return 0, io.EOF
+		default:
+		}
+
+		p.mu.Lock()
+		playing := p.cur != nil
+		p.mu.Unlock()
+
+		if !playing {
+			if failed == len(p.files) {
+				return 0, ErrNoPlayableFiles
+			}
+
+			if err := p.open(); err != nil {
+				log.Println("icecast.playlist: failed to open file:", err)
+				failed++
+				continue
+			}
+		}
+
+		if err := p.wait(); err != nil {
+			return 0, err
+		}
+
+		p.mu.Lock()
+		if p.cur == nil {
+			p.mu.Unlock()
+			return 0, io.EOF
+		}
+		n, err := p.cur.Read(b)
+		p.mu.Unlock()
+
+		if n > 0 {
+			if p.rate == 0 {
+				p.rate = int64(p.detectBitrate(b[:n])) * 1000 / 8
+			}
+			p.read += int64(n)
+			return n, nil
+		}
+
+		if err == io.EOF {
+			p.closeFile()
+			continue
+		} else if err != nil {
+			select {
+			case <-p.closed:
+				return 0, io.EOF
+			default:
+			}
+
+			log.Println("icecast.playlist: failed to read file:", err)
+			p.closeFile()
+			failed++
+		}
+	}
+}
+
+// open opens the next file in the playlist
+func (p *playlistReader) open() error {
+	path := p.files[p.next]
+	p.next = (p.next + 1) % len(p.files)
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	select {
+	case <-p.closed:
+		return f.Close()
+	default:
+	}
+	p.cur = f
+
+	p.start, p.read = time.Now(), 0
+	p.rate = int64(p.bitrate) * 1000 / 8
+	return nil
+}
+
+// wait waits until the data read so far from the current file should
+// have been played.
+func (p *playlistReader) wait() error {
+	if p.rate == 0 {
+		return nil
+	}
+
+	due := p.start.Add(time.Duration(p.read) * time.Second / time.Duration(p.rate))
+	d := due.Sub(time.Now())
+	if d <= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-p.closed:
+		return io.EOF
+	}
+}
+
+// detectBitrate returns the bitrate of the first MPEG audio frame in b,
+// or the default bitrate if there is none.
+func (p *playlistReader) detectBitrate(b []byte) int {
+	if i := mp3FrameSync(b); i >= 0 {
+		return mp3Bitrate(b[i:])
+	}
+	return DefaultFileBitrate
+}
+
+func (p *playlistReader) closeFile() {
+	p.mu.Lock()
+	if p.cur != nil {
+		p.cur.Close()
+		p.cur = nil
+	}
+	p.mu.Unlock()
+}
+
+func (p *playlistReader) Write(b []byte) (int, error) {
+	return 0, errors.New("icecast.playlist: can't write to a playlist")
+}
+
+// Close stops the reader, a blocked Read returns io.EOF
+func (p *playlistReader) Close() error {
+	p.closeOnce.Do(func() { close(p.closed) })
+	p.closeFile()
+	return nil
+}
@@ -0,0 +1,206 @@
+package icecast
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Wessie/sirencast/config"
+)
+
+// writeFiles writes the files given into a new temporary directory
+func writeFiles(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "sirencast")
+	if err != nil {
+		t.Fatal("failed to create directory:", err)
+	}
+
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal("failed to write file:", err)
+		}
+	}
+	return dir
+}
+
+func TestReadPlaylist(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"list.m3u": "#EXTM3U\n\na.mp3\n/abs/b.mp3\n",
+	})
+	defer os.RemoveAll(dir)
+
+	files, err := readPlaylist(filepath.Join(dir, "list.m3u"))
+	if err != nil {
+		t.Fatal("failed to read playlist:", err)
+	}
+
+	if len(files) != 2 || files[0] != filepath.Join(dir, "a.mp3") || files[1] != "/abs/b.mp3" {
+		t.Errorf("unexpected playlist files: %q", files)
+	}
+
+	files, err = readPlaylist("single.mp3")
+	if err != nil || len(files) != 1 || files[0] != "single.mp3" {
+		t.Errorf("unexpected result for single file: %q %v", files, err)
+	}
+}
+
+func TestPlaylistReader(t *testing.T) {
+	dir := writeFiles(t, map[string]string{"a.aac": "aaaa", "b.aac": "bb"})
+	defer os.RemoveAll(dir)
+
+	p := &playlistReader{
+		files:   []string{filepath.Join(dir, "a.aac"), filepath.Join(dir, "missing.aac"), filepath.Join(dir, "b.aac")},
+		bitrate: 8, // 1000 bytes per second
+		closed:  make(chan struct{}),
+	}
+
+	// the files should be played in a loop, skipping missing ones
+	b := make([]byte, 8)
+	var res string
+	for len(res) < 12 {
+		n, err := p.Read(b)
+		if err != nil {
+			t.Fatal("failed to read:", err)
+		}
+		res += string(b[:n])
+	}
+
+	if res != "aaaabbaaaabb" {
+		t.Errorf("unexpected data: %q", res)
+	}
+
+	// reads are paced, a blocked read should return once closed
+	p.read = 1000
+	done := make(chan error)
+	go func() {
+		_, err := p.Read(b)
+		done <- err
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("read was not paced")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	p.Close()
+	select {
+	case err := <-done:
+		if err != io.EOF {
+			t.Errorf("unexpected error after close: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("close did not interrupt read")
+	}
+}
+
+func TestMP3Bitrate(t *testing.T) {
+	if !isMP3Header(mp3Frame) {
+		t.Fatal("valid header not recognized")
+	}
+
+	if br := mp3Bitrate(mp3Frame); br != 128 {
+		t.Errorf("unexpected bitrate: %d", br)
+	}
+}
+
+func TestFileFallback(t *testing.T) {
+	dir := writeFiles(t, map[string]string{"fallback.aac": "fallback"})
+	defer os.RemoveAll(dir)
+
+	s := NewServer(&config.Config{
+		Mounts: []config.Mount{{
+			Name:            "/main",
+			FallbackFile:    filepath.Join(dir, "fallback.aac"),
+			FallbackBitrate: 8,
+		}},
+	})
+	defer s.Close()
+
+	s.StartFileFallbacks()
+	mount := s.Mount("/main")
+	if mount == nil {
+		t.Fatal("mount was not created for fallback file")
+	}
+
+	if mount.ContentType != "audio/aac" {
+		t.Errorf("unexpected mount content-type: %s", mount.ContentType)
+	}
+
+	fallback := mount.sources.Top()
+	if fallback == nil {
+		t.Fatal("fallback source was not added")
+	}
+
+	// a live source takes over, and gives back control once it leaves
+	conn, remote := net.Pipe()
+	r, _ := http.NewRequest("SOURCE", "/main", nil)
+	live := NewSource(conn, r)
+	mount.AddSource(live)
+
+	if top := mount.sources.Top(); top != live {
+		t.Error("live source did not take over from fallback file")
+	}
+
+	remote.Close()
+	<-live.done
+	if top := mount.sources.Top(); top != fallback {
+		t.Error("fallback file did not take over from live source")
+	}
+}
+
+func TestFileFallbackReload(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"first.aac":  "first",
+		"second.aac": "second",
+	})
+	defer os.RemoveAll(dir)
+
+	conf := config.Config{
+		Mounts: []config.Mount{{Name: "/main", FallbackFile: filepath.Join(dir, "first.aac")}},
+	}
+	s := NewServer(&conf)
+	defer s.Close()
+
+	s.StartFileFallbacks()
+	mount := s.Mount("/main")
+	if mount == nil {
+		t.Fatal("mount was not created for fallback file")
+	}
+	first := mount.sources.Top()
+
+	// an unchanged fallback keeps playing
+	s.SetConfig(&conf)
+	if top := mount.sources.Top(); top != first {
+		t.Fatal("unchanged fallback file was restarted")
+	}
+
+	// a changed fallback replaces the old one
+	s.SetConfig(&config.Config{
+		Mounts: []config.Mount{{Name: "/main", FallbackFile: filepath.Join(dir, "second.aac")}},
+	})
+
+	select {
+	case <-first.done:
+	case <-time.After(time.Second):
+		t.Fatal("old fallback file was not stopped")
+	}
+
+	second := mount.sources.Top()
+	if second == nil || second.Name != filepath.Join(dir, "second.aac") {
+		t.Fatalf("new fallback file was not started: %v", second)
+	}
+
+	// and a removed one is stopped
+	s.SetConfig(&config.Config{})
+	select {
+	case <-second.done:
+	case <-time.After(time.Second):
+		t.Fatal("removed fallback file was not stopped")
+	}
+}
@@ -2,31 +2,89 @@ package icecast
 
 import (
 	"bufio"
+	"errors"
 	"io"
 	"log"
 	"net/http"
-	"net/textproto"
+	"net/http/httputil"
 	"net/url"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/Wessie/sirencast"
+	"github.com/Wessie/sirencast/config"
 	"github.com/Wessie/sirencast/util/taxtic"
 )
 
-const metadataSuccess = `<?xml version="1.0"?>
-<iceresponse><message>Metadata update successful</message><return>1</return></iceresponse>
-`
-
-func NewServer() *Server {
-	return &Server{
+// NewServer returns a new icecast server using the configuration given.
+func NewServer(conf *config.Config) *Server {
+	s := &Server{
 		mu:     new(sync.RWMutex),
 		mounts: make(map[string]*Mount),
+		files:  make(map[string]fileFallback),
 	}
+	s.conf.Store(conf)
+	return s
 }
 
 type Server struct {
+	// conf holds the *config.Config in use, see Config
+	conf atomic.Value
+
 	mu     *sync.RWMutex
 	mounts map[string]*Mount
+	// closed indicates if Close has been called, no new
+	// mounts are created once this is set.
+	closed bool
+	// detectors are the detectors registered with RegisterDetectors
+	detectors *sirencast.Detectors
+
+	// filesMu protects files
+	filesMu sync.Mutex
+	// files are the running file fallbacks by mount name
+	files map[string]fileFallback
+}
+
+// fileFallback is a source playing the fallback file of a mount
+type fileFallback struct {
+	file    string
+	bitrate int
+	source  *Source
+}
+
+// Config returns the configuration in use, it is replaced as a whole
+// by SetConfig so the result should not be kept around.
+func (s *Server) Config() *config.Config {
+	return s.conf.Load().(*config.Config)
+}
+
+// SetConfig replaces the configuration of the server. Existing mounts pick
+// up their new settings right away, and file fallbacks are started or
+// stopped as needed. Connected sources and listeners are left alone, even
+// if the new configuration wouldn't allow them in.
+func (s *Server) SetConfig(conf *config.Config) {
+	s.conf.Store(conf)
+
+	s.mu.Lock()
+	mounts := make([]*Mount, 0, len(s.mounts))
+	for _, m := range s.mounts {
+		mounts = append(mounts, m)
+	}
+	s.mu.Unlock()
+
+	for _, m := range mounts {
+		mc := conf.Mount(m.Name)
+		if mc == nil {
+			mc = &config.Mount{Name: m.Name}
+		}
+		m.Configure(*mc)
+	}
+
+	s.updateFileFallbacks(conf)
+	s.checkFallbacks()
 }
 
 type ReadWriteCloser struct {
@@ -36,136 +94,274 @@ type ReadWriteCloser struct {
 }
 
 // SourceHandler parses an incoming request from an icecast
-// source client.
+// source client. Both the SOURCE method and the HTTP PUT method
+// used by icecast 2.4 and up are supported.
 func (s *Server) SourceHandler(conn *sirencast.Conn) {
-	// A request from an icecast source looks similar to plain HTTP.
-	//
-	// The initial line is of the form:
-	// 	SOURCE /mountpoint ICE/1.0
-	//
-	// The HTTP version part of this line (ICE/1.0) is the only thing
-	// holding us back from using the builtin net/http request parsers.
-	//
-	// Instead we parse the first line ourself, and construct a http.Request
-	// from this.
 	b := ReadWriteCloser{
 		Reader: bufio.NewReader(conn),
 		Writer: bufio.NewWriter(conn),
 		Closer: conn,
 	}
 
-	// FIXME: this will read something big if a \n is never found
-	line, err := b.ReadString('\n')
+	req, err := ReadSourceRequest(b.Reader)
 	if err != nil {
-		log.Println("icecast.source: invalid http request")
+		log.Println("icecast.source:", err)
 		return
 	}
-
-	method, uri, proto, ok := parseRequestLine(line)
-	if !ok {
-		log.Println("icecast.source: invalid http request line")
+	req.RemoteAddr = conn.RemoteAddr().String()
+	u := req.URL
+
+	if !s.authenticateSource(req, u.Path) {
+		log.Println("icecast.source: authentication failed for", u.Path, "from", req.RemoteAddr)
+		WriteUnauthorized(b)
+		b.Flush()
+		b.Close()
 		return
 	}
 
-	if method != "SOURCE" {
-		log.Println("icecast.source: received non-source method request.")
-		return
+	ct := req.Header.Get("content-type")
+	if ct == "" {
+		log.Println("icecast.source: no content-type given")
 	}
 
-	u, err := url.ParseRequestURI(uri)
+	mount, err := s.sourceMount(u.Path, ct)
 	if err != nil {
-		log.Println("icecast.source: invalid http request uri: ", err)
+		log.Println("icecast.source: refusing source for", u.Path+":", err)
+		WriteHeader(b, nil, sourceMountStatus(err))
+		b.Flush()
+		b.Close()
 		return
 	}
 
-	tp := textproto.NewReader(b.Reader)
-	mimeHeader, err := tp.ReadMIMEHeader()
-	if err != nil {
-		log.Println("icecast.source: invalid http headers: ", err)
+	// PUT sources can ask us to confirm the request before they
+	// start sending any data.
+	if strings.ToLower(req.Header.Get("Expect")) == "100-continue" {
+		if _, err := io.WriteString(b, "HTTP/1.1 100 Continue\r\n\r\n"); err != nil {
+			log.Println("icecast.source: failed to write continue header:", err)
+			return
+		}
+	}
+
+	if err := WriteHeader(b, nil, http.StatusOK); err != nil {
+		log.Println("icecast.source: failed to write OK header:", err)
 		return
 	}
 
-	req := &http.Request{
-		Body:       b,
-		Method:     method,
-		Proto:      proto,
-		ProtoMajor: 1,
-		ProtoMinor: 0,
-		Header:     http.Header(mimeHeader),
-		RequestURI: uri,
-		URL:        u,
-		Host:       u.Host,
-		RemoteAddr: conn.RemoteAddr().String(),
+	if err := b.Flush(); err != nil {
+		log.Println("icecast.source: failed to flush header:", err)
 	}
 
-	// Adjust the Host field if it wasn't included in the URI but we
-	// do have a Host header.
-	if req.Host == "" {
-		req.Host = req.Header.Get("Host")
+	chunked := isChunked(req)
+	if chunked {
+		b.Reader = bufio.NewReader(httputil.NewChunkedReader(b.Reader))
 	}
+	req.Body = b
 
-	ct := req.Header.Get("content-type")
-	if ct == "" {
-		log.Println("icecast.source: no content-type given")
+	source := NewSource(b, req)
+	if !chunked {
+		source.conn, source.buf = conn, b.Reader
+	}
+	mount.AddSource(source)
+	return
+}
+
+var (
+	// ErrUndeclaredMount is returned for sources connecting to a mount that
+	// isn't in the configuration while undeclared mounts are rejected.
+	ErrUndeclaredMount = errors.New("icecast: mount is not declared")
+	// ErrContentType is returned for sources sending a content-type other
+	// than that of the mount.
+	ErrContentType = errors.New("icecast: conflicting mount and source content-type")
+)
+
+// sourceMount returns the mount with the name given for a source sending
+// content-type ct, the mount is created if it doesn't exist yet. An error
+// is returned if the source isn't allowed on the mount or if the server
+// is closed.
+func (s *Server) sourceMount(name, ct string) (*Mount, error) {
+	conf := s.Config().Mount(name)
+	if conf == nil && s.Config().RejectUndeclaredMounts {
+		return nil, ErrUndeclaredMount
+	}
+	if conf != nil && conf.ContentType != "" && conf.ContentType != ct {
+		return nil, ErrContentType
 	}
 
 	s.mu.Lock()
-	mount := s.mounts[u.Path]
+	if s.closed {
+		s.mu.Unlock()
+		return nil, sirencast.ErrServerClosed
+	}
+
+	mount, created := s.mounts[name], false
 	if mount == nil {
-		mount = NewMount(u.Path, ct)
-		s.mounts[u.Path] = mount
+		mount, created = NewMount(name, ct), true
+		mount.fallback = func() *Mount { return s.fallbackMount(name) }
+		// the configuration is checked again with the lock held, such that
+		// a concurrent SetConfig either sees the mount or we see its config.
+		if conf := s.Config().Mount(name); conf != nil {
+			mount.Configure(*conf)
+		}
+		s.mounts[name] = mount
 	}
 	s.mu.Unlock()
 
-	if mount != nil && mount.ContentType != ct {
-		log.Println("icecast.source: conflicting mount and source content-type")
-		WriteHeader(b, nil, http.StatusBadRequest)
-		return
+	// a new mount can be the fallback of an existing one, or have a
+	// fallback itself.
+	if created {
+		s.checkFallbacks()
 	}
 
-	if err := WriteHeader(b, nil, http.StatusOK); err != nil {
-		log.Println("icecast.source: failed to write OK header:", err)
-		return
+	if mount.ContentType != ct {
+		return nil, ErrContentType
 	}
+	return mount, nil
+}
 
-	if err := b.Flush(); err != nil {
-		log.Println("icecast.source: failed to flush header:", err)
+// sourceMountStatus returns the status code send to a source that
+// was refused by sourceMount with err.
+func sourceMountStatus(err error) int {
+	switch err {
+	case ErrUndeclaredMount:
+		return http.StatusForbidden
+	case ErrContentType:
+		return http.StatusBadRequest
 	}
+	return http.StatusServiceUnavailable
+}
 
-	mount.AddSource(NewSource(b, req))
-	return
+// StartFileFallbacks creates the mounts that have a fallback file configured
+// and adds a source playing the file to each at the lowest priority, such
+// that any live source takes over from it.
+func (s *Server) StartFileFallbacks() {
+	s.updateFileFallbacks(s.Config())
 }
 
-func (s *Server) MetadataHandler(conn *sirencast.Conn) {
+// updateFileFallbacks starts the file fallbacks configured in conf that
+// aren't running yet, and stops those that were removed or changed.
+func (s *Server) updateFileFallbacks(conf *config.Config) {
+	s.filesMu.Lock()
+	defer s.filesMu.Unlock()
+
+	for name, fb := range s.files {
+		mc := conf.Mount(name)
+		if mc == nil || mc.FallbackFile != fb.file || mc.FallbackBitrate != fb.bitrate {
+			fb.source.Close()
+			delete(s.files, name)
+		}
+	}
+
+	for _, mc := range conf.Mounts {
+		if _, ok := s.files[mc.Name]; ok || mc.FallbackFile == "" {
+			continue
+		}
+
+		source, err := NewFileSource(mc.Name, mc.FallbackFile, mc.FallbackBitrate)
+		if err != nil {
+			log.Println("icecast.fallback: failed to load fallback file for", mc.Name+":", err)
+			continue
+		}
+
+		mount, err := s.sourceMount(mc.Name, source.req.Header.Get("Content-Type"))
+		if err != nil {
+			log.Println("icecast.fallback: unable to create mount", mc.Name+":", err)
+			continue
+		}
+		mount.AddSourcePriority(source, FallbackPriority)
+		s.files[mc.Name] = fileFallback{mc.FallbackFile, mc.FallbackBitrate, source}
+	}
+}
+
+// fallbackMount returns the fallback mount configured for the mount
+// given, or nil if it has none or it doesn't exist.
+func (s *Server) fallbackMount(name string) *Mount {
+	conf := s.Config().Mount(name)
+	if conf == nil || conf.Fallback == "" {
+		return nil
+	}
+	return s.Mount(conf.Fallback)
+}
+
+// checkFallbacks makes all mounts without a source check if their
+// fallback mount is available.
+func (s *Server) checkFallbacks() {
+	s.mu.Lock()
+	mounts := make([]*Mount, 0, len(s.mounts))
+	for _, m := range s.mounts {
+		mounts = append(mounts, m)
+	}
+	s.mu.Unlock()
+
+	for _, m := range mounts {
+		m.sendEvent(EventFallback)
+	}
+}
+
+// readAdminRequest reads a request for one of the admin functions from conn
+// and checks if it is allowed to administrate the mount given by the `mount`
+// query parameter, the source credentials of the mount are accepted if source
+// is true. An error response is written and a nil request returned if the
+// request is invalid or not authorized.
+func (s *Server) readAdminRequest(conn *sirencast.Conn, prefix string, source bool) (*http.Request, string) {
 	r, err := ReadRequest(conn)
 	if err != nil {
-		log.Println("icecast.metadata: failed to construct request:", err)
-		return
+		log.Println(prefix+": failed to construct request:", err)
+		return nil, ""
 	}
 
-	query := r.URL.Query()
-
-	name := query.Get("mount")
+	name := r.URL.Query().Get("mount")
 	if name == "" {
+		WriteIceResponse(conn, nil, http.StatusBadRequest, "Missing parameter")
+		return nil, ""
+	}
+
+	if !s.authenticateAdmin(r, name, source) {
+		log.Println(prefix+": authentication failed for", name, "from", r.RemoteAddr)
+		WriteIceResponse(conn, challengeHeader(), http.StatusUnauthorized, "Authentication Required")
+		return nil, ""
+	}
+
+	return r, name
+}
+
+func (s *Server) MetadataHandler(conn *sirencast.Conn) {
+	defer conn.Close()
+
+	// sources are allowed to update the metadata of their own mount
+	r, name := s.readAdminRequest(conn, "icecast.metadata", true)
+	if r == nil {
 		return
 	}
 
+	query := r.URL.Query()
+
 	metadata := query.Get("song")
 	if metadata == "" {
-		// TODO: Decide on ignoring empty values or updating to empty
+		WriteIceResponse(conn, nil, http.StatusBadRequest, "Missing parameter")
 		return
 	}
 
 	charset := query.Get("charset")
+	if mc := s.Config().Mount(name); charset == "" && mc != nil {
+		charset = mc.Charset
+	}
 	if charset == "" {
 		// TODO: Check what we want to do for encoding, defaulting to utf8 is
 		// pretty sane, but might not be the correct approach for icecast compatibility.
 		charset = "utf8"
 	}
 
-	metadata, err = taxtic.Convert(charset, metadata)
+	metadata, err := taxtic.Convert(charset, metadata)
 	if err != nil {
 		log.Println("icecast.metadata: failed to convert metadata to utf8:", err)
+		WriteIceResponse(conn, nil, http.StatusBadRequest, "Invalid metadata charset")
+		return
+	}
+
+	fields, err := metadataFields(query, charset)
+	if err != nil {
+		log.Println("icecast.metadata: failed to convert metadata to utf8:", err)
+		WriteIceResponse(conn, nil, http.StatusBadRequest, "Invalid metadata charset")
 		return
 	}
 
@@ -174,69 +370,232 @@ func (s *Server) MetadataHandler(conn *sirencast.Conn) {
 	// TODO: figure out what to do with metadata when no mount exists.
 	mount := s.Mount(name)
 	if mount != nil {
-		mount.SetMetadata(id, metadata)
+		mount.SetMetadataFields(id, metadata, fields)
 	}
 
-	h := http.Header{
-		"Content-Type":   {"text/xml"},
-		"Content-Length": {"113"},
+	// now send back a xml "success" response
+	if err := WriteIceResponse(conn, nil, http.StatusOK, "Metadata update successful"); err != nil {
+		log.Println("icecast.metadata: failed to write xml success response:", err)
 	}
+	return
+}
 
-	// now send back a xml "success" response
-	if err := WriteHeader(conn, h, http.StatusOK); err != nil {
-		log.Println("icecast.metadata: failed to write http header response:", err)
+// ReloadHandler reloads the configuration file, this requires the admin
+// credentials. The new configuration reaches us through config.OnReload.
+func (s *Server) ReloadHandler(conn *sirencast.Conn) {
+	defer conn.Close()
+
+	r, err := ReadRequest(conn)
+	if err != nil {
+		log.Println("icecast.reload: failed to construct request:", err)
+		return
 	}
 
-	if _, err := io.WriteString(conn, metadataSuccess); err != nil {
-		log.Println("icecast.metadata: failed to write xml success response:", err)
+	if !checkCredentials(r, s.Config().AdminCredentials()) {
+		log.Println("icecast.reload: authentication failed from", r.RemoteAddr)
+		WriteUnauthorized(conn)
+		return
+	}
+
+	if _, err := config.Reload(); err != nil {
+		log.Println("icecast.reload: failed to reload configuration:", err)
+		WriteIceResponse(conn, nil, http.StatusInternalServerError, "Reload failed: "+err.Error())
+		return
+	}
+
+	log.Println("icecast.reload: configuration reloaded")
+	if err := WriteIceResponse(conn, nil, http.StatusOK, "Configuration reloaded"); err != nil {
+		log.Println("icecast.reload: failed to write xml success response:", err)
 	}
-	return
 }
 
-func (s *Server) ClientHandler(conn *sirencast.Conn) {
+// DetectorsHandler writes the statistics of the detectors registered with
+// RegisterDetectors, this requires the admin credentials.
+func (s *Server) DetectorsHandler(conn *sirencast.Conn) {
+	defer conn.Close()
+
 	r, err := ReadRequest(conn)
 	if err != nil {
-		log.Println("icecast.client: failed to read http request:", err)
+		log.Println("icecast.detectors: failed to construct request:", err)
+		return
+	}
+
+	if !checkCredentials(r, s.Config().AdminCredentials()) {
+		log.Println("icecast.detectors: authentication failed from", r.RemoteAddr)
+		WriteUnauthorized(conn)
+		return
+	}
+
+	s.mu.RLock()
+	ds := s.detectors
+	s.mu.RUnlock()
+
+	if ds == nil {
+		WriteIceResponse(conn, nil, http.StatusNotFound, "No detectors registered")
 		return
 	}
 
-	var meta bool
-	if r.Header.Get("icy-metadata") == "1" {
-		meta = true
+	if err := WriteDetectorStats(conn, ds.Stats()); err != nil {
+		log.Println("icecast.detectors: failed to write detector statistics:", err)
+	}
+}
+
+// metaFieldPrefix is the prefix of metadata request parameters that are
+// passed on to listeners as extra ICY metadata fields.
+const metaFieldPrefix = "icy."
+
+// metadataFields returns the extra ICY metadata fields in a metadata
+// request. The url parameter becomes StreamUrl, and a parameter such as
+// icy.StreamAlbum becomes a StreamAlbum field. Keys can only hold letters
+// and digits, other parameters are ignored.
+func metadataFields(query url.Values, charset string) ([]MetaField, error) {
+	var fields []MetaField
+	add := func(key, value string) error {
+		value, err := taxtic.Convert(charset, value)
+		if err != nil {
+			return err
+		}
+		fields = append(fields, MetaField{Key: key, Value: value})
+		return nil
+	}
+
+	if v := query.Get("url"); v != "" {
+		if err := add("StreamUrl", v); err != nil {
+			return nil, err
+		}
 	}
 
-	c := Client{
-		conn:    conn,
-		bufconn: bufio.NewWriter(conn),
-		meta:    meta,
-		metaint: 16000,
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		if strings.HasPrefix(k, metaFieldPrefix) && isMetaKey(k[len(metaFieldPrefix):]) {
+			keys = append(keys, k)
+		}
 	}
+	sort.Strings(keys)
 
-	mount := s.Mount(r.URL.Path)
+	for _, k := range keys {
+		if err := add(k[len(metaFieldPrefix):], query.Get(k)); err != nil {
+			return nil, err
+		}
+	}
+	return fields, nil
+}
+
+// isMetaKey returns true if key can be used as an ICY metadata key
+func isMetaKey(key string) bool {
+	if key == "" || key == "StreamTitle" {
+		return false
+	}
+	for _, r := range key {
+		if !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Server) ClientHandler(conn *sirencast.Conn) {
+	r, err := ReadRequest(conn)
+	if err != nil {
+		log.Println("icecast.client: failed to read http request:", err)
+		conn.Close()
+		return
+	}
+
+	c := NewClient(conn, r)
+
+	mount := s.Mount(s.mountName(r.URL))
 	if mount == nil {
 		log.Println("icecast.client: requested non-existant mount")
 		WriteHeader(conn, nil, http.StatusNotFound)
+		conn.Close()
 		return
 	}
 
 	h := http.Header{
-		"Icy-Metaint":  {"16000"},
 		"Content-Type": {mount.ContentType},
 	}
 
+	// Ogg streams carry their metadata in-band, interleaving ICY
+	// metadata would corrupt them.
+	if isOgg(mount.ContentType) {
+		c.meta = false
+	} else {
+		c.metaint = mount.Metaint()
+		h.Set("Icy-Metaint", strconv.Itoa(c.metaint))
+	}
+	mount.StreamInfo().WriteHeaders(h)
+
+	// SHOUTcast v2 listeners can ask for the stream in Ultravox messages
+	// instead, the metadata is then send in messages of its own.
+	if typ := ultravoxDataType(mount.ContentType); typ != 0 && isUltravoxRequest(r) {
+		c.meta, c.ultravox = false, typ
+		sid, _ := streamID(r.URL)
+		h = ultravoxHeader(mount, sid, typ)
+	}
+
+	// the header is buffered until the client starts, it is never send
+	// if the mount doesn't take the client.
 	if err := WriteHeader(c.bufconn, h, http.StatusOK); err != nil {
 		log.Println("icecast.client: failed to write OK header:", err)
+		conn.Close()
 		return
 	}
 
-	mount.AddClient(&c)
+	if err := mount.AddClient(c); err != nil {
+		log.Println("icecast.client: refusing client on", mount.Name+":", err)
+		WriteHeader(conn, nil, http.StatusServiceUnavailable)
+		conn.Close()
+	}
 	return
 }
 
 func (s *Server) ListClientHandler(conn *sirencast.Conn) {
+	defer conn.Close()
+
+	r, name := s.readAdminRequest(conn, "icecast.listclients", false)
+	if r == nil {
+		return
+	}
+
+	mount := s.Mount(name)
+	if mount == nil {
+		WriteIceResponse(conn, nil, http.StatusBadRequest, "Source does not exist")
+		return
+	}
+
+	if err := WriteListClients(conn, name, mount.Clients()); err != nil {
+		log.Println("icecast.listclients: failed to write client list:", err)
+	}
 	return
 }
 
+// mountName returns the name of the mount requested by a listener, this
+// is the path of the URL given unless it is of the SHOUTcast v2 form
+// /stream/<sid>/ and the stream ID is mapped to a mount.
+func (s *Server) mountName(u *url.URL) string {
+	sid, ok := streamID(u)
+	if !ok || s.MountExists(u.Path) {
+		return u.Path
+	}
+
+	if name := s.Config().Shoutcast.StreamMount(sid); name != "" {
+		return name
+	}
+	return u.Path
+}
+
+// streamID returns the stream ID of a SHOUTcast v2 URL of the form
+// /stream/<sid>/, ok is false for other URLs.
+func streamID(u *url.URL) (sid int, ok bool) {
+	if !strings.HasPrefix(u.Path, "/stream/") {
+		return 0, false
+	}
+
+	sid, err := strconv.Atoi(strings.Trim(u.Path[len("/stream/"):], "/"))
+	return sid, err == nil
+}
+
 func (s *Server) MountExists(name string) bool {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -269,3 +628,23 @@ func (s *Server) RemoveMount(name string) {
 	m.Close()
 	return
 }
+
+// Close closes all mounts and waits for them to disconnect their sources
+// and clients. No new mounts can be created after Close is called.
+func (s *Server) Close() {
+	s.mu.Lock()
+	s.closed = true
+	mounts := s.mounts
+	s.mounts = make(map[string]*Mount)
+	s.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, m := range mounts {
+		wg.Add(1)
+		go func(m *Mount) {
+			defer wg.Done()
+			m.Close()
+		}(m)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,105 @@
+package icecast
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Wessie/sirencast"
+	"github.com/Wessie/sirencast/config"
+)
+
+// serveTest serves s with a sirencast server listening on a unix socket,
+// the returned dial function connects to it. stop shuts the server down.
+func serveTest(t *testing.T, s *Server) (dial func() net.Conn, stop func()) {
+	dir, err := ioutil.TempDir("", "sirencast-icecast")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := filepath.Join(dir, "sock")
+
+	server, err := sirencast.SetupServer(&config.Config{
+		Listeners: []config.Listener{{Network: "unix", Addr: addr}},
+	})
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	server.Detectors = sirencast.NewDetectors()
+	s.RegisterDetectors(server.Detectors)
+
+	served := make(chan error, 1)
+	go func() { served <- server.Serve() }()
+
+	dial = func() net.Conn {
+		var conn net.Conn
+		for i := 0; i < 100; i++ {
+			if conn, err = net.Dial("unix", addr); err == nil {
+				conn.SetDeadline(time.Now().Add(5 * time.Second))
+				return conn
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatal("failed to connect to server:", err)
+		return nil
+	}
+
+	stop = func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			t.Error("shutdown returned error:", err)
+		}
+		<-served
+		os.RemoveAll(dir)
+	}
+	return dial, stop
+}
+
+func TestClientHandlerMountFull(t *testing.T) {
+	s := NewServer(&config.Config{
+		Mounts: []config.Mount{{Name: "/main", MaxListeners: 1}},
+	})
+	defer s.Close()
+
+	dial, stop := serveTest(t, s)
+	defer stop()
+
+	m, err := s.sourceMount("/main", "audio/mpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, remote := net.Pipe()
+	defer conn.Close()
+	go ioutil.ReadAll(remote)
+	r, _ := http.NewRequest("GET", m.Name, nil)
+	if err := m.AddClient(NewClient(conn, r)); err != nil {
+		t.Fatal("failed to add first client:", err)
+	}
+
+	c := dial()
+	defer c.Close()
+	io.WriteString(c, "GET /main HTTP/1.0\r\n\r\n")
+
+	b := bufio.NewReader(c)
+	line, err := b.ReadString('\n')
+	if err != nil {
+		t.Fatal("failed to read status line:", err)
+	}
+	if !strings.Contains(line, " 503 ") {
+		t.Errorf("unexpected status line: %q", line)
+	}
+
+	// the refused listener is disconnected after the response
+	if _, err := ioutil.ReadAll(b); err != nil {
+		t.Error("connection was not closed after the response:", err)
+	}
+}
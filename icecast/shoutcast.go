@@ -0,0 +1,391 @@
+package icecast
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"log"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/Wessie/sirencast"
+)
+
+// maxPasswordLine is the maximum length of the password line
+// send by a SHOUTcast v1 source.
+const maxPasswordLine = 256
+
+// DetectShoutcast detects a SHOUTcast v1 source. These sources start
+// by sending a bare password line and wait for us to respond before
+// sending anything else.
+func (s *Server) DetectShoutcast(r io.Reader) sirencast.ConnHandler {
+	if s.Config().Shoutcast.Mount == "" {
+		return nil
+	}
+
+	b := bufio.NewReaderSize(r, maxPasswordLine)
+	line, err := b.ReadSlice('\n')
+	if err != nil {
+		return nil
+	}
+
+	if !isPasswordLine(string(line)) {
+		return nil
+	}
+
+	return s.ShoutcastHandler
+}
+
+// isPasswordLine returns true if the line given looks like a SHOUTcast v1
+// password line and not like the request line of a HTTP based protocol.
+func isPasswordLine(line string) bool {
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return false
+	}
+
+	_, _, proto, ok := parseRequestLine(line)
+	if ok && (strings.HasPrefix(proto, "HTTP/") || strings.HasPrefix(proto, "ICE/")) {
+		return false
+	}
+
+	return true
+}
+
+// ShoutcastHandler handles a SHOUTcast v1 source, the source is attached
+// to the mount configured in `config.Shoutcast.Mount`.
+func (s *Server) ShoutcastHandler(conn *sirencast.Conn) {
+	// The protocol is of the form:
+	//	-> password\r\n
+	//	<- OK2\r\nicy-caps:11\r\n\r\n
+	//	-> icy-* headers followed by an empty line
+	//	-> stream data
+	b := ReadWriteCloser{
+		Reader: bufio.NewReaderSize(conn, maxPasswordLine),
+		Writer: bufio.NewWriter(conn),
+		Closer: conn,
+	}
+
+	line, err := b.ReadSlice('\n')
+	if err != nil {
+		log.Println("icecast.shoutcast: failed to read password:", err)
+		b.Close()
+		return
+	}
+	passwd := strings.TrimRight(string(line), "\r\n")
+
+	name := s.Config().Shoutcast.Mount
+	creds := s.Config().SourceCredentials(name)
+	if !creds.Verify(creds.Username(), passwd) {
+		log.Println("icecast.shoutcast: authentication failed for", name, "from", conn.RemoteAddr())
+		io.WriteString(b, "invalid password\r\n")
+		b.Flush()
+		b.Close()
+		return
+	}
+
+	io.WriteString(b, "OK2\r\nicy-caps:11\r\n\r\n")
+	if err := b.Flush(); err != nil {
+		log.Println("icecast.shoutcast: failed to write OK response:", err)
+		b.Close()
+		return
+	}
+
+	mimeHeader, err := textproto.NewReader(b.Reader).ReadMIMEHeader()
+	if err != nil {
+		log.Println("icecast.shoutcast: invalid icy headers:", err)
+		b.Close()
+		return
+	}
+
+	req := &http.Request{
+		Method:     "SOURCE",
+		Proto:      "ICY",
+		ProtoMajor: 1,
+		ProtoMinor: 0,
+		Header:     http.Header(mimeHeader),
+		RequestURI: name,
+		URL:        &url.URL{Path: name},
+		RemoteAddr: conn.RemoteAddr().String(),
+		Body:       b,
+	}
+
+	// SHOUTcast v1 sources predate sending a content-type, those that
+	// don't are sending mp3.
+	ct := req.Header.Get("content-type")
+	if ct == "" {
+		ct = "audio/mpeg"
+	}
+
+	mount, err := s.sourceMount(name, ct)
+	if err != nil {
+		log.Println("icecast.shoutcast: refusing source for", name+":", err)
+		b.Close()
+		return
+	}
+
+	source := NewSource(b, req)
+	source.conn, source.buf = conn, b.Reader
+	mount.AddSource(source)
+	return
+}
+
+// DetectShoutcastV2 detects a SHOUTcast v2 source by the first ultravox
+// message it sends, which is either a cipher key request or the
+// authentication message.
+func (s *Server) DetectShoutcastV2(r io.Reader) sirencast.ConnHandler {
+	if len(s.Config().Shoutcast.Streams) == 0 {
+		return nil
+	}
+
+	// We check the first byte before waiting for the rest of the header, other
+	// protocols can send less than a full header before waiting on us.
+	header := make([]byte, 4)
+	n, err := r.Read(header)
+	if n == 0 || header[0] != uvSync {
+		return nil
+	}
+
+	if _, err = io.ReadFull(r, header[n:]); err != nil || header[1] != 0 {
+		return nil
+	}
+
+	switch binary.BigEndian.Uint16(header[2:4]) {
+	case uvCipherKey, uvAuthenticate:
+		return s.ShoutcastV2Handler
+	}
+	return nil
+}
+
+// ShoutcastV2Handler handles a SHOUTcast v2 source, the source is attached
+// to the mount its stream ID is mapped to in `config.Shoutcast.Streams`.
+// SHOUTcast v2 listeners are handled by ClientHandler, see ultravoxHeader.
+func (s *Server) ShoutcastV2Handler(conn *sirencast.Conn) {
+	s.handleUltravox(conn, conn.RemoteAddr().String())
+}
+
+func (s *Server) handleUltravox(conn io.ReadWriteCloser, remote string) {
+	b := ReadWriteCloser{
+		Reader: bufio.NewReader(conn),
+		Writer: bufio.NewWriter(conn),
+		Closer: conn,
+	}
+
+	var (
+		buf    = make([]byte, uvMaxPayloadSize+1)
+		header = http.Header{}
+		name   string
+		ct     string
+	)
+
+	reply := func(typ uint16, payload string) error {
+		if err := writeUltravox(b, typ, payload); err != nil {
+			return err
+		}
+		return b.Flush()
+	}
+
+	// The source negotiates the stream parameters before it starts sending
+	// data, each message is replied to with either an ACK or NAK message of
+	// the same type. The source enters data transfer mode after standby.
+	for standby := false; !standby; {
+		msg, err := readUltravox(b.Reader, buf)
+		if err != nil {
+			log.Println("icecast.shoutcast2: failed to read message:", err)
+			b.Close()
+			return
+		}
+		payload := string(msg.Payload)
+
+		if name == "" && msg.Type != uvCipherKey && msg.Type != uvAuthenticate {
+			reply(msg.Type, "NAK:Not authenticated")
+			b.Close()
+			return
+		}
+
+		switch msg.Type {
+		case uvCipherKey:
+			err = reply(msg.Type, "ACK:"+s.Config().Shoutcast.Key())
+		case uvAuthenticate:
+			if name = s.authenticateUltravox(payload); name == "" {
+				log.Println("icecast.shoutcast2: authentication failed from", remote)
+				reply(msg.Type, "NAK:2.1:Deny")
+				b.Close()
+				return
+			}
+			err = reply(msg.Type, "ACK:2.1:Allow")
+		case uvMimeType:
+			ct = payload
+			err = reply(msg.Type, "ACK")
+		case uvSetup:
+			// payload is of the form "avgbitrate:maxbitrate" in bits
+			pair := strings.SplitN(payload, ":", 2)
+			if br, err := strconv.Atoi(pair[0]); err == nil {
+				header.Set("Ice-Bitrate", strconv.Itoa(br/1000))
+			}
+			err = reply(msg.Type, "ACK")
+		case uvNegotiateBuffer:
+			// payload is of the form "desired:minimum" in kilobytes
+			pair := strings.SplitN(payload, ":", 2)
+			err = reply(msg.Type, "ACK:"+pair[0])
+		case uvNegotiatePayload:
+			// payload is of the form "desired:minimum" in bytes
+			pair := strings.SplitN(payload, ":", 2)
+			size, _ := strconv.Atoi(pair[0])
+			if size <= 0 || size > uvMaxPayloadSize {
+				size = uvMaxPayloadSize
+			}
+			err = reply(msg.Type, "ACK:"+strconv.Itoa(size))
+		case uvStreamName:
+			header.Set("Ice-Name", payload)
+			err = reply(msg.Type, "ACK")
+		case uvStreamGenre:
+			header.Set("Ice-Genre", payload)
+			err = reply(msg.Type, "ACK")
+		case uvStreamURL:
+			header.Set("Ice-Url", payload)
+			err = reply(msg.Type, "ACK")
+		case uvStreamPublic:
+			header.Set("Ice-Public", payload)
+			err = reply(msg.Type, "ACK")
+		case uvStandby:
+			standby = true
+			err = reply(msg.Type, "ACK:Data transfer mode")
+		case uvTerminate:
+			b.Close()
+			return
+		default:
+			err = reply(msg.Type, "ACK")
+		}
+
+		if err != nil {
+			log.Println("icecast.shoutcast2: failed to write reply:", err)
+			b.Close()
+			return
+		}
+	}
+
+	// SHOUTcast v2 sources aren't required to send a content-type,
+	// those that don't are sending mp3.
+	if ct == "" {
+		ct = "audio/mpeg"
+	}
+
+	mount, err := s.sourceMount(name, ct)
+	if err != nil {
+		log.Println("icecast.shoutcast2: refusing source for", name+":", err)
+		b.Close()
+		return
+	}
+
+	uv := newUltravoxReader(b.Reader)
+	rwc := ReadWriteCloser{
+		Reader: bufio.NewReader(uv),
+		Writer: b.Writer,
+		Closer: b.Closer,
+	}
+
+	req := &http.Request{
+		Method:     "SOURCE",
+		Proto:      "ULTRAVOX/2.1",
+		ProtoMajor: 2,
+		ProtoMinor: 1,
+		Header:     header,
+		RequestURI: name,
+		URL:        &url.URL{Path: name},
+		RemoteAddr: remote,
+		Body:       rwc,
+	}
+
+	source := NewSource(rwc, req)
+	uv.OnMetadata = func(meta string) {
+		mount.SetMetadata(source.ID(), meta)
+	}
+
+	mount.AddSource(source)
+	return
+}
+
+// authenticateUltravox checks the payload of an ultravox authentication
+// message and returns the mount the source is allowed to stream to, an
+// empty string is returned if authentication failed.
+func (s *Server) authenticateUltravox(payload string) string {
+	// payload is of the form "2.1:sid:uid:password" with the
+	// uid and password encrypted with the cipher key.
+	parts := strings.SplitN(payload, ":", 4)
+	if len(parts) != 4 || parts[0] != "2.1" {
+		return ""
+	}
+
+	sid := 1
+	if parts[1] != "" {
+		var err error
+		if sid, err = strconv.Atoi(parts[1]); err != nil {
+			return ""
+		}
+	}
+
+	name := s.Config().Shoutcast.StreamMount(sid)
+	if name == "" {
+		return ""
+	}
+
+	key := xteaKey(s.Config().Shoutcast.Key())
+	user, err := xteaDecipher(parts[2], key)
+	if err != nil {
+		return ""
+	}
+
+	passwd, err := xteaDecipher(parts[3], key)
+	if err != nil {
+		return ""
+	}
+
+	creds := s.Config().SourceCredentials(name)
+	if user == "" {
+		user = creds.Username()
+	}
+
+	if !creds.Verify(user, passwd) {
+		return ""
+	}
+	return name
+}
+
+// isUltravoxRequest returns true if a listener asked for the stream to be
+// send in Ultravox messages, as SHOUTcast v2 listeners do.
+func isUltravoxRequest(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Ultravox-Transport-Type"), "TCP")
+}
+
+// ultravoxHeader returns the response header for a SHOUTcast v2 listener of
+// the mount given, the data is send in Ultravox messages of type typ.
+func ultravoxHeader(mount *Mount, sid int, typ uint16) http.Header {
+	if sid == 0 {
+		sid = 1
+	}
+
+	h := http.Header{
+		"Content-Type":        {"misc/ultravox"},
+		"Ultravox-Sid":        {strconv.Itoa(sid)},
+		"Ultravox-Max-Msg":    {strconv.Itoa(uvMaxPayloadSize)},
+		"Ultravox-Class-Type": {strconv.FormatUint(uint64(typ), 16)},
+	}
+
+	info := mount.StreamInfo()
+	set := func(name, value string) {
+		if value != "" {
+			h.Set(name, value)
+		}
+	}
+	set("Ultravox-Title", info.Name)
+	set("Ultravox-Genre", info.Genre)
+	set("Ultravox-Url", info.URL)
+	if kbps := info.Kbps(); kbps > 0 {
+		h.Set("Ultravox-Bitrate", strconv.Itoa(kbps*1000))
+	}
+	return h
+}
@@ -0,0 +1,49 @@
+package icecast
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Wessie/sirencast/config"
+)
+
+func TestIsPasswordLine(t *testing.T) {
+	tests := []struct {
+		line string
+		ok   bool
+	}{
+		{"hackme\r\n", true},
+		{"hackme\n", true},
+		{"pass with spaces\r\n", true},
+		{"\r\n", false},
+		{"GET /main HTTP/1.1\r\n", false},
+		{"SOURCE /main ICE/1.0\r\n", false},
+		{"PUT /main HTTP/1.0\r\n", false},
+	}
+
+	for _, h := range tests {
+		if ok := isPasswordLine(h.line); ok != h.ok {
+			t.Errorf("unexpected result for %q: %v != %v", h.line, ok, h.ok)
+		}
+	}
+}
+
+func TestDetectShoutcast(t *testing.T) {
+	s := NewServer(&config.Config{})
+	if s.DetectShoutcast(strings.NewReader("hackme\r\n")) != nil {
+		t.Error("detected shoutcast source without a configured mount")
+	}
+
+	s.Config().Shoutcast.Mount = "/sc"
+	if s.DetectShoutcast(strings.NewReader("hackme\r\n")) == nil {
+		t.Error("did not detect shoutcast source")
+	}
+
+	if s.DetectShoutcast(strings.NewReader("GET /sc HTTP/1.1\r\n\r\n")) != nil {
+		t.Error("detected HTTP request as shoutcast source")
+	}
+
+	if s.DetectShoutcast(strings.NewReader("no line ending")) != nil {
+		t.Error("detected incomplete line as shoutcast source")
+	}
+}
@@ -1,11 +1,15 @@
 package icecast
 
 import (
+	"bufio"
 	"io"
 	"log"
 	"net"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 )
 
 type nullWriter struct{}
@@ -42,7 +46,9 @@ func NewSource(rwc io.ReadWriteCloser, r *http.Request) *Source {
 	s := &Source{
 		ReadWriteCloser: rwc,
 		req:             r,
+		info:            ParseStreamInfo(r.Header),
 		out:             discardWriter,
+		done:            make(chan struct{}),
 	}
 
 	return s
@@ -51,10 +57,29 @@ func NewSource(rwc io.ReadWriteCloser, r *http.Request) *Source {
 // Source is an icecast source client, a source sends audio data and
 // metadata of this audio to be send to listening clients.
 type Source struct {
+	// detached is set to 1 if the source is being handed off, this is
+	// accessed atomically.
+	detached int32
+
 	// source input/output
 	io.ReadWriteCloser
 	// source request
 	req *http.Request
+	// info is the stream information send by the source
+	info StreamInfo
+
+	// conn and buf are set if the source reads its data from buf without
+	// any further decoding, these sources can be handed off on upgrade.
+	conn net.Conn
+	buf  *bufio.Reader
+	// done is closed once the source stopped and was removed from its mount
+	done chan struct{}
+
+	// frames follows the frames in the data of the source, it is set
+	// when the source is added to a mount.
+	frames framer
+	// onMetadata is called with metadata found in the data of the source
+	onMetadata func(meta string)
 
 	// protects 'out' below
 	mu sync.Mutex
@@ -70,12 +95,17 @@ func (s *Source) ID() SourceID {
 	return NewSourceID(s.req)
 }
 
+// Info returns the stream information the source send along with its request
+func (s *Source) Info() StreamInfo {
+	return s.info
+}
+
 func (s *Source) readLoop() {
 	b := make([]byte, ReadBufferSize)
 	for {
 		n, err := s.Read(b)
 		if err != nil {
-			if err == io.EOF {
+			if err == io.EOF || atomic.LoadInt32(&s.detached) == 1 {
 				return
 			}
 
@@ -91,12 +121,117 @@ func (s *Source) readLoop() {
 			return
 		}
 
+		if mf, ok := s.frames.(metadataFramer); ok && s.onMetadata != nil {
+			if meta, ok := mf.Metadata(); ok {
+				s.onMetadata(meta)
+			}
+		}
 	}
 }
 
+// pending returns the data that was read from the source connection
+// but not yet handled by the source.
+func (s *Source) pending() []byte {
+	if s.buf == nil {
+		return nil
+	}
+
+	b, _ := s.buf.Peek(s.buf.Buffered())
+	return b
+}
+
 // SwapOutput swaps the source output with the new writer passed in.
 func (s *Source) SwapOutput(n io.Writer) {
 	s.mu.Lock()
 	s.out = n
 	s.mu.Unlock()
 }
+
+// StreamInfo is the information about a stream as send by a source
+// in its ice-* headers.
+type StreamInfo struct {
+	Name        string
+	Description string
+	Genre       string
+	URL         string
+	Public      bool
+	Bitrate     string
+	AudioInfo   string
+}
+
+// ParseStreamInfo parses the ice-* headers in `h` into a StreamInfo. The
+// icy-* variants used by shoutcast sources are used if no ice-* header
+// is available.
+func ParseStreamInfo(h http.Header) StreamInfo {
+	get := func(name string) string {
+		if v := h.Get("Ice-" + name); v != "" {
+			return v
+		}
+		return h.Get("Icy-" + name)
+	}
+
+	bitrate := get("Bitrate")
+	if bitrate == "" {
+		bitrate = h.Get("Icy-Br")
+	}
+
+	public := get("Public")
+	if public == "" {
+		public = h.Get("Icy-Pub")
+	}
+
+	return StreamInfo{
+		Name:        get("Name"),
+		Description: get("Description"),
+		Genre:       get("Genre"),
+		URL:         get("Url"),
+		Public:      public == "1" || strings.ToLower(public) == "true",
+		Bitrate:     bitrate,
+		AudioInfo:   get("Audio-Info"),
+	}
+}
+
+// WriteHeaders adds the icy-* headers send to listeners for
+// the stream information to `h`, empty fields are omitted.
+func (si StreamInfo) WriteHeaders(h http.Header) {
+	set := func(name, value string) {
+		if value != "" {
+			h.Set(name, value)
+		}
+	}
+
+	set("Icy-Name", si.Name)
+	set("Icy-Description", si.Description)
+	set("Icy-Genre", si.Genre)
+	set("Icy-Url", si.URL)
+	set("Icy-Br", si.Bitrate)
+	set("Ice-Audio-Info", si.AudioInfo)
+	if si.Public {
+		h.Set("Icy-Pub", "1")
+	} else {
+		h.Set("Icy-Pub", "0")
+	}
+}
+
+// Kbps returns the bitrate of the stream in kbit/s, this is taken from the
+// bitrate header or the ice-bitrate key in the audio info. Returns zero
+// if the bitrate is unknown.
+func (si StreamInfo) Kbps() int {
+	bitrate := si.Bitrate
+	if bitrate == "" {
+		for _, kv := range strings.Split(si.AudioInfo, ";") {
+			if strings.HasPrefix(kv, "ice-bitrate=") || strings.HasPrefix(kv, "bitrate=") {
+				bitrate = kv[strings.Index(kv, "=")+1:]
+			}
+		}
+	}
+
+	// some sources send a list of bitrates, we use the first
+	end := 0
+	for end < len(bitrate) && bitrate[end] >= '0' && bitrate[end] <= '9' {
+		end++
+	}
+
+	kbps, _ := strconv.Atoi(bitrate[:end])
+	return kbps
+}
@@ -0,0 +1,112 @@
+package icecast
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Wessie/sirencast/config"
+)
+
+func TestParseStreamInfo(t *testing.T) {
+	h := http.Header{
+		"Ice-Name":    {"sirencast radio"},
+		"Ice-Genre":   {"various"},
+		"Ice-Public":  {"1"},
+		"Icy-Url":     {"http://example.com"},
+		"Ice-Bitrate": {"128"},
+	}
+
+	info := ParseStreamInfo(h)
+	expected := StreamInfo{
+		Name:    "sirencast radio",
+		Genre:   "various",
+		URL:     "http://example.com",
+		Public:  true,
+		Bitrate: "128",
+	}
+
+	if info != expected {
+		t.Errorf("unexpected stream info: %+v != %+v", info, expected)
+	}
+
+	out := http.Header{}
+	info.WriteHeaders(out)
+	if out.Get("Icy-Name") != info.Name || out.Get("Icy-Pub") != "1" || out.Get("Icy-Br") != "128" {
+		t.Errorf("unexpected listener headers: %v", out)
+	}
+}
+
+func TestSourceHandlerPutChunked(t *testing.T) {
+	const data = "chunked stream data "
+
+	s := NewServer(&config.Config{
+		Source: config.Credentials{Password: "hackme"},
+	})
+	defer s.Close()
+
+	dial, stop := serveTest(t, s)
+	defer stop()
+
+	source := dial()
+	defer source.Close()
+
+	r, _ := http.NewRequest("PUT", "/main", nil)
+	r.SetBasicAuth(config.DefaultSourceUser, "hackme")
+	io.WriteString(source, "PUT /main HTTP/1.1\r\n"+
+		"Authorization: "+r.Header.Get("Authorization")+"\r\n"+
+		"Content-Type: audio/aac\r\n"+
+		"Expect: 100-continue\r\n"+
+		"Transfer-Encoding: chunked\r\n\r\n")
+
+	// the interim response comes before the final one
+	tp := textproto.NewReader(bufio.NewReader(source))
+	for _, status := range []string{"HTTP/1.1 100 ", "HTTP/1.0 200 "} {
+		line, err := tp.ReadLine()
+		if err != nil {
+			t.Fatal("failed to read status line:", err)
+		}
+		if !strings.HasPrefix(line, status) {
+			t.Fatalf("unexpected status line: %q, expected %q", line, status)
+		}
+		if _, err := tp.ReadMIMEHeader(); err != nil {
+			t.Fatal("failed to read response header:", err)
+		}
+	}
+
+	mount := s.Mount("/main")
+	if mount == nil {
+		t.Fatal("mount was not created for source")
+	}
+
+	conn, client := net.Pipe()
+	defer client.Close()
+	r, _ = http.NewRequest("GET", "/main", nil)
+	mount.AddClient(NewClient(conn, r))
+
+	// the client should receive the stream without the chunk framing
+	cw := httputil.NewChunkedWriter(source)
+	chunk := []byte(strings.Repeat(data, 200))
+	buf := make([]byte, 16384)
+	for i := 0; i < 100; i++ {
+		if _, err := cw.Write(chunk); err != nil {
+			t.Fatal("failed to write chunk:", err)
+		}
+
+		client.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+		n, _ := client.Read(buf)
+		if strings.Contains(string(buf[:n]), "\r\n") {
+			t.Fatalf("client received chunk framing: %q", buf[:n])
+		}
+		if strings.Contains(string(buf[:n]), data+data) {
+			return
+		}
+	}
+	t.Fatalf("client did not receive %q", data)
+}
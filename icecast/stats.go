@@ -0,0 +1,114 @@
+package icecast
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Wessie/sirencast"
+)
+
+// iceStats is the root of the icecast statistics XML documents
+type iceStats struct {
+	XMLName xml.Name    `xml:"icestats"`
+	Sources []iceSource `xml:"source"`
+}
+
+type iceSource struct {
+	Mount     string        `xml:"mount,attr"`
+	Listeners int           `xml:"Listeners"`
+	Listener  []iceListener `xml:"listener"`
+}
+
+// iceListener is a single listener as shown by the icecast listclients
+// admin function, BytesSent is not included by icecast itself.
+type iceListener struct {
+	IP        string `xml:"IP"`
+	UserAgent string `xml:"UserAgent"`
+	Connected int64  `xml:"Connected"`
+	ID        uint64 `xml:"ID"`
+	BytesSent uint64 `xml:"BytesSent"`
+}
+
+// WriteListClients writes a HTTP response to `w` containing the clients given
+// in the same XML format as the icecast listclients admin function.
+func WriteListClients(w io.Writer, mount string, clients []ClientInfo) error {
+	src := iceSource{
+		Mount:     mount,
+		Listeners: len(clients),
+		Listener:  make([]iceListener, len(clients)),
+	}
+
+	now := time.Now()
+	for i, c := range clients {
+		src.Listener[i] = iceListener{
+			IP:        c.Addr,
+			UserAgent: c.UserAgent,
+			Connected: int64(now.Sub(c.Connected) / time.Second),
+			ID:        c.ID,
+			BytesSent: c.BytesSent,
+		}
+	}
+
+	return writeXML(w, iceStats{Sources: []iceSource{src}})
+}
+
+// detectorStats is the root of the detector statistics XML document
+type detectorStats struct {
+	XMLName   xml.Name      `xml:"detectors"`
+	Detectors []iceDetector `xml:"detector"`
+}
+
+type iceDetector struct {
+	Name     string `xml:"name,attr"`
+	Priority int    `xml:"priority,attr"`
+	Enabled  bool   `xml:"enabled,attr"`
+	Hits     uint64 `xml:"Hits"`
+	Misses   uint64 `xml:"Misses"`
+	Peeked   uint64 `xml:"PeekedBytes"`
+	// Time is in microseconds
+	Time int64 `xml:"Time"`
+}
+
+// WriteDetectorStats writes a HTTP response to `w` containing the statistics
+// of the detectors given as XML, to see which protocols connections use.
+func WriteDetectorStats(w io.Writer, stats []sirencast.DetectorStats) error {
+	doc := detectorStats{Detectors: make([]iceDetector, len(stats))}
+	for i, st := range stats {
+		doc.Detectors[i] = iceDetector{
+			Name:     st.Name,
+			Priority: st.Priority,
+			Enabled:  st.Enabled,
+			Hits:     st.Hits,
+			Misses:   st.Misses,
+			Peeked:   st.Peeked,
+			Time:     int64(st.Time / time.Microsecond),
+		}
+	}
+	return writeXML(w, doc)
+}
+
+// writeXML writes a HTTP response to `w` with v encoded as XML document
+func writeXML(w io.Writer, v interface{}) error {
+	var body bytes.Buffer
+	body.WriteString(xml.Header)
+	if err := xml.NewEncoder(&body).Encode(v); err != nil {
+		return err
+	}
+	body.WriteString("\n")
+
+	h := http.Header{
+		"Content-Type":   {"text/xml"},
+		"Content-Length": {strconv.Itoa(body.Len())},
+	}
+
+	if err := WriteHeader(w, h, http.StatusOK); err != nil {
+		return err
+	}
+
+	_, err := body.WriteTo(w)
+	return err
+}
@@ -0,0 +1,118 @@
+package icecast
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Wessie/sirencast"
+)
+
+func TestWriteListClients(t *testing.T) {
+	clients := []ClientInfo{
+		{ID: 1, Addr: "127.0.0.1", UserAgent: "mpv", Connected: time.Now().Add(-time.Minute), BytesSent: 500},
+		{ID: 5, Addr: "::1", UserAgent: "<vlc>", Connected: time.Now(), BytesSent: 0},
+	}
+
+	var buf bytes.Buffer
+	if err := WriteListClients(&buf, "/main", clients); err != nil {
+		t.Fatal("failed to write client list:", err)
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(&buf), nil)
+	if err != nil {
+		t.Fatal("failed to read response:", err)
+	}
+
+	var stats iceStats
+	if err := xml.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		t.Fatal("failed to decode response:", err)
+	}
+
+	if len(stats.Sources) != 1 {
+		t.Fatalf("unexpected amount of sources: %d", len(stats.Sources))
+	}
+
+	src := stats.Sources[0]
+	if src.Mount != "/main" || src.Listeners != len(clients) || len(src.Listener) != len(clients) {
+		t.Fatalf("unexpected source: %+v", src)
+	}
+
+	for i, l := range src.Listener {
+		c := clients[i]
+		if l.ID != c.ID || l.IP != c.Addr || l.UserAgent != c.UserAgent || l.BytesSent != c.BytesSent {
+			t.Errorf("listener does not match client: %+v != %+v", l, c)
+		}
+	}
+
+	if src.Listener[0].Connected < 59 {
+		t.Errorf("unexpected connected time: %d", src.Listener[0].Connected)
+	}
+}
+
+func TestWriteDetectorStats(t *testing.T) {
+	stats := []sirencast.DetectorStats{
+		{Name: DetectorSource, Enabled: true, Hits: 3, Misses: 1, Peeked: 120, Time: 2 * time.Millisecond},
+		{Name: DetectorShoutcast, Priority: -1, Misses: 4},
+	}
+
+	var buf bytes.Buffer
+	if err := WriteDetectorStats(&buf, stats); err != nil {
+		t.Fatal("failed to write detector statistics:", err)
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(&buf), nil)
+	if err != nil {
+		t.Fatal("failed to read response:", err)
+	}
+
+	var doc detectorStats
+	if err := xml.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		t.Fatal("failed to decode response:", err)
+	}
+
+	expected := []iceDetector{
+		{Name: DetectorSource, Enabled: true, Hits: 3, Misses: 1, Peeked: 120, Time: 2000},
+		{Name: DetectorShoutcast, Priority: -1, Misses: 4},
+	}
+	if len(doc.Detectors) != len(expected) {
+		t.Fatalf("unexpected amount of detectors: %d", len(doc.Detectors))
+	}
+	for i, d := range doc.Detectors {
+		if d != expected[i] {
+			t.Errorf("unexpected detector: %+v != %+v", d, expected[i])
+		}
+	}
+}
+
+func TestMountClients(t *testing.T) {
+	m := NewMount("/test", "audio/mpeg")
+
+	for i := 0; i < 3; i++ {
+		conn, _ := net.Pipe()
+		r, _ := http.NewRequest("GET", "/test", nil)
+		r.RemoteAddr = "10.0.0.1:5000"
+		r.Header.Set("User-Agent", "test")
+
+		m.AddClient(NewClient(conn, r))
+	}
+
+	clients := m.Clients()
+	if len(clients) != 3 {
+		t.Fatalf("unexpected amount of clients: %d", len(clients))
+	}
+
+	for i, c := range clients {
+		if i > 0 && clients[i-1].ID >= c.ID {
+			t.Error("clients are not ordered by ID")
+		}
+
+		if c.Addr != "10.0.0.1" || c.UserAgent != "test" {
+			t.Errorf("unexpected client information: %+v", c)
+		}
+	}
+}
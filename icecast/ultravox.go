@@ -0,0 +1,325 @@
+package icecast
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"io"
+	"mime"
+	"strings"
+)
+
+// Ultravox 2.1 is the framing used by SHOUTcast v2, every message is of
+// the form:
+//
+//	sync (0x5A) | reserved (0x00) | class+type (2) | length (2) | payload | 0x00
+//
+// The upper 4 bits of the message type are the message class.
+const (
+	uvSync           = 0x5A
+	uvHeaderSize     = 6
+	uvMaxPayloadSize = 16377
+)
+
+// Ultravox message types used by the broadcaster protocol
+const (
+	uvAuthenticate     = 0x1001
+	uvSetup            = 0x1002
+	uvNegotiateBuffer  = 0x1003
+	uvStandby          = 0x1004
+	uvTerminate        = 0x1005
+	uvFlushMetadata    = 0x1006
+	uvListenerAuth     = 0x1007
+	uvNegotiatePayload = 0x1008
+	uvCipherKey        = 0x1009
+	uvMimeType         = 0x1040
+	uvStreamName       = 0x1100
+	uvStreamGenre      = 0x1101
+	uvStreamURL        = 0x1102
+	uvStreamPublic     = 0x1103
+	uvXMLMetadata      = 0x3902
+)
+
+// Ultravox message classes carrying stream data
+const (
+	uvClassMP3  = 0x7
+	uvClassData = 0x8
+)
+
+// ultravoxDataType returns the type of the messages carrying the data of a
+// stream with content-type ct, or 0 if the content-type can't be send over
+// Ultravox.
+func ultravoxDataType(ct string) uint16 {
+	if t, _, err := mime.ParseMediaType(ct); err == nil {
+		ct = t
+	}
+
+	switch strings.ToLower(ct) {
+	case "audio/mpeg":
+		return uvClassMP3 << 12
+	case "audio/aac":
+		return uvClassData<<12 | 0x001
+	case "audio/aacp":
+		return uvClassData<<12 | 0x003
+	}
+	return 0
+}
+
+var (
+	ErrUltravoxSync   = errors.New("ultravox: invalid sync byte")
+	ErrUltravoxLength = errors.New("ultravox: payload too large")
+)
+
+// uvMessage is a single ultravox message
+type uvMessage struct {
+	Type    uint16
+	Payload []byte
+}
+
+// Class returns the message class
+func (m uvMessage) Class() uint16 {
+	return m.Type >> 12
+}
+
+// readUltravox reads a single ultravox message from `r`, the payload
+// is only valid until the next call.
+func readUltravox(r *bufio.Reader, buf []byte) (uvMessage, error) {
+	var msg uvMessage
+
+	header := buf[:uvHeaderSize]
+	if _, err := io.ReadFull(r, header); err != nil {
+		return msg, err
+	}
+
+	if header[0] != uvSync {
+		return msg, ErrUltravoxSync
+	}
+
+	msg.Type = binary.BigEndian.Uint16(header[2:4])
+	length := int(binary.BigEndian.Uint16(header[4:6]))
+	if length > uvMaxPayloadSize {
+		return msg, ErrUltravoxLength
+	}
+
+	// the payload is followed by a single 0x00 byte
+	payload := buf[:length+1]
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return msg, err
+	}
+
+	msg.Payload = payload[:length]
+	return msg, nil
+}
+
+// writeUltravox writes a single ultravox message to `w`
+func writeUltravox(w io.Writer, typ uint16, payload string) error {
+	if len(payload) > uvMaxPayloadSize {
+		return ErrUltravoxLength
+	}
+
+	msg := make([]byte, uvHeaderSize, uvHeaderSize+len(payload)+1)
+	msg[0] = uvSync
+	binary.BigEndian.PutUint16(msg[2:4], typ)
+	binary.BigEndian.PutUint16(msg[4:6], uint16(len(payload)))
+	msg = append(msg, payload...)
+	msg = append(msg, 0)
+
+	_, err := w.Write(msg)
+	return err
+}
+
+// xteaKey converts a cipher key into a XTEA key, the key is
+// padded with zero bytes or truncated to 16 bytes.
+func xteaKey(key string) (k [4]uint32) {
+	b := make([]byte, 16)
+	copy(b, key)
+	for i := range k {
+		k[i] = binary.BigEndian.Uint32(b[i*4:])
+	}
+	return k
+}
+
+// xteaDecipher decrypts a hex encoded string encrypted with XTEA by a
+// SHOUTcast v2 source. The result has its zero padding removed.
+func xteaDecipher(s string, key [4]uint32) (string, error) {
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		return "", err
+	}
+
+	if len(data)%8 != 0 {
+		return "", errors.New("ultravox: invalid encrypted data length")
+	}
+
+	for i := 0; i < len(data); i += 8 {
+		v0 := binary.BigEndian.Uint32(data[i:])
+		v1 := binary.BigEndian.Uint32(data[i+4:])
+
+		const delta = 0x9E3779B9
+		var sum uint32 = 0xC6EF3720 // delta * 32
+		for r := 0; r < 32; r++ {
+			v1 -= (((v0 << 4) ^ (v0 >> 5)) + v0) ^ (sum + key[(sum>>11)&3])
+			sum -= delta
+			v0 -= (((v1 << 4) ^ (v1 >> 5)) + v1) ^ (sum + key[sum&3])
+		}
+
+		binary.BigEndian.PutUint32(data[i:], v0)
+		binary.BigEndian.PutUint32(data[i+4:], v1)
+	}
+
+	return strings.TrimRight(string(data), "\x00"), nil
+}
+
+// uvMetadata assembles the XML metadata of a SHOUTcast v2 source, these
+// can be split over several messages each starting with a small header:
+//
+//	id (2) | span (2) | index (2)
+//
+// where span is the total amount of messages and index is 1-based.
+type uvMetadata struct {
+	id    uint16
+	parts []string
+}
+
+// add adds a metadata message and returns the full XML document once
+// all parts have been received.
+func (m *uvMetadata) add(payload []byte) (string, bool) {
+	if len(payload) < 6 {
+		return "", false
+	}
+
+	id := binary.BigEndian.Uint16(payload[0:2])
+	span := int(binary.BigEndian.Uint16(payload[2:4]))
+	index := int(binary.BigEndian.Uint16(payload[4:6]))
+	if span == 0 || index == 0 || index > span {
+		return "", false
+	}
+
+	if id != m.id || len(m.parts) != span {
+		m.id = id
+		m.parts = make([]string, span)
+	}
+	m.parts[index-1] = string(payload[6:])
+
+	for _, p := range m.parts {
+		if p == "" {
+			return "", false
+		}
+	}
+
+	doc := strings.Join(m.parts, "")
+	m.parts = nil
+	return doc, true
+}
+
+// uvMetadataMessages splits the XML metadata document into the payloads
+// of the messages it is send in, each holds at most size bytes of doc.
+func uvMetadataMessages(id uint16, doc string, size int) [][]byte {
+	var parts []string
+	for len(doc) > size {
+		parts = append(parts, doc[:size])
+		doc = doc[size:]
+	}
+	parts = append(parts, doc)
+
+	payloads := make([][]byte, len(parts))
+	for i, p := range parts {
+		b := make([]byte, 6, 6+len(p))
+		binary.BigEndian.PutUint16(b[0:], id)
+		binary.BigEndian.PutUint16(b[2:], uint16(len(parts)))
+		binary.BigEndian.PutUint16(b[4:], uint16(i+1))
+		payloads[i] = append(b, p...)
+	}
+	return payloads
+}
+
+// ultravoxMetadataDoc returns the XML metadata send to SHOUTcast v2
+// listeners for meta, the whole "artist - title" is send as the title.
+func ultravoxMetadataDoc(meta string) string {
+	var b bytes.Buffer
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8" ?><metadata><TIT2>`)
+	xml.EscapeText(&b, []byte(meta))
+	b.WriteString(`</TIT2></metadata>`)
+	return b.String()
+}
+
+// parseUltravoxMetadata parses the XML metadata send by SHOUTcast v2 sources
+// and returns it in the "artist - title" form used for ICY metadata.
+func parseUltravoxMetadata(doc string) (string, error) {
+	var meta struct {
+		Title  string `xml:"TIT2"`
+		Artist string `xml:"TPE1"`
+	}
+
+	if err := xml.Unmarshal([]byte(doc), &meta); err != nil {
+		return "", err
+	}
+
+	return joinArtistTitle(meta.Artist, meta.Title), nil
+}
+
+// joinArtistTitle returns the "artist - title" form used for metadata,
+// either can be empty.
+func joinArtistTitle(artist, title string) string {
+	title = strings.TrimSpace(title)
+	artist = strings.TrimSpace(artist)
+	if artist == "" {
+		return title
+	} else if title == "" {
+		return artist
+	}
+	return artist + " - " + title
+}
+
+// ultravoxReader reads the stream data of a SHOUTcast v2 source, metadata
+// messages are passed to OnMetadata and all other messages are ignored.
+type ultravoxReader struct {
+	r   *bufio.Reader
+	buf []byte
+	// data is the remaining stream data of the last message
+	data []byte
+	meta uvMetadata
+
+	OnMetadata func(meta string)
+}
+
+func newUltravoxReader(r *bufio.Reader) *ultravoxReader {
+	return &ultravoxReader{
+		r:   r,
+		buf: make([]byte, uvMaxPayloadSize+1),
+	}
+}
+
+func (uv *ultravoxReader) Read(p []byte) (n int, err error) {
+	for len(uv.data) == 0 {
+		msg, err := readUltravox(uv.r, uv.buf)
+		if err != nil {
+			return 0, err
+		}
+
+		switch {
+		case msg.Class() == uvClassMP3 || msg.Class() == uvClassData:
+			uv.data = msg.Payload
+		case msg.Type == uvXMLMetadata:
+			doc, ok := uv.meta.add(msg.Payload)
+			if !ok || uv.OnMetadata == nil {
+				continue
+			}
+
+			meta, err := parseUltravoxMetadata(doc)
+			if err != nil {
+				continue
+			}
+			uv.OnMetadata(meta)
+		case msg.Type == uvTerminate:
+			return 0, io.EOF
+		}
+	}
+
+	n = copy(p, uv.data)
+	uv.data = uv.data[n:]
+	return n, nil
+}
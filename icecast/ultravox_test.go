@@ -0,0 +1,298 @@
+package icecast
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Wessie/sirencast/config"
+)
+
+// xteaEncipher is the inverse of xteaDecipher and mirrors what a
+// SHOUTcast v2 source does to its credentials.
+func xteaEncipher(s string, key [4]uint32) string {
+	data := []byte(s)
+	for len(data)%8 != 0 {
+		data = append(data, 0)
+	}
+
+	for i := 0; i < len(data); i += 8 {
+		v0 := binary.BigEndian.Uint32(data[i:])
+		v1 := binary.BigEndian.Uint32(data[i+4:])
+
+		const delta = 0x9E3779B9
+		var sum uint32
+		for r := 0; r < 32; r++ {
+			v0 += (((v1 << 4) ^ (v1 >> 5)) + v1) ^ (sum + key[sum&3])
+			sum += delta
+			v1 += (((v0 << 4) ^ (v0 >> 5)) + v0) ^ (sum + key[(sum>>11)&3])
+		}
+
+		binary.BigEndian.PutUint32(data[i:], v0)
+		binary.BigEndian.PutUint32(data[i+4:], v1)
+	}
+
+	return hex.EncodeToString(data)
+}
+
+func TestUltravoxXTEA(t *testing.T) {
+	key := xteaKey(config.DefaultCipherKey)
+	tests := []string{"", "a", "hackme", "exactly8", "a somewhat longer password"}
+
+	for _, s := range tests {
+		res, err := xteaDecipher(xteaEncipher(s, key), key)
+		if err != nil {
+			t.Errorf("failed to decipher %q: %s", s, err)
+		} else if res != s {
+			t.Errorf("deciphered result differs: %q != %q", res, s)
+		}
+	}
+
+	if _, err := xteaDecipher("abc", key); err == nil {
+		t.Error("deciphered invalid input without error")
+	}
+
+	// known answers of the reference XTEA implementation
+	vectors := []struct {
+		key, cipher, plain string
+	}{
+		{"", "dee9d4d8f7131ed9", ""},
+		{"\x00\x01\x02\x03\x04\x05\x06\x07\x08\x09\x0a\x0b\x0c\x0d\x0e\x0f", "497df3d072612cb5", "ABCDEFGH"},
+		{"\x00\x01\x02\x03\x04\x05\x06\x07\x08\x09\x0a\x0b\x0c\x0d\x0e\x0f", "e78f2d13744341d8", "AAAAAAAA"},
+	}
+	for _, v := range vectors {
+		res, err := xteaDecipher(v.cipher, xteaKey(v.key))
+		if err != nil {
+			t.Errorf("failed to decipher %s: %s", v.cipher, err)
+		} else if res != v.plain {
+			t.Errorf("unexpected result for %s: %q != %q", v.cipher, res, v.plain)
+		}
+	}
+}
+
+func TestUltravoxMessage(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeUltravox(&buf, uvMimeType, "audio/mpeg"); err != nil {
+		t.Fatal("failed to write message:", err)
+	}
+
+	msg, err := readUltravox(bufio.NewReader(&buf), make([]byte, uvMaxPayloadSize+1))
+	if err != nil {
+		t.Fatal("failed to read message:", err)
+	}
+
+	if msg.Type != uvMimeType || string(msg.Payload) != "audio/mpeg" {
+		t.Errorf("unexpected message: %x %q", msg.Type, msg.Payload)
+	}
+
+	if msg.Class() != 0x1 {
+		t.Errorf("unexpected message class: %x", msg.Class())
+	}
+
+	_, err = readUltravox(bufio.NewReader(bytes.NewReader([]byte{0, 0, 0, 0, 0, 0, 0})), make([]byte, 16))
+	if err != ErrUltravoxSync {
+		t.Errorf("expected sync error, got: %v", err)
+	}
+}
+
+func TestUltravoxMetadata(t *testing.T) {
+	const doc = `<?xml version="1.0" encoding="UTF-8" ?><metadata><TIT2>Title</TIT2><TPE1>Artist</TPE1></metadata>`
+
+	var m uvMetadata
+	payloads := uvMetadataMessages(1, doc, 20)
+	for i, p := range payloads {
+		res, ok := m.add(p)
+		if ok != (i == len(payloads)-1) {
+			t.Fatalf("unexpected completion at part %d of %d", i+1, len(payloads))
+		}
+
+		if ok && res != doc {
+			t.Errorf("assembled document differs: %q != %q", res, doc)
+		}
+	}
+
+	meta, err := parseUltravoxMetadata(doc)
+	if err != nil {
+		t.Fatal("failed to parse metadata:", err)
+	}
+
+	if meta != "Artist - Title" {
+		t.Errorf("unexpected metadata: %q", meta)
+	}
+}
+
+func TestUltravoxSource(t *testing.T) {
+	const doc = `<?xml version="1.0" encoding="UTF-8" ?><metadata><TIT2>Title</TIT2><TPE1>Artist</TPE1></metadata>`
+
+	s := NewServer(&config.Config{
+		Source: config.Credentials{Password: "hackme"},
+		Shoutcast: config.Shoutcast{
+			Streams: []config.ShoutcastStream{{ID: 2, Mount: "/sc2"}},
+		},
+	})
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go s.handleUltravox(server, "127.0.0.1:5000")
+
+	var (
+		b   = bufio.NewReader(client)
+		buf = make([]byte, uvMaxPayloadSize+1)
+	)
+
+	expect := func(typ uint16, payload string) {
+		client.SetDeadline(time.Now().Add(time.Second))
+		if err := writeUltravox(client, typ, payload); err != nil {
+			t.Fatal("failed to write message:", err)
+		}
+
+		msg, err := readUltravox(b, buf)
+		if err != nil {
+			t.Fatal("failed to read reply:", err)
+		}
+
+		if msg.Type != typ || len(msg.Payload) < 3 || string(msg.Payload[:3]) != "ACK" {
+			t.Fatalf("unexpected reply to %x: %x %q", typ, msg.Type, msg.Payload)
+		}
+	}
+
+	key := xteaKey(config.DefaultCipherKey)
+	expect(uvCipherKey, "2.1")
+	expect(uvAuthenticate, "2.1:2:"+xteaEncipher("", key)+":"+xteaEncipher("hackme", key))
+	expect(uvMimeType, "audio/aacp")
+	expect(uvSetup, "64000:64000")
+	expect(uvStandby, "")
+
+	for _, p := range uvMetadataMessages(1, doc, 40) {
+		writeUltravox(client, uvXMLMetadata, string(p))
+	}
+	writeUltravox(client, uvClassData<<12|0x003, "data")
+
+	mount := s.Mount("/sc2")
+	if mount == nil {
+		t.Fatal("mount was not created for source")
+	}
+
+	if mount.ContentType != "audio/aacp" {
+		t.Errorf("unexpected mount content-type: %s", mount.ContentType)
+	}
+
+	for i := 0; mount.meta.Get() != "Artist - Title"; i++ {
+		if i > 100 {
+			t.Fatalf("metadata was not set on mount: %q", mount.meta.Get())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestUltravoxListener(t *testing.T) {
+	s := NewServer(&config.Config{
+		Shoutcast: config.Shoutcast{
+			Streams: []config.ShoutcastStream{{ID: 2, Mount: "/sc2"}},
+		},
+	})
+	defer s.Close()
+
+	dial, stop := serveTest(t, s)
+	defer stop()
+
+	mount, err := s.sourceMount("/sc2", "audio/aacp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sourceConn, sourceRemote := net.Pipe()
+	defer sourceRemote.Close()
+	r, _ := http.NewRequest("SOURCE", "/sc2", nil)
+	mount.AddSource(NewSource(sourceConn, r))
+	mount.SetMetadata(NewSourceID(r), "Artist - Title")
+	go func() {
+		chunk := bytes.Repeat([]byte("data"), 1024)
+		for {
+			if _, err := sourceRemote.Write(chunk); err != nil {
+				return
+			}
+		}
+	}()
+
+	for i := 0; mount.meta.Get() != "Artist - Title"; i++ {
+		if i > 100 {
+			t.Fatalf("metadata was not set on mount: %q", mount.meta.Get())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	conn := dial()
+	defer conn.Close()
+	io.WriteString(conn, "GET /stream/2/ HTTP/1.1\r\nUltravox-Transport-Type: TCP\r\n\r\n")
+
+	b := bufio.NewReader(conn)
+	tp := textproto.NewReader(b)
+	if line, err := tp.ReadLine(); err != nil || !strings.HasPrefix(line, "HTTP/1.0 200 ") {
+		t.Fatalf("unexpected status line: %q, %v", line, err)
+	}
+	h, err := tp.ReadMIMEHeader()
+	if err != nil {
+		t.Fatal("failed to read header:", err)
+	}
+	if h.Get("Content-Type") != "misc/ultravox" || h.Get("Ultravox-Sid") != "2" || h.Get("Ultravox-Class-Type") != "8003" {
+		t.Errorf("unexpected header: %v", h)
+	}
+
+	var (
+		buf  = make([]byte, uvMaxPayloadSize+1)
+		meta uvMetadata
+		doc  string
+		data int
+	)
+	for data < 8192 {
+		msg, err := readUltravox(b, buf)
+		if err != nil {
+			t.Fatal("failed to read message:", err)
+		}
+
+		switch msg.Type {
+		case uvXMLMetadata:
+			if d, ok := meta.add(msg.Payload); ok {
+				doc = d
+			}
+		case uvClassData<<12 | 0x003:
+			if !bytes.Contains(bytes.Repeat([]byte("data"), 2+len(msg.Payload)/4), msg.Payload) {
+				t.Fatalf("unexpected data: %q", msg.Payload)
+			}
+			data += len(msg.Payload)
+		default:
+			t.Fatalf("unexpected message type: %x", msg.Type)
+		}
+	}
+
+	if res, err := parseUltravoxMetadata(doc); err != nil || res != "Artist - Title" {
+		t.Errorf("unexpected metadata: %q, %v", res, err)
+	}
+}
+
+func TestUltravoxReader(t *testing.T) {
+	var buf bytes.Buffer
+	writeUltravox(&buf, uvClassMP3<<12, "hello ")
+	writeUltravox(&buf, uvStreamName, "ignored")
+	writeUltravox(&buf, uvClassMP3<<12, "world")
+	writeUltravox(&buf, uvTerminate, "")
+	writeUltravox(&buf, uvClassMP3<<12, "never read")
+
+	data, err := ioutil.ReadAll(newUltravoxReader(bufio.NewReader(&buf)))
+	if err != nil {
+		t.Fatal("failed to read data:", err)
+	}
+
+	if string(data) != "hello world" {
+		t.Errorf("unexpected data: %q", data)
+	}
+}
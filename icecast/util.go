@@ -1,7 +1,9 @@
 package icecast
 
 import (
+	"bytes"
 	"encoding/base64"
+	"encoding/xml"
 	"errors"
 	"io"
 	"net/http"
@@ -54,3 +56,31 @@ func WriteHeader(w io.Writer, h http.Header, code int) error {
 	_, err := io.WriteString(w, "\r\n")
 	return err
 }
+
+// WriteIceResponse writes an icecast admin response to writer `w`, this is a
+// HTTP header followed by a small XML document containing the message given.
+// The return value in the document is 1 if code is 200 OK and 0 otherwise.
+func WriteIceResponse(w io.Writer, h http.Header, code int, message string) error {
+	ret := "0"
+	if code == http.StatusOK {
+		ret = "1"
+	}
+
+	var body bytes.Buffer
+	body.WriteString(`<?xml version="1.0"?>` + "\n<iceresponse><message>")
+	xml.EscapeText(&body, []byte(message))
+	body.WriteString("</message><return>" + ret + "</return></iceresponse>\n")
+
+	if h == nil {
+		h = http.Header{}
+	}
+	h.Set("Content-Type", "text/xml")
+	h.Set("Content-Length", strconv.Itoa(body.Len()))
+
+	if err := WriteHeader(w, h, code); err != nil {
+		return err
+	}
+
+	_, err := body.WriteTo(w)
+	return err
+}
@@ -0,0 +1,51 @@
+package icecast
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestWriteIceResponse(t *testing.T) {
+	tests := []struct {
+		code    int
+		message string
+		ret     string
+	}{
+		{http.StatusOK, "Metadata update successful", "<return>1</return>"},
+		{http.StatusUnauthorized, "Authentication Required", "<return>0</return>"},
+		{http.StatusBadRequest, "<escaped & more>", "<return>0</return>"},
+	}
+
+	for _, h := range tests {
+		var buf bytes.Buffer
+		if err := WriteIceResponse(&buf, nil, h.code, h.message); err != nil {
+			t.Fatal("failed to write response:", err)
+		}
+
+		resp, err := http.ReadResponse(bufio.NewReader(&buf), nil)
+		if err != nil {
+			t.Fatal("failed to read response:", err)
+		}
+
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal("failed to read response body:", err)
+		}
+
+		if resp.StatusCode != h.code {
+			t.Errorf("unexpected status code: %d != %d", resp.StatusCode, h.code)
+		}
+
+		if int64(len(body)) != resp.ContentLength {
+			t.Errorf("content-length does not match body: %d != %d", len(body), resp.ContentLength)
+		}
+
+		if !strings.Contains(string(body), h.ret) {
+			t.Errorf("body does not contain %s: %s", h.ret, body)
+		}
+	}
+}
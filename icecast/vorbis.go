@@ -0,0 +1,268 @@
+package icecast
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"strings"
+)
+
+// Prefixes of the comment header packets of the codecs we can rewrite
+var (
+	vorbisCommentPrefix = []byte("\x03vorbis")
+	opusCommentPrefix   = []byte("OpusTags")
+)
+
+// vorbisComments is a Vorbis comment header, as used by both Vorbis
+// and Opus streams.
+type vorbisComments struct {
+	prefix []byte
+	// framing indicates if the packet ends with a framing bit
+	framing bool
+
+	Vendor   string
+	Comments []string
+}
+
+// parseVorbisComments parses a Vorbis or Opus comment header packet
+func parseVorbisComments(packet []byte) (vorbisComments, bool) {
+	var vc vorbisComments
+	switch {
+	case bytes.HasPrefix(packet, vorbisCommentPrefix):
+		vc.prefix, vc.framing = vorbisCommentPrefix, true
+	case bytes.HasPrefix(packet, opusCommentPrefix):
+		vc.prefix = opusCommentPrefix
+	default:
+		return vc, false
+	}
+
+	b := packet[len(vc.prefix):]
+	read := func() (string, bool) {
+		if len(b) < 4 {
+			return "", false
+		}
+		n := binary.LittleEndian.Uint32(b)
+		b = b[4:]
+		if uint32(len(b)) < n {
+			return "", false
+		}
+		s := string(b[:n])
+		b = b[n:]
+		return s, true
+	}
+
+	vendor, ok := read()
+	if !ok || len(b) < 4 {
+		return vc, false
+	}
+	vc.Vendor = vendor
+
+	count := binary.LittleEndian.Uint32(b)
+	b = b[4:]
+	for i := uint32(0); i < count; i++ {
+		c, ok := read()
+		if !ok {
+			return vc, false
+		}
+		vc.Comments = append(vc.Comments, c)
+	}
+	return vc, true
+}
+
+// Bytes returns the comment header packet
+func (vc vorbisComments) Bytes() []byte {
+	var b bytes.Buffer
+	write := func(s string) {
+		binary.Write(&b, binary.LittleEndian, uint32(len(s)))
+		b.WriteString(s)
+	}
+
+	b.Write(vc.prefix)
+	write(vc.Vendor)
+	binary.Write(&b, binary.LittleEndian, uint32(len(vc.Comments)))
+	for _, c := range vc.Comments {
+		write(c)
+	}
+
+	if vc.framing {
+		b.WriteByte(1)
+	}
+	return b.Bytes()
+}
+
+// get returns the value of the first comment with the field name given
+func (vc vorbisComments) get(name string) string {
+	for _, c := range vc.Comments {
+		if i := strings.IndexByte(c, '='); i >= 0 && strings.EqualFold(c[:i], name) {
+			return c[i+1:]
+		}
+	}
+	return ""
+}
+
+// Meta returns the comments in the "artist - title" form used for metadata
+func (vc vorbisComments) Meta() string {
+	return joinArtistTitle(vc.get("ARTIST"), vc.get("TITLE"))
+}
+
+// SetMeta replaces the ARTIST and TITLE comments with those in the metadata
+// given, metadata without a " - " separator is used as the title.
+func (vc *vorbisComments) SetMeta(meta string) {
+	comments := vc.Comments[:0:0]
+	for _, c := range vc.Comments {
+		i := strings.IndexByte(c, '=')
+		if i >= 0 && (strings.EqualFold(c[:i], "ARTIST") || strings.EqualFold(c[:i], "TITLE")) {
+			continue
+		}
+		comments = append(comments, c)
+	}
+
+	artist, title := "", meta
+	if i := strings.Index(meta, " - "); i >= 0 {
+		artist, title = meta[:i], meta[i+3:]
+	}
+
+	if artist != "" {
+		comments = append(comments, "ARTIST="+artist)
+	}
+	vc.Comments = append(comments, "TITLE="+title)
+}
+
+// oggHeaderComments returns the comments in the header pages given, and
+// the index of the comment packet in the header packets.
+func oggHeaderComments(packets [][]byte) (vorbisComments, int, bool) {
+	for i, p := range packets {
+		if vc, ok := parseVorbisComments(p); ok {
+			return vc, i, true
+		}
+	}
+	return vorbisComments{}, -1, false
+}
+
+// oggRewriter rewrites the Ogg stream of a mount to carry the metadata of
+// the mount. A metadata update starts a new logical stream with the same
+// codec headers except for the comments, the pages following it are
+// rewritten to belong to the new stream.
+type oggRewriter struct {
+	// buf holds the page being assembled
+	buf []byte
+	// scratch is used for rewriting pages
+	scratch []byte
+
+	// headers are the header pages of the current source stream
+	headers   []byte
+	inHeaders bool
+	// serial is the serial number of the current source stream
+	serial uint32
+	// unsupported is set if we can't rewrite the current stream, this is
+	// the case for multiplexed streams and codecs without comments.
+	unsupported bool
+
+	// current is the metadata in the comments of our output
+	current string
+	// pending is the metadata we want in our output
+	pending    string
+	hasPending bool
+
+	// rewriting indicates if source pages are rewritten to newSerial
+	rewriting bool
+	newSerial uint32
+	seq       uint32
+}
+
+// setMetadata makes the rewriter start a new logical stream with the
+// metadata given at the next page boundary, unless the stream already
+// carries it.
+func (r *oggRewriter) setMetadata(meta string) {
+	r.pending, r.hasPending = meta, true
+}
+
+// write assembles the pages in p and passes them to out, possibly
+// after rewriting them.
+func (r *oggRewriter) write(p []byte, out func([]byte)) {
+	r.buf = append(r.buf, p...)
+	for {
+		i := oggSync(r.buf)
+		if i < 0 {
+			// keep what might be the start of a capture pattern
+			if len(r.buf) > 4 {
+				r.buf = append(r.buf[:0], r.buf[len(r.buf)-4:]...)
+			}
+			return
+		}
+
+		pg, ok := parseOggPage(r.buf[i:])
+		if !ok || len(r.buf)-i < pg.Size {
+			r.buf = append(r.buf[:0], r.buf[i:]...)
+			return
+		}
+
+		r.page(r.buf[i:i+pg.Size], pg, out)
+		r.buf = r.buf[i+pg.Size:]
+	}
+}
+
+func (r *oggRewriter) page(page []byte, pg oggPage, out func([]byte)) {
+	serial := binary.LittleEndian.Uint32(page[14:18])
+
+	if pg.Flags&oggFlagBOS != 0 && !r.inHeaders {
+		// the source starts a new stream, which comes with its own comments
+		r.headers, r.inHeaders = nil, true
+		r.serial, r.unsupported, r.rewriting = serial, false, false
+	}
+
+	if r.inHeaders {
+		if pg.isHeader() {
+			r.unsupported = r.unsupported || serial != r.serial
+			r.headers = append(r.headers, page...)
+			out(page)
+			return
+		}
+
+		r.inHeaders = false
+		vc, _, ok := oggHeaderComments(oggPackets(r.headers))
+		r.unsupported = r.unsupported || !ok
+		r.current = vc.Meta()
+	}
+
+	r.unsupported = r.unsupported || serial != r.serial
+	if r.hasPending && !r.unsupported && r.pending != r.current {
+		r.restart(out)
+	}
+	r.hasPending = false
+
+	if r.rewriting {
+		page = append(r.scratch[:0], page...)
+		binary.LittleEndian.PutUint32(page[14:18], r.newSerial)
+		binary.LittleEndian.PutUint32(page[18:22], r.seq)
+		setOggCRC(page)
+		r.scratch = page
+		r.seq++
+	}
+	out(page)
+}
+
+// restart starts a new logical stream with the pending metadata
+func (r *oggRewriter) restart(out func([]byte)) {
+	packets := oggPackets(r.headers)
+	vc, idx, ok := oggHeaderComments(packets)
+	if !ok {
+		return
+	}
+	vc.SetMeta(r.pending)
+	packets[idx] = vc.Bytes()
+
+	old := r.newSerial
+	for r.newSerial == old || r.newSerial == r.serial {
+		r.newSerial = rand.Uint32()
+	}
+
+	// the first packet is alone on the BOS page, the others follow it
+	r.seq = 0
+	out(oggPacketPages(packets[0], oggFlagBOS, r.newSerial, &r.seq))
+	for _, packet := range packets[1:] {
+		out(oggPacketPages(packet, 0, r.newSerial, &r.seq))
+	}
+
+	r.rewriting, r.current = true, r.pending
+}
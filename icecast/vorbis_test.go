@@ -0,0 +1,207 @@
+package icecast
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// vorbisStream returns the header pages and audio pages of a Vorbis stream
+// with the serial and comments given, all pages have a valid CRC.
+func vorbisStream(serial uint32, comments ...string) (headers []byte, audio [][]byte) {
+	vc := vorbisComments{
+		prefix:   vorbisCommentPrefix,
+		framing:  true,
+		Vendor:   "sirencast test",
+		Comments: comments,
+	}
+
+	var seq uint32
+	headers = oggPacketPages([]byte("\x01vorbis ident"), oggFlagBOS, serial, &seq)
+	headers = append(headers, oggPacketPages(vc.Bytes(), 0, serial, &seq)...)
+	headers = append(headers, oggPacketPages([]byte("\x05vorbis setup"), 0, serial, &seq)...)
+
+	for i := uint64(1); i <= 3; i++ {
+		page := oggPacketPages([]byte("audio data"), 0, serial, &seq)
+		binary.LittleEndian.PutUint64(page[6:14], i*1000)
+		setOggCRC(page)
+		audio = append(audio, page)
+	}
+	return headers, audio
+}
+
+// splitOggPages splits b into the pages it holds
+func splitOggPages(t *testing.T, b []byte) [][]byte {
+	var pages [][]byte
+	for len(b) > 0 {
+		pg, ok := parseOggPage(b)
+		if !ok || pg.Size > len(b) {
+			t.Fatalf("invalid page: %q", b)
+		}
+		pages = append(pages, b[:pg.Size])
+		b = b[pg.Size:]
+	}
+	return pages
+}
+
+func TestVorbisComments(t *testing.T) {
+	vc := vorbisComments{
+		prefix:   vorbisCommentPrefix,
+		framing:  true,
+		Vendor:   "vendor",
+		Comments: []string{"artist=Someone", "TITLE=Something", "ALBUM=Else"},
+	}
+
+	if meta := vc.Meta(); meta != "Someone - Something" {
+		t.Errorf("unexpected metadata: %q", meta)
+	}
+
+	vc.SetMeta("Another - Song - Remix")
+	parsed, ok := parseVorbisComments(vc.Bytes())
+	if !ok {
+		t.Fatalf("failed to parse comments: %q", vc.Bytes())
+	}
+
+	if parsed.Vendor != "vendor" || parsed.get("ALBUM") != "Else" {
+		t.Errorf("unexpected comments: %+v", parsed)
+	}
+	if meta := parsed.Meta(); meta != "Another - Song - Remix" {
+		t.Errorf("unexpected metadata: %q", meta)
+	}
+
+	parsed.SetMeta("Just a title")
+	if parsed.get("ARTIST") != "" || parsed.get("TITLE") != "Just a title" {
+		t.Errorf("unexpected comments: %q", parsed.Comments)
+	}
+
+	if _, ok := parseVorbisComments([]byte("\x03vorbis\xff\x00\x00\x00")); ok {
+		t.Errorf("parsed truncated comments")
+	}
+}
+
+func TestOggPacketPages(t *testing.T) {
+	// a packet that is an exact multiple of 255 needs a terminating
+	// zero length segment.
+	packets := [][]byte{
+		bytes.Repeat([]byte{'a'}, 10),
+		bytes.Repeat([]byte{'b'}, 255*2),
+		bytes.Repeat([]byte{'c'}, 255*300),
+	}
+
+	var seq uint32
+	var b []byte
+	for _, p := range packets {
+		b = append(b, oggPacketPages(p, 0, 1234, &seq)...)
+	}
+
+	got := oggPackets(b)
+	if len(got) != len(packets) {
+		t.Fatalf("expected %d packets, got %d", len(packets), len(got))
+	}
+	for i := range packets {
+		if !bytes.Equal(got[i], packets[i]) {
+			t.Errorf("packet %d differs", i)
+		}
+	}
+
+	pages := splitOggPages(t, b)
+	if uint32(len(pages)) != seq {
+		t.Errorf("expected %d pages, got %d", seq, len(pages))
+	}
+	for i, page := range pages {
+		crc := binary.LittleEndian.Uint32(page[22:26])
+		setOggCRC(page)
+		if binary.LittleEndian.Uint32(page[22:26]) != crc {
+			t.Errorf("page %d has an invalid CRC", i)
+		}
+	}
+}
+
+func TestOggRewriter(t *testing.T) {
+	headers, audio := vorbisStream(1, "ARTIST=Source", "TITLE=Song")
+
+	var out []byte
+	write := func(p []byte) { out = append(out, p...) }
+
+	r := new(oggRewriter)
+	r.write(headers, write)
+	r.write(audio[0], write)
+
+	// the metadata of the stream itself doesn't need a new stream
+	r.setMetadata("Source - Song")
+	r.write(audio[1][:10], write)
+	r.write(audio[1][10:], write)
+
+	expected := append(append(append([]byte{}, headers...), audio[0]...), audio[1]...)
+	if !bytes.Equal(out, expected) {
+		t.Fatalf("stream was modified without new metadata")
+	}
+
+	out = out[:0]
+	r.setMetadata("Mount - Update")
+	r.write(audio[2], write)
+
+	pages := splitOggPages(t, out)
+	if len(pages) < 2 || !isOggBOS(pages[0]) {
+		t.Fatalf("expected a new stream, got %q", out)
+	}
+
+	vc, _, ok := oggHeaderComments(oggPackets(out))
+	if !ok || vc.Meta() != "Mount - Update" || vc.Vendor != "sirencast test" {
+		t.Errorf("unexpected comments: %+v", vc)
+	}
+
+	serial := binary.LittleEndian.Uint32(pages[0][14:18])
+	if serial == 1 {
+		t.Errorf("new stream uses the serial of the source")
+	}
+
+	for i, page := range pages {
+		if s := binary.LittleEndian.Uint32(page[14:18]); s != serial {
+			t.Errorf("page %d has serial %d instead of %d", i, s, serial)
+		}
+		if seq := binary.LittleEndian.Uint32(page[18:22]); seq != uint32(i) {
+			t.Errorf("page %d has sequence number %d", i, seq)
+		}
+
+		crc := binary.LittleEndian.Uint32(page[22:26])
+		setOggCRC(page)
+		if binary.LittleEndian.Uint32(page[22:26]) != crc {
+			t.Errorf("page %d has an invalid CRC", i)
+		}
+	}
+
+	last := pages[len(pages)-1]
+	if !bytes.Equal(last[oggHeaderSize:], audio[2][oggHeaderSize:]) {
+		t.Errorf("audio page was modified: %q", last)
+	}
+
+	// a new stream from the source is passed through unchanged again
+	out = out[:0]
+	next, nextAudio := vorbisStream(2, "TITLE=Next")
+	r.write(next, write)
+	r.write(nextAudio[0], write)
+	if !bytes.Equal(out, append(next, nextAudio[0]...)) {
+		t.Errorf("new source stream was modified")
+	}
+}
+
+func TestOggParserMetadata(t *testing.T) {
+	headers, audio := vorbisStream(1, "ARTIST=Source", "TITLE=Song")
+
+	op := new(oggParser)
+	op.Scan(headers)
+	if _, ok := op.Metadata(); ok {
+		t.Errorf("metadata reported before the headers ended")
+	}
+
+	op.Scan(audio[0])
+	if meta, ok := op.Metadata(); !ok || meta != "Source - Song" {
+		t.Errorf("unexpected metadata: %q %v", meta, ok)
+	}
+
+	op.Scan(audio[1])
+	if _, ok := op.Metadata(); ok {
+		t.Errorf("metadata reported twice")
+	}
+}
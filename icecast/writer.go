@@ -1,6 +1,10 @@
 package icecast
 
-import "io"
+import (
+	"io"
+	"sync"
+	"time"
+)
 
 func NewMultiWriter() *MultiWriter {
 	return &MultiWriter{
@@ -42,3 +46,275 @@ pending:
 
 	return len(p), nil
 }
+
+// DefaultBurstSize is the amount of bytes send to new clients if no burst
+// is configured for a mount.
+const DefaultBurstSize = 64 * 1024
+
+// mountWriter is the writer the sources of a mount write to, it passes
+// the data to the MultiWriter of the mount and keeps a backlog of the
+// latest data to burst to new clients.
+type mountWriter struct {
+	mu sync.Mutex
+	mw *MultiWriter
+	// frames follows the frames of all data written
+	frames framer
+	// sync returns where to start the burst in the backlog given
+	sync func([]byte) int
+	// rewriter rewrites the data of Ogg streams to carry our metadata,
+	// it is nil for other formats.
+	rewriter *oggRewriter
+
+	// backlog holds at least the last burstLimit() bytes written
+	backlog []byte
+	// size and seconds are the configured burst size, seconds is
+	// used over size if the bitrate is known.
+	size    int
+	seconds int
+	// rate is the bitrate of the current data in bytes per second,
+	// or zero if unknown.
+	rate int
+	// detect indicates if the rate should be found from the data
+	detect bool
+}
+
+func newMountWriter(mw *MultiWriter, frames framer, sync func([]byte) int) *mountWriter {
+	return &mountWriter{
+		mw:     mw,
+		frames: frames,
+		sync:   sync,
+		size:   DefaultBurstSize,
+	}
+}
+
+func (w *mountWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.rewriter != nil {
+		w.rewriter.write(p, w.write)
+	} else {
+		w.write(p)
+	}
+	return len(p), nil
+}
+
+// setMetadata sets the metadata to carry in-band, for formats that
+// support it. Empty metadata is ignored.
+func (w *mountWriter) setMetadata(meta string) {
+	if meta == "" || w.rewriter == nil {
+		return
+	}
+
+	w.mu.Lock()
+	w.rewriter.setMetadata(meta)
+	w.mu.Unlock()
+}
+
+func (w *mountWriter) write(p []byte) {
+	w.mw.Write(p)
+	w.frames.Scan(p)
+
+	if w.detect && w.rate == 0 {
+		if i := mp3FrameSync(p); i >= 0 {
+			w.rate = mp3Bitrate(p[i:]) * 1000 / 8
+		}
+	}
+
+	limit := w.burstLimit()
+	if limit == 0 {
+		w.backlog = w.backlog[:0]
+		return
+	}
+
+	// the backlog is only compacted once it grows to twice the limit
+	// to avoid moving it around on every write.
+	w.backlog = append(w.backlog, p...)
+	if len(w.backlog) > 2*limit {
+		w.backlog = w.backlog[:copy(w.backlog, w.backlog[len(w.backlog)-limit:])]
+	}
+}
+
+// burstLimit returns the amount of bytes to burst to new clients
+func (w *mountWriter) burstLimit() int {
+	if w.seconds > 0 && w.rate > 0 {
+		return w.seconds * w.rate
+	}
+	return w.size
+}
+
+// setBurst sets the burst size in bytes and seconds, see config.Mount
+func (w *mountWriter) setBurst(size, seconds int) {
+	w.mu.Lock()
+	w.size, w.seconds = size, seconds
+	w.mu.Unlock()
+}
+
+// setBitrate sets the bitrate of the data in kbit/s, the bitrate is found
+// from the data if zero and detect is true.
+func (w *mountWriter) setBitrate(kbps int, detect bool) {
+	w.mu.Lock()
+	w.rate, w.detect = kbps*1000/8, detect
+	w.mu.Unlock()
+}
+
+// join writes the backlog to dst, starting at the frame boundary found by
+// sync, and adds dst to the writers receiving all new data. The headers of
+// the stream are written first if the backlog doesn't start the stream.
+func (w *mountWriter) join(dst io.Writer) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	burst := w.backlog
+	if limit := w.burstLimit(); len(burst) > limit {
+		burst = burst[len(burst)-limit:]
+	}
+
+	i := -1
+	if len(burst) > 0 {
+		i = w.sync(burst)
+	}
+
+	if hf, ok := w.frames.(headerFramer); ok && (i < 0 || !isOggBOS(burst[i:])) {
+		dst.Write(hf.Headers())
+	}
+
+	if i >= 0 {
+		dst.Write(burst[i:])
+	}
+
+	// the MultiWriter is only written to with the lock held, so dst is
+	// added before anything is written after the backlog.
+	w.mw.w = append(w.mw.w, dst)
+}
+
+// relay adds g to the writers receiving all new data, without a burst.
+// The gate continues from the state of our framer so it knows where the
+// frames are in the data right away.
+func (w *mountWriter) relay(g *frameGate) {
+	w.mu.Lock()
+	g.frames = w.frames.clone()
+	w.mw.w = append(w.mw.w, g)
+	w.mu.Unlock()
+}
+
+// add adds dst to the writers receiving all new data, without a burst
+func (w *mountWriter) add(dst io.Writer) {
+	w.mu.Lock()
+	w.mw.w = append(w.mw.w, dst)
+	w.mu.Unlock()
+}
+
+// switchTimeout is the longest a frameGate waits for a frame boundary
+// after being stopped.
+var switchTimeout = time.Second
+
+// newFrameGate returns a frameGate writing to w, frame boundaries are found
+// with frames. If after is non-nil nothing is written until it is closed.
+func newFrameGate(w io.Writer, frames framer, after <-chan struct{}) *frameGate {
+	return &frameGate{
+		w:      w,
+		frames: frames,
+		after:  after,
+		done:   make(chan struct{}),
+	}
+}
+
+// frameGate is a writer that starts and stops passing data through at
+// frame boundaries, such that switching between two streams doesn't
+// leave a partial frame in the output.
+type frameGate struct {
+	mu sync.Mutex
+	w  io.Writer
+	// frames finds the frame boundaries, it is passed all data written
+	frames framer
+	// after is waited on before anything is written
+	after <-chan struct{}
+	// started indicates if we found the first frame boundary
+	started bool
+	// stopping indicates if we should stop at the next frame boundary
+	stopping bool
+	// discard makes writes succeed after the gate is done, instead of
+	// returning io.EOF.
+	discard bool
+
+	done     chan struct{}
+	doneOnce sync.Once
+}
+
+// Write writes p to the underlying writer. Data before the first frame
+// boundary is discarded, as is all data after the gate is done. io.EOF
+// is returned once the gate is done, unless discard is set.
+func (g *frameGate) Write(p []byte) (int, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	// the framer can be shared with other gates of the same source,
+	// so it gets to see all data even if we're done.
+	n := len(p)
+	i := g.frames.Scan(p)
+	select {
+	case <-g.done:
+		return n, g.doneErr()
+	default:
+	}
+
+	if !g.started {
+		if g.after != nil {
+			select {
+			case <-g.after:
+			default:
+				return n, nil
+			}
+		}
+
+		if i < 0 {
+			return n, nil
+		}
+		g.started, p = true, p[i:]
+
+		// decoders need the headers when starting in the middle
+		if hf, ok := g.frames.(headerFramer); ok {
+			if h := hf.StartHeaders(); len(h) > 0 {
+				g.w.Write(h)
+			}
+		}
+	} else if g.stopping && i >= 0 {
+		g.w.Write(p[:i])
+		g.finish()
+		return n, g.doneErr()
+	}
+
+	if _, err := g.w.Write(p); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+func (g *frameGate) doneErr() error {
+	if g.discard {
+		return nil
+	}
+	return io.EOF
+}
+
+// stop makes the gate stop at the next frame boundary, or after
+// switchTimeout if none is found. A gate that didn't start yet
+// stops immediately. The channel returned is closed once the gate stopped.
+func (g *frameGate) stop() <-chan struct{} {
+	g.mu.Lock()
+	g.stopping = true
+	started := g.started
+	g.mu.Unlock()
+
+	if !started {
+		g.finish()
+	} else {
+		time.AfterFunc(switchTimeout, g.finish)
+	}
+	return g.done
+}
+
+func (g *frameGate) finish() {
+	g.doneOnce.Do(func() { close(g.done) })
+}
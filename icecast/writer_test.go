@@ -0,0 +1,160 @@
+package icecast
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// mp3Frame is a MPEG-1 layer 3 frame header followed by some data
+var mp3Frame = []byte{0xFF, 0xFB, 0x90, 0x64, 'a', 'b', 'c'}
+
+// mp3Frames returns n frames of 128kbit/s 44.1kHz MPEG-1 layer 3 audio,
+// each frame is filled with the character given.
+func mp3Frames(n int, fill byte) []byte {
+	frame := bytes.Repeat([]byte{fill}, mp3FrameSize(mp3Frame))
+	copy(frame, mp3Frame[:4])
+	return bytes.Repeat(frame, n)
+}
+
+func TestFrameGate(t *testing.T) {
+	var buf bytes.Buffer
+	g := newFrameGate(&buf, new(mp3Parser), nil)
+	frames := mp3Frames(2, 'a')
+	size := len(frames) / 2
+
+	// data before the first frame is dropped
+	g.Write([]byte("junk"))
+	g.Write(append([]byte("xx"), frames[:size/2]...))
+	if !bytes.Equal(buf.Bytes(), frames[:size/2]) {
+		t.Fatalf("unexpected output after start: %x", buf.Bytes())
+	}
+
+	done := g.stop()
+	select {
+	case <-done:
+		t.Fatal("gate stopped before reaching a frame boundary")
+	default:
+	}
+
+	// the gate should stop exactly at the start of the second frame
+	buf.Reset()
+	n, err := g.Write(frames[size/2:])
+	if err != io.EOF || n != len(frames)-size/2 {
+		t.Errorf("unexpected result of stopping write: %d %v", n, err)
+	}
+
+	if !bytes.Equal(buf.Bytes(), frames[size/2:size]) {
+		t.Errorf("gate did not stop at the frame boundary: %d bytes written", buf.Len())
+	}
+
+	select {
+	case <-done:
+	default:
+		t.Error("gate is not done after stopping")
+	}
+}
+
+func TestMP3Parser(t *testing.T) {
+	frames := mp3Frames(3, 0)
+	size := len(frames) / 3
+
+	// split the stream at awkward places, including inside a header
+	splits := []int{0, 10, size + 2, size + 3, 2*size + 1, len(frames)}
+	var found []int
+	mp := new(mp3Parser)
+	for i := 1; i < len(splits); i++ {
+		p := frames[splits[i-1]:splits[i]]
+		if j := mp.Scan(p); j >= 0 {
+			found = append(found, splits[i-1]+j)
+		}
+	}
+
+	if len(found) != 3 || found[0] != 0 || found[1] != size || found[2] != 2*size {
+		t.Errorf("unexpected frame boundaries: %v (frame size %d)", found, size)
+	}
+
+	// audio data that looks like a header shouldn't be a boundary
+	data := mp3Frames(2, 0)
+	copy(data[10:], mp3Frame[:4])
+	mp = new(mp3Parser)
+	mp.Scan(data[:8])
+	if j := mp.Scan(data[8:20]); j >= 0 {
+		t.Errorf("header inside a frame reported as boundary at %d", 8+j)
+	}
+}
+
+func TestMP3FrameSync(t *testing.T) {
+	frames := mp3Frames(2, 0)
+	size := len(frames) / 2
+
+	// junk that looks like a header but isn't followed by another one
+	junk := append([]byte{}, mp3Frame[:4]...)
+	junk = append(junk, make([]byte, size)...)
+	if i := mp3FrameSync(append(junk, frames...)); i != len(junk) {
+		t.Errorf("unexpected frame sync: %d != %d", i, len(junk))
+	}
+
+	// a frame that runs past the end can't be checked
+	if i := mp3FrameSync(append([]byte("xx"), frames[:size/2]...)); i != 2 {
+		t.Errorf("unexpected frame sync on a partial frame: %d", i)
+	}
+
+	if i := mp3FrameSync([]byte("no frames here")); i != -1 {
+		t.Errorf("unexpected frame sync without a header: %d", i)
+	}
+}
+
+func TestFrameGateAfter(t *testing.T) {
+	var buf bytes.Buffer
+	after := make(chan struct{})
+	g := newFrameGate(&buf, anyFramer{}, after)
+
+	g.Write([]byte("early"))
+	close(after)
+	g.Write([]byte("late"))
+
+	if buf.String() != "late" {
+		t.Errorf("unexpected output: %q", buf.Bytes())
+	}
+
+	// a gate that never started stops immediately
+	select {
+	case <-newFrameGate(&buf, anyFramer{}, nil).stop():
+	default:
+		t.Error("unstarted gate did not stop immediately")
+	}
+}
+
+func TestMountWriterBurst(t *testing.T) {
+	w := newMountWriter(NewMultiWriter(), new(mp3Parser), mp3FrameSync)
+	w.setBurst(10, 0)
+
+	frame := append(append([]byte{}, mp3Frame...), 'd')
+	w.Write([]byte("junk"))
+	w.Write(append([]byte("xx"), frame...))
+
+	// the backlog is limited to 10 bytes and should start at the frame
+	var buf bytes.Buffer
+	w.join(&buf)
+	if !bytes.Equal(buf.Bytes(), frame) {
+		t.Fatalf("unexpected burst: %x", buf.Bytes())
+	}
+
+	buf.Reset()
+	w.Write([]byte("live"))
+	if buf.String() != "live" {
+		t.Errorf("joined writer did not receive new data: %q", buf.Bytes())
+	}
+
+	// with a known bitrate the burst is in seconds
+	w.setBurst(10, 1)
+	w.setBitrate(8, false)
+	if limit := w.burstLimit(); limit != 1000 {
+		t.Errorf("unexpected burst limit: %d", limit)
+	}
+
+	if kbps := (StreamInfo{AudioInfo: "ice-samplerate=44100;ice-bitrate=192"}).Kbps(); kbps != 192 {
+		t.Errorf("unexpected bitrate from audio info: %d", kbps)
+	}
+}
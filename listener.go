@@ -0,0 +1,131 @@
+package sirencast
+
+import (
+	"errors"
+	"net"
+	"os"
+	"time"
+
+	"github.com/Wessie/sirencast/config"
+)
+
+// listener is a listener we accept connections on, along with the
+// configuration it was opened for.
+type listener struct {
+	net.Listener
+	conf config.Listener
+}
+
+// listen opens a listener as configured in conf. A unix socket left behind
+// by a previous process is removed first, unless something still accepts
+// connections on it.
+func listen(conf config.Listener) (net.Listener, error) {
+	if conf.Net() == "unix" {
+		if fi, err := os.Stat(conf.Addr); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			if c, err := net.DialTimeout("unix", conf.Addr, time.Second); err == nil {
+				c.Close()
+			} else {
+				os.Remove(conf.Addr)
+			}
+		}
+	}
+
+	return net.Listen(conf.Net(), conf.Addr)
+}
+
+// listen returns the listeners to accept connections on, the listeners
+// passed on by Server.Upgrade are used if we were started by it. Listeners
+// that are no longer configured are closed, and new ones are opened.
+func (server *Server) listen() ([]*listener, *net.UnixConn, error) {
+	if err := server.inherit(); err != nil {
+		return nil, nil, err
+	}
+
+	server.mu.Lock()
+	conf := server.Config
+	inherited, upgrade := server.inherited, server.upgrade
+	server.inherited, server.upgrade = nil, nil
+	server.mu.Unlock()
+
+	var (
+		ls  []*listener
+		err error
+	)
+	fail := func(err error) ([]*listener, *net.UnixConn, error) {
+		for _, l := range ls {
+			l.Close()
+		}
+		closeListeners(inherited)
+		if upgrade != nil {
+			upgrade.Close()
+		}
+		return nil, nil, err
+	}
+
+	for _, lc := range conf.AllListeners() {
+		l, ok := inherited[lc.String()]
+		if ok {
+			delete(inherited, lc.String())
+		} else if l, err = listen(lc); err != nil {
+			return fail(err)
+		}
+		ls = append(ls, &listener{l, lc})
+	}
+	closeListeners(inherited)
+
+	if len(ls) == 0 {
+		return fail(errors.New("sirencast: no listeners configured"))
+	}
+	return ls, upgrade, nil
+}
+
+// inherit takes over the listeners passed on by Upgrade if we were started
+// by it, this is only done once.
+func (server *Server) inherit() error {
+	server.inheritOnce.Do(func() {
+		inherited, upgrade, err := inheritedListeners()
+
+		server.mu.Lock()
+		server.inherited, server.upgrade, server.inheritErr = inherited, upgrade, err
+		server.mu.Unlock()
+	})
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return server.inheritErr
+}
+
+// inheritedListener returns the listener passed on by Upgrade under name,
+// or nil if there is none. Listeners that aren't taken before Serve is
+// called are closed by it.
+func (server *Server) inheritedListener(name string) (net.Listener, error) {
+	if err := server.inherit(); err != nil {
+		return nil, err
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	l := server.inherited[name]
+	delete(server.inherited, name)
+	return l, nil
+}
+
+// closeListeners closes all listeners in ls
+func closeListeners(ls map[string]net.Listener) {
+	for _, l := range ls {
+		l.Close()
+	}
+}
+
+// listenerConfig returns the current configuration of the listener l was
+// opened for, or the configuration l was opened with if it was removed.
+func (server *Server) listenerConfig(l config.Listener) config.Listener {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	if cl := server.Config.Listener(l); cl != nil {
+		return *cl
+	}
+	return l
+}
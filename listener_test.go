@@ -0,0 +1,130 @@
+package sirencast
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Wessie/sirencast/config"
+)
+
+// nameDetector returns a detector that claims connections starting with
+// name, the handler writes back the name.
+func nameDetector(name string) Detector {
+	return func(r io.Reader) ConnHandler {
+		line, _ := bufio.NewReader(r).ReadString('\n')
+		if line != name+"\n" {
+			return nil
+		}
+		return func(c *Conn) {
+			defer c.Close()
+			c.Write([]byte(name + "\n"))
+		}
+	}
+}
+
+func TestServerListeners(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sirencast-listeners")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "sirencast.sock")
+	conf := &config.Config{
+		Addr: "127.0.0.1:0",
+		Listeners: []config.Listener{
+			{Network: "unix", Addr: socket, Detectors: []string{"source"}},
+			{Addr: "localhost:0", Detectors: []string{"listener", DefaultName}},
+		},
+	}
+
+	server, err := SetupServer(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Detectors = NewDetectors()
+	server.Detectors.RegisterName("source", nameDetector("source"))
+	server.Detectors.RegisterName("listener", nameDetector("listener"))
+	server.Detectors.Default = func(c *Conn) {
+		defer c.Close()
+		c.Write([]byte("default\n"))
+	}
+
+	served := make(chan error, 1)
+	go func() { served <- server.Serve() }()
+
+	var ls []*listener
+	for i := 0; i < 100 && len(ls) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		server.mu.Lock()
+		ls = server.listeners
+		server.mu.Unlock()
+	}
+	if len(ls) != 3 {
+		t.Fatalf("expected 3 listeners, got %d", len(ls))
+	}
+
+	send := func(l *listener, line string) string {
+		c, err := net.Dial(l.Addr().Network(), l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		c.Write([]byte(line + "\n"))
+		reply, _ := bufio.NewReader(c).ReadString('\n')
+		return reply
+	}
+
+	tests := []struct {
+		listener int
+		line     string
+		reply    string
+	}{
+		{0, "source", "source\n"},
+		{0, "listener", "listener\n"},
+		{0, "other", "default\n"},
+		{1, "source", "source\n"},
+		{1, "listener", ""},
+		{1, "other", ""},
+		{2, "source", "default\n"},
+		{2, "listener", "listener\n"},
+	}
+	for _, test := range tests {
+		if reply := send(ls[test.listener], test.line); reply != test.reply {
+			t.Errorf("listener %d: expected %q for %q, got %q",
+				test.listener, test.reply, test.line, reply)
+		}
+	}
+
+	// reloading changes the restrictions of a listener
+	reloaded := *conf
+	reloaded.Listeners = []config.Listener{conf.Listeners[0], {Addr: "localhost:0"}}
+	reloaded.Listeners[0].Detectors = []string{"listener"}
+	server.SetConfig(&reloaded)
+
+	if reply := send(ls[1], "source"); reply != "" {
+		t.Errorf("reloaded listener still allows sources: %q", reply)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-served; err != ErrServerClosed {
+		t.Errorf("serve returned unexpected error: %v", err)
+	}
+
+	if _, err := os.Stat(socket); !os.IsNotExist(err) {
+		t.Errorf("socket file was not removed: %v", err)
+	}
+}
@@ -1,12 +1,17 @@
 package sirencast
 
 import (
+	"errors"
 	"io"
 )
 
 const PeekBufferSize = 8192
 const PeekReadSize = 4096
 
+// ErrPeekLimit is returned by a Peeker that can't read more from its input
+// because it buffered as much as it is allowed to.
+var ErrPeekLimit = errors.New("sirencast: peek limit reached")
+
 type Peeker interface {
 	io.Reader
 	// Reset peeking position to the start
@@ -22,9 +27,15 @@ type PeekReader struct {
 	buffer     []byte
 	wpos, rpos int
 	stopped    bool
+	// limit is the maximum amount of bytes to buffer, no limit if zero
+	limit int
 }
 
 func NewPeeker(input io.Reader) Peeker {
+	return newPeekReader(input)
+}
+
+func newPeekReader(input io.Reader) *PeekReader {
 	return &PeekReader{
 		input:   input,
 		buffer:  nil,
@@ -54,6 +65,10 @@ func (pk *PeekReader) Read(p []byte) (n int, err error) {
 		return 0, io.EOF
 	}
 
+	if pk.limit > 0 && pk.wpos >= pk.limit {
+		return 0, ErrPeekLimit
+	}
+
 	// We ran out of bytes in the buffer, so instead get ready to
 	// read from the input reader.
 	var buffer []byte
@@ -63,6 +78,9 @@ func (pk *PeekReader) Read(p []byte) (n int, err error) {
 	}
 
 	buffer = pk.buffer[pk.wpos : pk.wpos+PeekReadSize]
+	if pk.limit > 0 && pk.wpos+len(buffer) > pk.limit {
+		buffer = buffer[:pk.limit-pk.wpos]
+	}
 
 	// Otherwise read from the original source
 	n, err = pk.input.Read(buffer)
@@ -79,6 +97,7 @@ func (pk *PeekReader) Read(p []byte) (n int, err error) {
 	}
 
 	copy(p, buffer[:n])
+	pk.rpos += n
 
 	return
 }
@@ -90,3 +109,10 @@ func (pk *PeekReader) Reset() {
 func (pk *PeekReader) Stop() {
 	pk.stopped = true
 }
+
+// discard drops everything read so far from the buffer, Reset returns to
+// the current position afterwards.
+func (pk *PeekReader) discard() {
+	n := copy(pk.buffer, pk.buffer[pk.rpos:pk.wpos])
+	pk.wpos, pk.rpos = n, 0
+}
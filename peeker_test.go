@@ -3,8 +3,10 @@ package sirencast
 import (
 	"bytes"
 	"io"
+	"io/ioutil"
 	"reflect"
 	"testing"
+	"testing/iotest"
 )
 
 var testData = []byte("abcdefghijklmnopqrstuvwxyz")
@@ -65,6 +67,37 @@ func TestPeekerStop(t *testing.T) {
 	}
 }
 
+// TestPeekerSmallReads tests that reads smaller than what the Peeker
+// read from its input continue where the previous read stopped.
+func TestPeekerSmallReads(t *testing.T) {
+	peek := NewPeeker(bytes.NewBuffer(testData))
+
+	got, _ := ioutil.ReadAll(io.LimitReader(iotest.OneByteReader(peek), 10))
+	if string(got) != string(testData[:10]) {
+		t.Errorf("peeker returned invalid data: %q", got)
+	}
+
+	peek.Reset()
+	peek.Stop()
+	if got, _ = ioutil.ReadAll(peek); string(got) != string(testData) {
+		t.Errorf("peeker returned invalid data after Reset: %q", got)
+	}
+}
+
+// TestPeekerLimit tests that a Peeker doesn't buffer more than its limit
+func TestPeekerLimit(t *testing.T) {
+	peek := newPeekReader(bytes.NewBuffer(testData))
+	peek.limit = 10
+
+	got, err := ioutil.ReadAll(peek)
+	if err != ErrPeekLimit {
+		t.Errorf("expected ErrPeekLimit, got %v", err)
+	}
+	if string(got) != string(testData[:10]) {
+		t.Errorf("peeker returned invalid data: %q", got)
+	}
+}
+
 func BenchmarkPeekerBuffer(b *testing.B) {
 	peeker := NewPeeker(bytes.NewBuffer(testData))
 	buf := make([]byte, 6)
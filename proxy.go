@@ -0,0 +1,161 @@
+package sirencast
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var (
+	proxyV1Signature = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// proxyV1MaxLength is the maximum length of a PROXY v1 header, including
+// the terminating CRLF.
+const proxyV1MaxLength = 107
+
+// errProxyHeader is returned for a PROXY header that can't be parsed
+var errProxyHeader = errors.New("sirencast: invalid PROXY protocol header")
+
+// trustedProxy returns true if addr is the address of a trusted proxy
+func (server *Server) trustedProxy(addr net.Addr) bool {
+	server.mu.Lock()
+	proxies := server.proxies
+	server.mu.Unlock()
+
+	if len(proxies) == 0 {
+		return false
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range proxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// readProxyHeader reads a PROXY protocol v1 or v2 header from the start of
+// p and returns the address of the client it names. The header is removed
+// from p, which is left unchanged if it doesn't start with a header.
+//
+// The address is nil for headers that don't name a client, such as the
+// health checks of the proxy.
+func readProxyHeader(p *PeekReader) (net.Addr, error) {
+	var (
+		sig = make([]byte, 0, len(proxyV2Signature))
+		b   = make([]byte, 1)
+	)
+
+	for len(sig) < len(proxyV2Signature) {
+		if _, err := io.ReadFull(p, b); err != nil {
+			p.Reset()
+			return nil, nil
+		}
+		sig = append(sig, b[0])
+
+		if bytes.Equal(sig, proxyV1Signature) {
+			return readProxyV1(p)
+		}
+		if !bytes.HasPrefix(proxyV1Signature, sig) && !bytes.HasPrefix(proxyV2Signature, sig) {
+			p.Reset()
+			return nil, nil
+		}
+	}
+	return readProxyV2(p)
+}
+
+// readProxyV1 reads the rest of a text header after its signature, such as
+// "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n".
+func readProxyV1(p *PeekReader) (net.Addr, error) {
+	line := make([]byte, 0, proxyV1MaxLength)
+	line = append(line, proxyV1Signature...)
+
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) == proxyV1MaxLength {
+			return nil, errProxyHeader
+		}
+		if _, err := io.ReadFull(p, b); err != nil {
+			return nil, err
+		}
+		line = append(line, b[0])
+	}
+	p.discard()
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errProxyHeader
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, errProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 reads the rest of a binary header after its signature
+func readProxyV2(p *PeekReader) (net.Addr, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(p, header); err != nil {
+		return nil, err
+	}
+
+	if header[0]>>4 != 2 {
+		return nil, errProxyHeader
+	}
+
+	// the address block is followed by optional TLVs, which we skip
+	block := make([]byte, binary.BigEndian.Uint16(header[2:4]))
+	if _, err := io.ReadFull(p, block); err != nil {
+		return nil, err
+	}
+	p.discard()
+
+	// LOCAL connections are made by the proxy itself
+	if header[0]&0xf == 0 {
+		return nil, nil
+	}
+	if header[0]&0xf != 1 {
+		return nil, errProxyHeader
+	}
+
+	var size int
+	switch header[1] >> 4 {
+	case 1: // AF_INET
+		size = net.IPv4len
+	case 2: // AF_INET6
+		size = net.IPv6len
+	default:
+		return nil, nil
+	}
+
+	// source and destination address, followed by their ports
+	if len(block) < 2*size+4 {
+		return nil, errProxyHeader
+	}
+	ip := make(net.IP, size)
+	copy(ip, block[:size])
+	port := binary.BigEndian.Uint16(block[2*size:])
+
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
@@ -0,0 +1,135 @@
+package sirencast
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Wessie/sirencast/config"
+)
+
+// proxyV2Header returns a PROXY v2 header for a client at ip:port
+func proxyV2Header(ip net.IP, port int) []byte {
+	family, dst := byte(0x11), net.IPv4(10, 0, 0, 1).To4()
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	} else {
+		family, dst = 0x21, net.IPv6loopback
+	}
+
+	block := append(append([]byte{}, ip...), dst...)
+	block = append(block, byte(port>>8), byte(port), 0x01, 0xbb)
+	// a TLV that has to be skipped
+	block = append(block, 0x04, 0x00, 0x01, 0xff)
+
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x21, family, 0, byte(len(block)))
+	return append(header, block...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  []byte
+		remote string
+		err    bool
+	}{
+		{"v1 tcp4", []byte("PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n"), "192.0.2.1:56324", false},
+		{"v1 tcp6", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 4000 443\r\n"), "[2001:db8::1]:4000", false},
+		{"v1 unknown", []byte("PROXY UNKNOWN\r\n"), "", false},
+		{"v1 invalid", []byte("PROXY TCP4 nonsense\r\n"), "", true},
+		{"v1 too long", append([]byte("PROXY "), bytes.Repeat([]byte{'a'}, 200)...), "", true},
+		{"v2 ipv4", proxyV2Header(net.IPv4(192, 0, 2, 1), 56324), "192.0.2.1:56324", false},
+		{"v2 ipv6", proxyV2Header(net.ParseIP("2001:db8::1"), 4000), "[2001:db8::1]:4000", false},
+		{"v2 local", append(append([]byte{}, proxyV2Signature...), 0x20, 0x00, 0, 0), "", false},
+		{"v2 version", append(append([]byte{}, proxyV2Signature...), 0x31, 0x11, 0, 0), "", true},
+	}
+
+	const rest = "GET / HTTP/1.0\r\n\r\n"
+	for _, test := range tests {
+		pk := newPeekReader(bytes.NewReader(append(test.input, rest...)))
+
+		addr, err := readProxyHeader(pk)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+			continue
+		}
+
+		var remote string
+		if addr != nil {
+			remote = addr.String()
+		}
+		if remote != test.remote {
+			t.Errorf("%s: expected %q, got %q", test.name, test.remote, remote)
+		}
+
+		// the header is gone, even after a Reset
+		pk.Reset()
+		pk.Stop()
+		if b, _ := ioutil.ReadAll(pk); string(b) != rest {
+			t.Errorf("%s: unexpected data after the header: %q", test.name, b)
+		}
+	}
+
+	// connections without a header are left alone
+	for _, input := range []string{rest, "PRO", "\r\n\r\nGET"} {
+		pk := newPeekReader(bytes.NewReader([]byte(input)))
+		if addr, err := readProxyHeader(pk); addr != nil || err != nil {
+			t.Errorf("%q: unexpected result %v %v", input, addr, err)
+		}
+
+		pk.Stop()
+		if b, _ := ioutil.ReadAll(pk); string(b) != input {
+			t.Errorf("%q: data was consumed: %q", input, b)
+		}
+	}
+}
+
+func TestServerProxy(t *testing.T) {
+	conf := &config.Config{
+		Addr:           "127.0.0.1:0",
+		TrustedProxies: []string{"127.0.0.0/8"},
+	}
+	server, addr, _ := startServerConfig(t, conf, handlerDetectors(func(c *Conn) {
+		defer c.Close()
+		bufio.NewReader(c).ReadString('\n')
+		c.Write([]byte(c.RemoteAddr().String() + "\n"))
+	}))
+	defer server.Shutdown(context.Background())
+
+	remoteOf := func(header string) string {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		c.Write([]byte(header + "hello\n"))
+		line, _ := bufio.NewReader(c).ReadString('\n')
+		return line
+	}
+
+	if got := remoteOf("PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n"); got != "192.0.2.1:56324\n" {
+		t.Errorf("unexpected address with a header: %q", got)
+	}
+	if got := remoteOf(""); got == "" || got == "192.0.2.1:56324\n" {
+		t.Errorf("unexpected address without a header: %q", got)
+	}
+
+	// headers from anyone else are passed on untouched
+	server.SetConfig(&config.Config{Addr: conf.Addr, TrustedProxies: []string{"192.0.2.0/24"}})
+	if got := remoteOf("PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n"); got == "192.0.2.1:56324\n" {
+		t.Errorf("header of an untrusted proxy was used")
+	}
+}
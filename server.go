@@ -1,47 +1,141 @@
 package sirencast
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
+	"log"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Wessie/sirencast/config"
 )
 
+// ErrServerClosed is returned by Server.Serve after a call to Shutdown
+var ErrServerClosed = errors.New("sirencast: server closed")
+
 type Server struct {
 	Config    *config.Config
 	Detectors *Detectors
-	listener  net.Listener
+
+	// mu protects the fields below
+	mu         sync.Mutex
+	listeners  []*listener
+	closing    bool
+	onShutdown []func()
+	handoffs   []func() []Handoff
+	resumers   map[string]Resumer
+	// proxies are the networks of trusted proxies
+	proxies []*net.IPNet
+	// detection are the counters of connections in detection
+	detection DetectionStats
+	// httpListener is the listener of the HTTP server started by Setup,
+	// if it has an address of its own, it is passed on by Upgrade under
+	// httpName.
+	httpListener net.Listener
+	httpName     string
+	// inherited are the listeners passed on by Upgrade that haven't been
+	// used yet, and upgrade the socket to the process that started us.
+	inherited map[string]net.Listener
+	upgrade   *net.UnixConn
+
+	inheritOnce sync.Once
+	inheritErr  error
+
+	// conns tracks the goroutines serving connections
+	conns sync.WaitGroup
+
+	// certs holds the []*tls.Certificate used for TLS connections
+	certs   atomic.Value
+	tlsOnce sync.Once
+	tlsConf *tls.Config
 }
 
 func SetupServer(e *config.Config) (*Server, error) {
 	s := &Server{
 		Config:    e,
 		Detectors: DefaultDetectors,
+		proxies:   e.ProxyNetworks(),
+	}
+
+	if err := s.loadCertificates(e); err != nil {
+		return nil, err
 	}
 
 	return s, nil
 }
 
+// SetConfig replaces the configuration of the server, settings that are
+// only used when the server starts, such as the address, don't change.
+// The TLS certificates are loaded again, the old ones are kept if that fails.
+func (server *Server) SetConfig(conf *config.Config) {
+	if err := server.loadCertificates(conf); err != nil {
+		log.Println("sirencast: failed to load TLS certificates:", err)
+	}
+
+	server.mu.Lock()
+	server.Config = conf
+	server.proxies = conf.ProxyNetworks()
+	server.mu.Unlock()
+}
+
 func (server *Server) Serve() (err error) {
-	addr, err := net.ResolveTCPAddr("tcp", server.Config.Addr)
+	ls, upgrade, err := server.listen()
 	if err != nil {
 		return err
 	}
+	defer func() {
+		for _, l := range ls {
+			l.Close()
+		}
+	}()
 
-	l, err := net.ListenTCP("tcp", addr)
-	if err != nil {
-		return err
+	server.mu.Lock()
+	if server.closing {
+		server.mu.Unlock()
+		return ErrServerClosed
 	}
-	defer l.Close()
+	server.listeners = ls
+	server.mu.Unlock()
 
-	server.listener = l
+	// We were started by Server.Upgrade, let the old process know
+	// we're ready to take over.
+	if upgrade != nil {
+		go server.completeUpgrade(upgrade)
+	}
+
+	errs := make(chan error, len(ls))
+	for _, l := range ls {
+		go func(l *listener) {
+			errs <- server.accept(l)
+		}(l)
+	}
+
+	// All listeners stop on Shutdown, if one stops for another
+	// reason we stop the others as well.
+	err = <-errs
+	for _, l := range ls {
+		l.Close()
+	}
+	for range ls[1:] {
+		<-errs
+	}
+	return err
+}
 
+// accept accepts connections on l until it is closed
+func (server *Server) accept(l *listener) error {
 	var tempDelay time.Duration
 	for {
 		conn, err := l.Accept()
 
 		if err != nil {
+			if server.shuttingDown() {
+				return ErrServerClosed
+			}
+
 			if ne, ok := err.(net.Error); ok && ne.Temporary() {
 				if tempDelay == 0 {
 					tempDelay = 5 * time.Millisecond
@@ -54,42 +148,162 @@ func (server *Server) Serve() (err error) {
 				}
 
 				time.Sleep(tempDelay)
+				continue
 			}
 			// Unrecoverable
 			return err
 		}
+		tempDelay = 0
 
-		c, err := server.newConn(conn)
-
-		if err != nil {
+		dc, ok := server.startDetection()
+		if !ok {
 			conn.Close()
 			continue
 		}
 
-		go c.serve()
+		// Detection waits for the client, so it can't block the
+		// accepting of new connections.
+		server.conns.Add(1)
+		go func(conn net.Conn) {
+			defer server.conns.Done()
+
+			c, err := server.newConn(conn, server.listenerConfig(l.conf), dc)
+			server.endDetection(err)
+
+			if err != nil {
+				conn.Close()
+				return
+			}
+			c.serve()
+		}(conn)
+	}
+}
+
+// RegisterOnShutdown registers a function to call on Shutdown. This can be
+// used by handlers to close connections they are still responsible for, the
+// function should return once these are closed.
+func (server *Server) RegisterOnShutdown(f func()) {
+	server.mu.Lock()
+	server.onShutdown = append(server.onShutdown, f)
+	server.mu.Unlock()
+}
+
+// Shutdown gracefully shuts down the server. It stops accepting new
+// connections, calls all functions registered with RegisterOnShutdown
+// and waits for them and all connection handlers to return.
+//
+// If the context expires before this is done Shutdown returns the
+// context error.
+func (server *Server) Shutdown(ctx context.Context) error {
+	server.mu.Lock()
+	server.closing = true
+	ls := server.listeners
+	funcs := server.onShutdown
+	server.mu.Unlock()
+
+	for _, l := range ls {
+		l.Close()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		var wg sync.WaitGroup
+		for _, f := range funcs {
+			wg.Add(1)
+			go func(f func()) {
+				defer wg.Done()
+				f()
+			}(f)
+		}
+		wg.Wait()
+
+		server.conns.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
 
+func (server *Server) shuttingDown() bool {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return server.closing
+}
+
 // newConn wraps the given connection into a Conn and tries
-// to find a handler suitable for the connection.
+// to find a handler suitable for the connection. A PROXY protocol
+// header from a trusted proxy is consumed first, and TLS connections
+// are decrypted when TLS is enabled on the listener lc. All of this
+// is limited as configured in dc.
 //
 // newConn will return an error if it is unable to find a handler.
-func (server *Server) newConn(c net.Conn) (*Conn, error) {
+func (server *Server) newConn(c net.Conn, lc config.Listener, dc config.Detection) (_ *Conn, err error) {
 	var (
-		p = NewPeeker(c)
-		h ConnHandler
+		pk            = newPeekReader(c)
+		p      Peeker = pk
+		h      ConnHandler
+		remote net.Addr
+		raw    = c
 	)
+	pk.limit = dc.Bytes()
+
+	deadline := time.Now().Add(dc.Timeout())
+	raw.SetDeadline(deadline)
+	defer func() {
+		// detectors that fail to read return no handler, so we
+		// find out about timeouts by the time instead.
+		if err != nil && !time.Now().Before(deadline) {
+			err = errDetectTimeout
+		}
+	}()
+
+	if server.trustedProxy(c.RemoteAddr()) {
+		if remote, err = readProxyHeader(pk); err != nil {
+			return nil, err
+		}
+	}
 
-	if h = server.Detectors.Detect(p); h == nil {
+	if lc.TLS != "" {
+		hello := isClientHello(p)
+		p.Reset()
+
+		switch {
+		case hello:
+			tc, err := server.startTLS(c, p)
+			if err != nil {
+				return nil, err
+			}
+			tp := newPeekReader(tc)
+			tp.limit = dc.Bytes()
+			c, p = tc, tp
+		case lc.TLS != config.TLSDetect:
+			return nil, errPlainConn
+		}
+	}
+
+	h = server.Detectors.detect(p, lc.Detectors)
+	// the Default handler would be called for connections that
+	// timed out as well.
+	if !time.Now().Before(deadline) {
+		return nil, errDetectTimeout
+	}
+	if h == nil {
 		return nil, errors.New("Unsupported stream")
 	}
 	p.Stop()
+	raw.SetDeadline(time.Time{})
 
 	return &Conn{
 		conn:    c,
 		start:   p,
 		reader:  p,
 		handler: h,
+		remote:  remote,
 	}, nil
 }
 
@@ -0,0 +1,120 @@
+package sirencast
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Wessie/sirencast/config"
+)
+
+// startServer starts serving a server with the handler given on a random
+// local port and returns the server, its address and the Serve result.
+func startServer(t *testing.T, handler ConnHandler) (*Server, string, chan error) {
+	return startServerConfig(t, &config.Config{Addr: "127.0.0.1:0"}, handlerDetectors(handler))
+}
+
+// handlerDetectors returns detectors that pass every connection to handler
+func handlerDetectors(handler ConnHandler) *Detectors {
+	ds := NewDetectors()
+	ds.Register(func(io.Reader) ConnHandler { return handler })
+	return ds
+}
+
+// startServerConfig is startServer with the configuration and detectors given
+func startServerConfig(t *testing.T, conf *config.Config, ds *Detectors) (*Server, string, chan error) {
+	server, err := SetupServer(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Detectors = ds
+
+	served := make(chan error, 1)
+	go func() { served <- server.Serve() }()
+
+	for i := 0; i < 100; i++ {
+		server.mu.Lock()
+		ls := server.listeners
+		server.mu.Unlock()
+
+		if len(ls) > 0 {
+			return server, ls[0].Addr().String(), served
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatal("server did not start listening")
+	return nil, "", nil
+}
+
+func TestServerShutdown(t *testing.T) {
+	var (
+		handling = make(chan struct{})
+		release  = make(chan struct{})
+		closed   = make(chan struct{})
+	)
+
+	server, addr, served := startServer(t, func(c *Conn) {
+		close(handling)
+		<-release
+		close(closed)
+	})
+	server.RegisterOnShutdown(func() { close(release) })
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	<-handling
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatal("shutdown returned error:", err)
+	}
+
+	select {
+	case <-closed:
+	default:
+		t.Error("shutdown returned before handler finished")
+	}
+
+	if err := <-served; err != ErrServerClosed {
+		t.Error("serve returned unexpected error:", err)
+	}
+
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Error("server still accepting connections after shutdown")
+	}
+}
+
+func TestServerShutdownTimeout(t *testing.T) {
+	var (
+		handling = make(chan struct{})
+		release  = make(chan struct{})
+	)
+	defer close(release)
+
+	server, addr, _ := startServer(t, func(c *Conn) {
+		close(handling)
+		<-release
+	})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	<-handling
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Error("shutdown did not time out:", err)
+	}
+}
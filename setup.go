@@ -1,48 +1,78 @@
 package sirencast
 
 import (
-	"errors"
+	"context"
 	"log"
 	"net"
 	"net/http"
-
-	"github.com/Wessie/sirencast/config"
 )
 
-func Setup() (*config.Config, error) {
-	if !config.Loaded {
-		return nil, errors.New("unable to load configuration")
-	}
+// Setup starts the HTTP server included with sirencast as configured for
+// server, it is either served on its own address or on the address of the
+// sirencast server for connections no detector claims. The HTTP server is
+// shut down along with server, and its listener is passed on by
+// Server.Upgrade. Setup should be called before Server.Serve.
+func Setup(server *Server) error {
+	server.mu.Lock()
+	conf := server.Config
+	server.mu.Unlock()
 
 	// TODO: Move all of this into reusable functions
 	// Setup a listener for HTTP requests
-	if config.Active.HTTP.Disabled {
-		return config.Active, nil
+	if conf.HTTP.Disabled {
+		return nil
 	}
 
 	var l net.Listener
 	// Setup a protocol detector default and a fake listener
 	// for HTTP if the configuration tells us to not run the
 	// HTTP server on a different address.
-	if config.Active.HTTP.Addr == "" {
-		httpListener := NewHTTPListener(config.Active.Addr)
-		DefaultDetectors.Default = httpListener.Handler
+	if conf.HTTP.Addr == "" {
+		httpListener := NewHTTPListener(conf.Addr)
+		server.Detectors.Default = httpListener.Handler
 		l = httpListener
 	} else {
+		name := httpListenerName(conf.HTTP.Addr)
+
 		var err error
-		l, err = net.Listen("tcp", config.Active.HTTP.Addr)
-		if err != nil {
-			log.Printf("http: unable to listen on '%s': %s\n", config.Active.HTTP.Addr, err)
+		if l, err = server.inheritedListener(name); err != nil {
+			return err
 		}
+		if l == nil {
+			l, err = net.Listen("tcp", conf.HTTP.Addr)
+			if err != nil {
+				log.Printf("http: unable to listen on '%s': %s\n", conf.HTTP.Addr, err)
+				return err
+			}
+		}
+
+		server.mu.Lock()
+		server.httpListener, server.httpName = l, name
+		server.mu.Unlock()
 	}
 	log.Printf("http: server listening on '%s'\n", l.Addr())
 
+	srv := new(http.Server)
+	server.RegisterOnShutdown(func() {
+		// closes l and waits for requests in progress
+		if err := srv.Shutdown(context.Background()); err != nil {
+			log.Println("http: shutdown failed:", err)
+		}
+	})
+
 	go func() {
-		if err := http.Serve(l, nil); err != nil {
+		if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
 			log.Println("http: server exited error:", err)
+			return
 		}
 		log.Println("http: server stopped gracefully")
 	}()
 
-	return config.Active, nil
+	return nil
+}
+
+// httpListenerName is the name the listener of the HTTP server on addr is
+// passed on under by Server.Upgrade.
+func httpListenerName(addr string) string {
+	return "http:" + addr
 }
@@ -0,0 +1,45 @@
+package sirencast
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Wessie/sirencast/config"
+)
+
+func TestSetupShutdown(t *testing.T) {
+	server, err := SetupServer(&config.Config{
+		Addr: "127.0.0.1:0",
+		HTTP: config.HTTPServer{Addr: "127.0.0.1:0"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Setup(server); err != nil {
+		t.Fatal(err)
+	}
+
+	server.mu.Lock()
+	addr := server.httpListener.Addr().String()
+	server.mu.Unlock()
+
+	resp, err := http.Get("http://" + addr + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatal("shutdown returned error:", err)
+	}
+
+	if c, err := net.Dial("tcp", addr); err == nil {
+		c.Close()
+		t.Error("HTTP server still accepts connections after shutdown")
+	}
+}
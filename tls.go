@@ -0,0 +1,108 @@
+package sirencast
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+
+	"github.com/Wessie/sirencast/config"
+)
+
+// errPlainConn is returned by newConn for a connection that doesn't start
+// with a TLS handshake while TLS is required.
+var errPlainConn = errors.New("sirencast: plain connection while TLS is required")
+
+// errTLSHandoff is returned when handing off a TLS connection on an upgrade
+var errTLSHandoff = errors.New("sirencast: TLS connections can't be handed off")
+
+// readCertificates loads the certificate and key pairs given, the leaf of
+// each certificate is parsed so it can be matched against a server name.
+func readCertificates(conf []config.Certificate) ([]*tls.Certificate, error) {
+	certs := make([]*tls.Certificate, 0, len(conf))
+	for _, c := range conf {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		if cert.Leaf == nil {
+			if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+				return nil, err
+			}
+		}
+		certs = append(certs, &cert)
+	}
+	return certs, nil
+}
+
+// loadCertificates replaces the certificates used for new TLS connections
+// with the ones configured in conf, the old ones are kept on an error.
+func (server *Server) loadCertificates(conf *config.Config) error {
+	certs, err := readCertificates(conf.TLS.Certificates)
+	if err != nil {
+		return err
+	}
+
+	server.certs.Store(certs)
+	return nil
+}
+
+// tlsConfig returns the tls.Config used for all TLS connections, it is
+// shared so that sessions can be resumed.
+func (server *Server) tlsConfig() *tls.Config {
+	server.tlsOnce.Do(func() {
+		server.tlsConf = &tls.Config{
+			GetCertificate: server.getCertificate,
+		}
+	})
+	return server.tlsConf
+}
+
+// getCertificate returns the first certificate that is valid for the
+// server name asked for by the client, or the first certificate if none is.
+func (server *Server) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	certs, _ := server.certs.Load().([]*tls.Certificate)
+	if len(certs) == 0 {
+		return nil, errors.New("sirencast: no TLS certificates loaded")
+	}
+
+	if hello.ServerName != "" {
+		for _, cert := range certs {
+			if cert.Leaf.VerifyHostname(hello.ServerName) == nil {
+				return cert, nil
+			}
+		}
+	}
+	return certs[0], nil
+}
+
+// isClientHello returns true if r starts with a TLS handshake record, which
+// is what a client sends first.
+func isClientHello(r io.Reader) bool {
+	var header [3]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return false
+	}
+
+	// content type handshake, followed by the major version of TLS
+	return header[0] == 0x16 && header[1] == 0x03
+}
+
+// startTLS performs the TLS handshake on c, p is the peeker used on c
+// that holds the start of the handshake. The handshake is limited by the
+// deadline of c.
+func (server *Server) startTLS(c net.Conn, p Peeker) (*tls.Conn, error) {
+	p.Stop()
+	tc := tls.Server(&Conn{
+		conn:   c,
+		start:  p,
+		reader: p,
+	}, server.tlsConfig())
+
+	if err := tc.Handshake(); err != nil {
+		return nil, err
+	}
+	return tc, nil
+}
@@ -0,0 +1,174 @@
+package sirencast
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Wessie/sirencast/config"
+)
+
+// writeCertificate writes a self-signed certificate for name and its key
+// to dir, and returns them as configuration.
+func writeCertificate(t *testing.T, dir, name string) config.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert := config.Certificate{
+		CertFile: filepath.Join(dir, name+".pem"),
+		KeyFile:  filepath.Join(dir, name+".key"),
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	if err := ioutil.WriteFile(cert.CertFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(cert.KeyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// echoLine is a handler that writes back the first line it reads
+func echoLine(c *Conn) {
+	defer c.Close()
+
+	line, err := bufio.NewReader(c).ReadString('\n')
+	if err != nil {
+		return
+	}
+	c.Write([]byte(line))
+}
+
+// roundTrip sends a line over c and returns the line send back
+func roundTrip(t *testing.T, c net.Conn) string {
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Write([]byte("hello\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	line, _ := bufio.NewReader(c).ReadString('\n')
+	return line
+}
+
+// dialTLS connects to addr with TLS and returns the name of the
+// certificate the server used, and the line echoed back.
+func dialTLS(t *testing.T, addr, name string) (string, string) {
+	c, err := tls.Dial("tcp", addr, &tls.Config{
+		ServerName:         name,
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	line := roundTrip(t, c)
+	return c.ConnectionState().PeerCertificates[0].Subject.CommonName, line
+}
+
+func TestServerTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sirencast-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a := writeCertificate(t, dir, "a.example")
+	b := writeCertificate(t, dir, "b.example")
+
+	conf := &config.Config{
+		Addr: "127.0.0.1:0",
+		TLS: config.TLS{
+			Certificates: []config.Certificate{a, b},
+			Detect:       true,
+		},
+	}
+	server, addr, _ := startServerConfig(t, conf, handlerDetectors(echoLine))
+	defer server.Shutdown(context.Background())
+
+	for _, name := range []string{"a.example", "b.example"} {
+		got, line := dialTLS(t, addr, name)
+		if got != name {
+			t.Errorf("expected the certificate for %s, got %s", name, got)
+		}
+		if line != "hello\n" {
+			t.Errorf("unexpected reply over TLS: %q", line)
+		}
+	}
+
+	// an unknown name gets the first certificate
+	if got, _ := dialTLS(t, addr, "c.example"); got != "a.example" {
+		t.Errorf("expected the first certificate, got %s", got)
+	}
+
+	plain, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line := roundTrip(t, plain); line != "hello\n" {
+		t.Errorf("unexpected reply without TLS: %q", line)
+	}
+	plain.Close()
+
+	// reloading picks up new certificates and can require TLS
+	server.SetConfig(&config.Config{
+		Addr: conf.Addr,
+		TLS:  config.TLS{Certificates: []config.Certificate{b}},
+	})
+
+	if got, _ := dialTLS(t, addr, "a.example"); got != "b.example" {
+		t.Errorf("expected the reloaded certificate, got %s", got)
+	}
+
+	plain, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line := roundTrip(t, plain); line != "" {
+		t.Errorf("plain connection was served while TLS is required: %q", line)
+	}
+	plain.Close()
+
+	// a broken certificate keeps the loaded ones
+	server.SetConfig(&config.Config{
+		Addr: conf.Addr,
+		TLS:  config.TLS{Certificates: []config.Certificate{{CertFile: "missing", KeyFile: "missing"}}},
+	})
+
+	if got, _ := dialTLS(t, addr, "b.example"); got != "b.example" {
+		t.Errorf("expected the old certificate, got %s", got)
+	}
+}
@@ -0,0 +1,89 @@
+package sirencast
+
+import (
+	"errors"
+	"net"
+)
+
+// ErrUpgradeUnsupported is returned by Server.Upgrade on platforms that
+// can't pass file descriptors to a new process.
+var ErrUpgradeUnsupported = errors.New("sirencast: upgrade not supported on this platform")
+
+// Handoff is a live connection that is passed to the new process on an
+// upgrade, the connection is resumed in the new process by the Resumer
+// registered for Kind.
+type Handoff struct {
+	// Kind is the name of the Resumer to pass the connection to
+	Kind string
+	// State is handler specific state required to resume the connection
+	State []byte
+	// Pending is data that was already read from the connection but not
+	// yet handled, the new process will read this before anything else.
+	Pending []byte
+	// Conn is the connection to hand off, it is closed in the current
+	// process after it has been passed to the new process.
+	Conn net.Conn
+}
+
+// Resumer resumes a connection handed off by a previous process, state is
+// the State of the Handoff the connection was passed with.
+type Resumer func(conn *Conn, state []byte)
+
+// handoffMessage is the description of a Handoff send to the new process
+type handoffMessage struct {
+	Kind    string
+	State   []byte
+	Pending []byte
+	// Remote is the address of the client if it was given by a PROXY
+	// protocol header, and empty otherwise.
+	Remote string `json:",omitempty"`
+}
+
+// RegisterHandoff registers a function that returns the connections to hand
+// off to the new process on an upgrade. The function is only called if
+// handing off connections is enabled in the configuration, and should stop
+// using the connections before returning them.
+func (server *Server) RegisterHandoff(f func() []Handoff) {
+	server.mu.Lock()
+	server.handoffs = append(server.handoffs, f)
+	server.mu.Unlock()
+}
+
+// RegisterResumer registers the Resumer to use for handed off connections
+// of the kind given.
+func (server *Server) RegisterResumer(kind string, r Resumer) {
+	server.mu.Lock()
+	if server.resumers == nil {
+		server.resumers = make(map[string]Resumer)
+	}
+	server.resumers[kind] = r
+	server.mu.Unlock()
+}
+
+// resumeConn serves a handed off connection with the Resumer registered
+// for its kind, the connection is closed if no Resumer is known.
+func (server *Server) resumeConn(c net.Conn, msg handoffMessage) {
+	server.mu.Lock()
+	resume := server.resumers[msg.Kind]
+	server.mu.Unlock()
+
+	if resume == nil {
+		c.Close()
+		return
+	}
+
+	conn := newResumedConn(c, msg.Pending, func(conn *Conn) {
+		resume(conn, msg.State)
+	})
+	if msg.Remote != "" {
+		if addr, err := net.ResolveTCPAddr("tcp", msg.Remote); err == nil {
+			conn.remote = addr
+		}
+	}
+
+	server.conns.Add(1)
+	go func() {
+		defer server.conns.Done()
+		conn.serve()
+	}()
+}
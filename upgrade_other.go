@@ -0,0 +1,21 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package sirencast
+
+import (
+	"context"
+	"net"
+)
+
+// Upgrade is not supported on this platform and always returns
+// ErrUpgradeUnsupported.
+func (server *Server) Upgrade(ctx context.Context) error {
+	return ErrUpgradeUnsupported
+}
+
+func inheritedListeners() (map[string]net.Listener, *net.UnixConn, error) {
+	return nil, nil, nil
+}
+
+func (server *Server) completeUpgrade(uc *net.UnixConn) {}
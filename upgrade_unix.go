@@ -0,0 +1,362 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package sirencast
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+const (
+	// envUpgrade is set in the environment of a process started by Upgrade,
+	// it holds the JSON list of the listeners passed on. It doesn't use the
+	// SIRENCAST_ prefix as that is reserved for configuration overrides.
+	envUpgrade = "_SIRENCAST_UPGRADE"
+	// upgradeSocketFD is the file descriptor of the socket connected to
+	// the process that started us, used to receive handed off connections.
+	upgradeSocketFD = 3
+	// upgradeListenerFD is the file descriptor of the first inherited
+	// listener, the others follow it in the order of envUpgrade.
+	upgradeListenerFD = 4
+)
+
+// filer is implemented by the net package listeners and connections
+type filer interface {
+	File() (*os.File, error)
+}
+
+// Upgrade starts a new process of the current executable with the same
+// arguments and passes the listening sockets to it. Once the new process is
+// accepting connections the server stops accepting, hands off its live
+// connections if enabled in the configuration, and shuts down gracefully.
+//
+// If the new process fails to start before the context expires it is killed
+// and the server keeps serving as if Upgrade was never called.
+func (server *Server) Upgrade(ctx context.Context) error {
+	server.mu.Lock()
+	ls, closing := server.listeners, server.closing
+	httpListener, httpName := server.httpListener, server.httpName
+	server.mu.Unlock()
+
+	if len(ls) == 0 || closing {
+		return errors.New("sirencast: upgrade on server that isn't serving")
+	}
+
+	var (
+		files = make([]*os.File, 0, len(ls)+1)
+		names = make([]string, 0, len(ls)+1)
+	)
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	pass := func(l net.Listener, name string) error {
+		fl, ok := l.(filer)
+		if !ok {
+			return ErrUpgradeUnsupported
+		}
+
+		lf, err := fl.File()
+		if err != nil {
+			return err
+		}
+		files = append(files, lf)
+		names = append(names, name)
+		return nil
+	}
+
+	for _, l := range ls {
+		if err := pass(l.Listener, l.conf.String()); err != nil {
+			return err
+		}
+	}
+	// The HTTP server of Setup stops accepting once we shut down
+	if httpListener != nil {
+		if err := pass(httpListener, httpName); err != nil {
+			return err
+		}
+	}
+
+	env, err := json.Marshal(names)
+	if err != nil {
+		return err
+	}
+
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return err
+	}
+	childSock := os.NewFile(uintptr(fds[1]), "upgrade-child")
+	defer childSock.Close()
+
+	parentSock := os.NewFile(uintptr(fds[0]), "upgrade-parent")
+	sc, err := net.FileConn(parentSock)
+	parentSock.Close()
+	if err != nil {
+		return err
+	}
+	uc := sc.(*net.UnixConn)
+	defer uc.Close()
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), envUpgrade+"="+string(env))
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = append([]*os.File{childSock}, files...)
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	childSock.Close()
+
+	// The new process sends a single byte once it is accepting connections
+	if deadline, ok := ctx.Deadline(); ok {
+		uc.SetDeadline(deadline)
+	}
+
+	if _, err := io.ReadFull(uc, make([]byte, 1)); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return fmt.Errorf("sirencast: upgraded process did not become ready: %s", err)
+	}
+	log.Printf("sirencast: upgraded to process %d", cmd.Process.Pid)
+	cmd.Process.Release()
+
+	// The new process is accepting on the same socket, so we can stop
+	server.mu.Lock()
+	server.closing = true
+	handoffs := server.handoffs
+	handoffConns := server.Config.HandoffConnections
+	server.mu.Unlock()
+
+	for _, l := range ls {
+		// the socket file is used by the new process now
+		if ul, ok := l.Listener.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+		l.Close()
+	}
+
+	if handoffConns {
+		uc.SetDeadline(time.Time{})
+		for _, f := range handoffs {
+			for _, h := range f() {
+				if err := sendHandoff(uc, h); err != nil {
+					log.Printf("sirencast: failed to hand off %s connection: %s", h.Kind, err)
+				}
+				h.Conn.Close()
+			}
+		}
+	}
+	uc.Close()
+
+	return server.Shutdown(ctx)
+}
+
+// sendHandoff passes a single connection to the new process over uc, this
+// is a length prefixed JSON handoffMessage with the file descriptor of the
+// connection attached.
+func sendHandoff(uc *net.UnixConn, h Handoff) error {
+	var (
+		pending []byte
+		remote  string
+		c       = h.Conn
+	)
+
+	// Unwrap our own connections, they can have peeked data left
+	if sc, ok := c.(*Conn); ok {
+		pending = sc.unread()
+		c = sc.conn
+		if sc.remote != nil {
+			remote = sc.remote.String()
+		}
+	}
+
+	// The TLS session state lives in this process
+	if _, ok := c.(*tls.Conn); ok {
+		return errTLSHandoff
+	}
+
+	fc, ok := c.(filer)
+	if !ok {
+		return ErrUpgradeUnsupported
+	}
+
+	f, err := fc.File()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	data, err := json.Marshal(handoffMessage{
+		Kind:    h.Kind,
+		State:   h.State,
+		Pending: append(h.Pending, pending...),
+		Remote:  remote,
+	})
+	if err != nil {
+		return err
+	}
+
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, uint32(len(data)))
+
+	// The file descriptor is attached to the length prefix
+	if _, _, err = uc.WriteMsgUnix(header, syscall.UnixRights(int(f.Fd())), nil); err != nil {
+		return err
+	}
+
+	_, err = uc.Write(data)
+	return err
+}
+
+// receiveHandoffs receives connections send with sendHandoff until uc
+// is closed by the other side.
+func (server *Server) receiveHandoffs(uc *net.UnixConn) {
+	var (
+		header = make([]byte, 4)
+		oob    = make([]byte, syscall.CmsgSpace(4))
+	)
+
+	for {
+		n, oobn, _, _, err := uc.ReadMsgUnix(header, oob)
+		if err != nil {
+			if err != io.EOF {
+				log.Println("sirencast: failed to receive handoff:", err)
+			}
+			return
+		}
+
+		if _, err = io.ReadFull(uc, header[n:]); err != nil {
+			log.Println("sirencast: failed to receive handoff:", err)
+			return
+		}
+
+		data := make([]byte, binary.BigEndian.Uint32(header))
+		if _, err = io.ReadFull(uc, data); err != nil {
+			log.Println("sirencast: failed to receive handoff:", err)
+			return
+		}
+
+		c, err := handoffConn(oob[:oobn])
+		if err != nil {
+			log.Println("sirencast: invalid handoff connection:", err)
+			continue
+		}
+
+		var msg handoffMessage
+		if err = json.Unmarshal(data, &msg); err != nil {
+			log.Println("sirencast: invalid handoff message:", err)
+			c.Close()
+			continue
+		}
+
+		server.resumeConn(c, msg)
+	}
+}
+
+// handoffConn returns the connection passed in the control message given
+func handoffConn(oob []byte) (net.Conn, error) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(msgs) != 1 {
+		return nil, errors.New("unexpected amount of control messages")
+	}
+
+	fds, err := syscall.ParseUnixRights(&msgs[0])
+	if err != nil {
+		return nil, err
+	}
+
+	if len(fds) != 1 {
+		for _, fd := range fds {
+			syscall.Close(fd)
+		}
+		return nil, errors.New("unexpected amount of file descriptors")
+	}
+
+	f := os.NewFile(uintptr(fds[0]), "handoff")
+	defer f.Close()
+
+	return net.FileConn(f)
+}
+
+// inheritedListeners returns the listeners passed to us by Upgrade by the
+// name of their configuration, or nil if we weren't started by Upgrade. The
+// socket used for receiving handed off connections is returned along with it.
+func inheritedListeners() (map[string]net.Listener, *net.UnixConn, error) {
+	env, ok := os.LookupEnv(envUpgrade)
+	if !ok {
+		return nil, nil, nil
+	}
+	// Don't pass this on to any processes we start ourselves
+	os.Unsetenv(envUpgrade)
+
+	var names []string
+	if err := json.Unmarshal([]byte(env), &names); err != nil {
+		return nil, nil, fmt.Errorf("sirencast: invalid %s: %s", envUpgrade, err)
+	}
+
+	ls := make(map[string]net.Listener, len(names))
+	for i, name := range names {
+		lf := os.NewFile(uintptr(upgradeListenerFD+i), "listener")
+		l, err := net.FileListener(lf)
+		lf.Close()
+		if err != nil {
+			closeListeners(ls)
+			return nil, nil, err
+		}
+		ls[name] = l
+	}
+
+	sf := os.NewFile(upgradeSocketFD, "upgrade-socket")
+	sc, err := net.FileConn(sf)
+	sf.Close()
+	if err != nil {
+		closeListeners(ls)
+		return nil, nil, err
+	}
+
+	uc, ok := sc.(*net.UnixConn)
+	if !ok {
+		closeListeners(ls)
+		sc.Close()
+		return nil, nil, errors.New("sirencast: inherited upgrade socket is not a unix socket")
+	}
+
+	return ls, uc, nil
+}
+
+// completeUpgrade signals the process that started us that we are accepting
+// connections and resumes the connections it hands off to us.
+func (server *Server) completeUpgrade(uc *net.UnixConn) {
+	defer uc.Close()
+
+	if _, err := uc.Write([]byte{1}); err != nil {
+		log.Println("sirencast: failed to signal upgrade readiness:", err)
+		return
+	}
+
+	server.receiveHandoffs(uc)
+}
@@ -0,0 +1,311 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package sirencast
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Wessie/sirencast/config"
+)
+
+// TestMain runs the server of TestUpgradeProcess instead of the tests if
+// we were started by Server.Upgrade.
+func TestMain(m *testing.M) {
+	http.HandleFunc("/upgrade-test", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strconv.Itoa(os.Getpid())))
+	})
+
+	if _, ok := os.LookupEnv(envUpgrade); ok {
+		os.Exit(upgradeChild())
+	}
+	os.Exit(m.Run())
+}
+
+// upgradeServer returns the server used on both sides of an upgrade by
+// TestUpgradeProcess. Every line send to it is answered with the pid of
+// the process handling it, until a line "exit" is send which closes exit.
+func upgradeServer(exit chan struct{}) (*Server, error) {
+	server, err := SetupServer(&config.Config{
+		Addr:               "127.0.0.1:0",
+		HTTP:               config.HTTPServer{Addr: "127.0.0.1:0"},
+		HandoffConnections: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		mu    sync.Mutex
+		conns = make(map[*Conn]bool)
+		once  sync.Once
+	)
+
+	handle := func(c *Conn) {
+		mu.Lock()
+		conns[c] = true
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			delete(conns, c)
+			mu.Unlock()
+			c.Close()
+		}()
+
+		br := bufio.NewReader(c)
+		for {
+			line, err := br.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if line == "exit\n" {
+				once.Do(func() { close(exit) })
+				return
+			}
+			c.Write([]byte(strconv.Itoa(os.Getpid()) + "\n"))
+		}
+	}
+
+	server.Detectors = handlerDetectors(handle)
+	server.RegisterResumer("test", func(c *Conn, state []byte) { handle(c) })
+	server.RegisterHandoff(func() []Handoff {
+		mu.Lock()
+		defer mu.Unlock()
+
+		var hs []Handoff
+		for c := range conns {
+			hs = append(hs, Handoff{Kind: "test", Conn: c})
+		}
+		return hs
+	})
+
+	if err := Setup(server); err != nil {
+		return nil, err
+	}
+	return server, nil
+}
+
+// upgradeChild runs the new process of TestUpgradeProcess until it is
+// told to exit, or gives up after a while.
+func upgradeChild() int {
+	exit := make(chan struct{})
+	server, err := upgradeServer(exit)
+	if err != nil {
+		log.Println("upgrade child:", err)
+		return 1
+	}
+	go server.Serve()
+
+	select {
+	case <-exit:
+	case <-time.After(30 * time.Second):
+		log.Println("upgrade child: timed out")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	server.Shutdown(ctx)
+	return 0
+}
+
+// unixPair returns both ends of a connected unix socket pair
+func unixPair(t *testing.T) (*net.UnixConn, *net.UnixConn) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conns := make([]*net.UnixConn, 2)
+	for i, fd := range fds {
+		f := os.NewFile(uintptr(fd), "pair")
+		c, err := net.FileConn(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns[i] = c.(*net.UnixConn)
+	}
+	return conns[0], conns[1]
+}
+
+// tcpPair returns both ends of a connected TCP connection
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+func TestUpgradeHandoff(t *testing.T) {
+	type result struct {
+		state string
+		data  string
+		addr  string
+	}
+
+	var (
+		parent, child = unixPair(t)
+		client, conn  = tcpPair(t)
+		resumed       = make(chan result, 1)
+		server        = &Server{}
+	)
+	defer client.Close()
+
+	server.RegisterResumer("test", func(c *Conn, state []byte) {
+		defer c.Close()
+		data, _ := ioutil.ReadAll(c)
+		resumed <- result{string(state), string(data), c.RemoteAddr().String()}
+	})
+
+	go server.receiveHandoffs(child)
+
+	// wrap the connection like Server.newConn would, with some peeked data left
+	p := NewPeeker(strings.NewReader("peeked "))
+	p.Read(make([]byte, 16))
+	p.Reset()
+	p.Stop()
+	sc := &Conn{conn: conn, start: p, reader: p}
+
+	err := sendHandoff(parent, Handoff{
+		Kind:    "test",
+		State:   []byte("state"),
+		Pending: []byte("pending "),
+		Conn:    sc,
+	})
+	if err != nil {
+		t.Fatal("failed to send handoff:", err)
+	}
+	sc.Close()
+	parent.Close()
+
+	client.Write([]byte("and live data"))
+	client.(*net.TCPConn).CloseWrite()
+
+	select {
+	case r := <-resumed:
+		if r.state != "state" {
+			t.Errorf("unexpected state: %q", r.state)
+		}
+
+		if r.data != "pending peeked and live data" {
+			t.Errorf("unexpected data: %q", r.data)
+		}
+
+		if r.addr != client.LocalAddr().String() {
+			t.Errorf("unexpected remote address: %s != %s", r.addr, client.LocalAddr())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("connection was not resumed")
+	}
+}
+
+func TestUpgradeProcess(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts a new process")
+	}
+
+	server, err := upgradeServer(make(chan struct{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	served := make(chan error, 1)
+	go func() { served <- server.Serve() }()
+
+	var addr string
+	for i := 0; i < 100 && addr == ""; i++ {
+		time.Sleep(10 * time.Millisecond)
+		server.mu.Lock()
+		if len(server.listeners) > 0 {
+			addr = server.listeners[0].Addr().String()
+		}
+		server.mu.Unlock()
+	}
+	if addr == "" {
+		t.Fatal("server did not start listening")
+	}
+
+	server.mu.Lock()
+	httpAddr := server.httpListener.Addr().String()
+	server.mu.Unlock()
+
+	pid := strconv.Itoa(os.Getpid())
+	ask := func(c net.Conn, br *bufio.Reader) string {
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		c.Write([]byte("pid\n"))
+		line, _ := br.ReadString('\n')
+		return strings.TrimSpace(line)
+	}
+
+	live, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer live.Close()
+	liveReader := bufio.NewReader(live)
+
+	if got := ask(live, liveReader); got != pid {
+		t.Fatalf("connection not served by us before the upgrade: %q", got)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Upgrade(ctx); err != nil {
+		t.Fatal("upgrade failed:", err)
+	}
+
+	if err := <-served; err != ErrServerClosed {
+		t.Errorf("unexpected Serve result: %v", err)
+	}
+
+	// the live connection was handed off to the new process
+	child := ask(live, liveReader)
+	if child == "" || child == pid {
+		t.Fatalf("live connection not resumed by the new process: %q", child)
+	}
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("new process isn't accepting:", err)
+	}
+	defer c.Close()
+	if got := ask(c, bufio.NewReader(c)); got != child {
+		t.Errorf("new connection served by %q instead of %s", got, child)
+	}
+
+	resp, err := http.Get("http://" + httpAddr + "/upgrade-test")
+	if err != nil {
+		t.Fatal("new process isn't serving HTTP:", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != child {
+		t.Errorf("HTTP request served by %q instead of %s", body, child)
+	}
+
+	c.Write([]byte("exit\n"))
+}
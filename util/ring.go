@@ -2,6 +2,7 @@ package util
 
 import (
 	"io"
+	"sync"
 	"sync/atomic"
 )
 
@@ -19,6 +20,10 @@ type RingBuffer struct {
 	bufCache  []byte
 	buf       chan []byte
 	dropped   uint64
+
+	// done is closed when Close is called to wake up a blocked reader
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
 // NewRingBuffer allocates a new RingBuffer with the given amount
@@ -26,7 +31,8 @@ type RingBuffer struct {
 // suggested to wrap the RingBuffer with the bufio package.
 func NewRingBuffer(spots int) *RingBuffer {
 	return &RingBuffer{
-		buf: make(chan []byte, spots),
+		buf:  make(chan []byte, spots),
+		done: make(chan struct{}),
 	}
 }
 
@@ -65,15 +71,21 @@ loop:
 }
 
 // Read reads from buffer, if no data is available Read waits
-// until there is some available.
+// until there is some available. Data written before Close is
+// still returned, io.EOF is only returned once it has been read.
 func (r *RingBuffer) Read(p []byte) (n int, err error) {
-	if atomic.LoadInt32(&r.closed) == 1 {
-		return 0, io.EOF
-	}
-
 	var b = r.readCache
 	if len(b) == 0 {
-		b = <-r.buf
+		select {
+		case b = <-r.buf:
+		case <-r.done:
+			// drain what was written before we were closed
+			select {
+			case b = <-r.buf:
+			default:
+				return 0, io.EOF
+			}
+		}
 		r.bufCache = b
 	}
 
@@ -92,9 +104,11 @@ func (r *RingBuffer) Read(p []byte) (n int, err error) {
 	return n, nil
 }
 
-// Close marks the buffer as closed, all following read and writes
-// will return an EOF error.
+// Close marks the buffer as closed, all following writes will return
+// an EOF error and reads will once the buffered data is read. A Read
+// blocked waiting for data returns immediately.
 func (r *RingBuffer) Close() error {
 	atomic.StoreInt32(&r.closed, 1)
+	r.closeOnce.Do(func() { close(r.done) })
 	return nil
 }
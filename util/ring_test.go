@@ -1,6 +1,7 @@
 package util
 
 import (
+	"io"
 	"testing"
 	"time"
 )
@@ -156,3 +157,61 @@ func BenchmarkRingWrite16ChunkedRead(b *testing.B) {
 		}
 	}
 }
+
+// TestRingCloseWakesReader tests that a blocked Read returns when
+// the buffer is closed.
+func TestRingCloseWakesReader(t *testing.T) {
+	var (
+		r    = NewRingBuffer(2)
+		done = make(chan error)
+	)
+
+	go func() {
+		_, err := r.Read(make([]byte, 16))
+		done <- err
+	}()
+
+	time.Sleep(time.Millisecond * 50)
+	r.Close()
+
+	select {
+	case err := <-done:
+		if err != io.EOF {
+			t.Error("Read returned unexpected error:", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Read did not return after Close")
+	}
+}
+
+// TestRingCloseDrains tests that data written before Close can still
+// be read, and that io.EOF follows it.
+func TestRingCloseDrains(t *testing.T) {
+	var (
+		r = NewRingBuffer(4)
+		b = make([]byte, 4)
+	)
+
+	r.Write([]byte("Hello"))
+	r.Write([]byte("World"))
+	r.Close()
+
+	if n, err := r.Write([]byte("Closed")); n != 0 || err != io.EOF {
+		t.Errorf("Write after Close returned %d, %v", n, err)
+	}
+
+	var got []byte
+	for {
+		n, err := r.Read(b)
+		got = append(got, b[:n]...)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal("Read returned unexpected error:", err)
+		}
+	}
+
+	if string(got) != "HelloWorld" {
+		t.Errorf("Received different value than expected: %s != HelloWorld", got)
+	}
+}
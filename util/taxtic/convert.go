@@ -132,3 +132,9 @@ func Encoding(charset string) encoding.Encoding {
 	}
 	return nil
 }
+
+// Supported returns true if Convert knows the charset given
+func Supported(charset string) bool {
+	c := strings.ToLower(strings.Replace(charset, "-", "", -1))
+	return c == "utf8" || Encoding(c) != nil
+}